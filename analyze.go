@@ -0,0 +1,168 @@
+package lm2
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// SpaceReport describes how the space of a collection's files is used.
+type SpaceReport struct {
+	// FileSize and WALSize are the sizes of the data file and the WAL.
+	FileSize int64
+	WALSize  int64
+	// Header is the size of the file header.
+	Header int64
+
+	// Records in the record chain, by state. Live counts the live records
+	// of the collection's own keys, and Indexes, Metadata and SharedValues
+	// the live index entries, metadata entries and deduplicated values.
+	// Overwritten records are of keys that were set again, Deleted ones of
+	// keys that were deleted and not set again, and Expired ones haven't
+	// been deleted yet. Compaction reclaims all but the live records.
+	Live         SpaceUsage
+	Indexes      SpaceUsage
+	Metadata     SpaceUsage
+	SharedValues SpaceUsage
+	Expired      SpaceUsage
+	Deleted      SpaceUsage
+	Overwritten  SpaceUsage
+
+	// Commits is the committed space outside of the record chain: the
+	// sentinels written by every commit, and records of failed commits.
+	Commits int64
+	// Uncommitted is the size of the data written after the last commit,
+	// which is truncated the next time the collection is opened.
+	Uncommitted int64
+
+	// Prefixes breaks the records of the collection's own keys down by
+	// key prefix, largest first.
+	Prefixes []PrefixUsage
+}
+
+// SpaceUsage is the number and total size of a set of records.
+type SpaceUsage struct {
+	Records int
+	Bytes   int64
+}
+
+func (u *SpaceUsage) add(size int64) {
+	u.Records++
+	u.Bytes += size
+}
+
+// PrefixUsage is the space used by the records of keys with a prefix.
+type PrefixUsage struct {
+	Prefix string
+	// Live is the space used by live records, and Garbage
+	// the space used by the others.
+	Live    SpaceUsage
+	Garbage SpaceUsage
+}
+
+// Analyze walks every record in the collection and reports where the
+// space of its files goes. Keys are grouped by their first prefixLen
+// bytes, so a prefixLen of 0 puts every key in one group. It is meant for
+// inspection tools, and can be run on a collection opened read-only.
+func (c *Collection) Analyze(prefixLen int) (*SpaceReport, error) {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+	info, err := c.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	report := &SpaceReport{
+		FileSize: info.Size(),
+		Header:   fileHeaderSize,
+	}
+	if c.wal != nil {
+		if info, err = c.wal.f.Stat(); err != nil {
+			return nil, err
+		}
+		report.WALSize = info.Size()
+	}
+	if report.FileSize > c.LastCommit {
+		report.Uncommitted = report.FileSize - c.LastCommit
+	}
+
+	now := time.Now().UnixNano()
+	prefixes := map[string]*PrefixUsage{}
+	chain := int64(0)
+	var prev *record
+	for offset := c.Head; offset != 0; {
+		rec, err := c.readRecordAfter(prev, offset)
+		if err != nil {
+			return nil, err
+		}
+		rec.lock.RLock()
+		header := rec.recordHeader
+		key := rec.Key
+		rec.lock.RUnlock()
+
+		size := int64(recordHeaderSize) + int64(header.KeyLen) + int64(header.ValLen)
+		chain += size
+		// An overwritten record is followed by the record that replaced it.
+		overwritten := false
+		if header.Deleted != 0 && header.Next != 0 {
+			next, err := c.readRecordAfter(rec, header.Next)
+			if err != nil {
+				return nil, err
+			}
+			overwritten = next.Key == key
+		}
+		live := false
+		switch {
+		case overwritten:
+			report.Overwritten.add(size)
+		case header.Deleted != 0:
+			report.Deleted.add(size)
+		case header.Expires != 0 && header.Expires <= now:
+			report.Expired.add(size)
+		case strings.HasPrefix(key, indexKeyPrefix):
+			report.Indexes.add(size)
+		case strings.HasPrefix(key, metaKeyPrefix):
+			report.Metadata.add(size)
+		case isBlobKey(key):
+			report.SharedValues.add(size)
+		default:
+			report.Live.add(size)
+			live = true
+		}
+
+		if !isReservedKey(key) {
+			prefix := key
+			if prefixLen >= 0 && len(prefix) > prefixLen {
+				prefix = prefix[:prefixLen]
+			}
+			usage := prefixes[prefix]
+			if usage == nil {
+				usage = &PrefixUsage{Prefix: prefix}
+				prefixes[prefix] = usage
+			}
+			if live {
+				usage.Live.add(size)
+			} else {
+				usage.Garbage.add(size)
+			}
+		}
+		prev = rec
+		offset = header.Next
+	}
+	report.Commits = c.LastCommit - fileHeaderSize - chain
+
+	for _, usage := range prefixes {
+		report.Prefixes = append(report.Prefixes, *usage)
+	}
+	sort.Slice(report.Prefixes, func(i, j int) bool {
+		a, b := report.Prefixes[i], report.Prefixes[j]
+		if a.Live.Bytes+a.Garbage.Bytes != b.Live.Bytes+b.Garbage.Bytes {
+			return a.Live.Bytes+a.Garbage.Bytes > b.Live.Bytes+b.Garbage.Bytes
+		}
+		return a.Prefix < b.Prefix
+	})
+	return report, nil
+}
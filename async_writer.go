@@ -0,0 +1,191 @@
+package lm2
+
+import (
+	"sync"
+	"time"
+)
+
+// AsyncWriter buffers sets and deletes and commits them to a collection
+// in batches from a background goroutine. Batching amortizes the cost of
+// writing the WAL and file header and of syncing over many writes.
+//
+// Buffered writes are not visible to readers until they are committed.
+// The writes of a commit that fails are discarded, and the error is
+// returned by every write method, Flush, Close and the reads of the
+// writer's sessions from then on, until it is acknowledged with
+// ClearError. An AsyncWriter is safe for concurrent use.
+type AsyncWriter struct {
+	collection *Collection
+	maxOps     int
+
+	lock sync.Mutex
+	wb   *WriteBatch
+	ops  int
+	err  error // the error of a failed commit until it is cleared
+
+	// seq counts buffered writes, and committed
+	// is the seq of the last write committed.
+	seq       uint64
+	committed uint64
+
+	// flushLock serializes commits so that batches are
+	// committed in the order they were buffered.
+	flushLock sync.Mutex
+
+	flush chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// NewAsyncWriter returns an AsyncWriter that commits buffered writes
+// every interval, or as soon as maxOps writes are buffered.
+func (c *Collection) NewAsyncWriter(maxOps int, interval time.Duration) *AsyncWriter {
+	w := &AsyncWriter{
+		collection: c,
+		maxOps:     maxOps,
+		wb:         NewWriteBatch(),
+		flush:      make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	c.backgroundLock.Lock()
+	if c.asyncWriters == nil {
+		c.asyncWriters = map[*AsyncWriter]struct{}{}
+	}
+	c.asyncWriters[w] = struct{}{}
+	c.backgroundLock.Unlock()
+	go w.run(interval)
+	return w
+}
+
+func (w *AsyncWriter) run(interval time.Duration) {
+	defer close(w.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.flush:
+		case <-w.stop:
+			return
+		}
+		w.Flush()
+	}
+}
+
+// Set buffers a set of key to value.
+func (w *AsyncWriter) Set(key, value string) error {
+	return w.buffer(func(wb *WriteBatch) {
+		delete(wb.deletes, key)
+		wb.Set(key, value)
+	})
+}
+
+// SetWithTTL buffers a set of key to value that expires ttl
+// after SetWithTTL is called.
+func (w *AsyncWriter) SetWithTTL(key, value string, ttl time.Duration) error {
+	return w.buffer(func(wb *WriteBatch) {
+		delete(wb.deletes, key)
+		wb.SetWithTTL(key, value, ttl)
+	})
+}
+
+// Delete buffers a delete of key.
+func (w *AsyncWriter) Delete(key string) error {
+	return w.buffer(func(wb *WriteBatch) {
+		delete(wb.sets, key)
+		delete(wb.expires, key)
+		wb.Delete(key)
+	})
+}
+
+// buffer applies op to the buffered batch. It returns the error
+// of a failed commit instead, if there was one.
+func (w *AsyncWriter) buffer(op func(*WriteBatch)) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	op(w.wb)
+	w.ops++
+	w.seq++
+	if w.ops >= w.maxOps {
+		select {
+		case w.flush <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Flush commits buffered writes and waits for the commit to complete.
+func (w *AsyncWriter) Flush() error {
+	w.flushLock.Lock()
+	defer w.flushLock.Unlock()
+
+	w.lock.Lock()
+	if w.err != nil {
+		w.lock.Unlock()
+		return w.err
+	}
+	wb, ops, seq := w.wb, w.ops, w.seq
+	w.wb, w.ops = NewWriteBatch(), 0
+	w.lock.Unlock()
+	if ops == 0 {
+		return nil
+	}
+	_, err := w.collection.Update(wb)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if err != nil {
+		w.err = err
+		return err
+	}
+	w.committed = seq
+	return nil
+}
+
+// ClearError acknowledges a failed commit, whose writes were discarded,
+// and returns its error, or nil if no commit has failed. Writes can be
+// buffered again after ClearError.
+func (w *AsyncWriter) ClearError() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	err := w.err
+	w.err = nil
+	return err
+}
+
+// failed returns the error of a failed commit that hasn't been cleared.
+func (w *AsyncWriter) failed() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.err
+}
+
+// flushed reports whether every write up to seq has been committed.
+func (w *AsyncWriter) flushed(seq uint64) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.committed >= seq
+}
+
+// lastSeq returns the seq of the last buffered write.
+func (w *AsyncWriter) lastSeq() uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.seq
+}
+
+// Close stops the background goroutine and commits buffered writes.
+// The AsyncWriter must not be used after Close.
+func (w *AsyncWriter) Close() error {
+	close(w.stop)
+	<-w.done
+	c := w.collection
+	c.backgroundLock.Lock()
+	delete(c.asyncWriters, w)
+	c.backgroundLock.Unlock()
+	return w.Flush()
+}
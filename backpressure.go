@@ -0,0 +1,118 @@
+package lm2
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrBusy is returned by updates rejected by BackpressureError.
+var ErrBusy = errors.New("lm2: too much garbage, waiting for compaction")
+
+// maxBackpressureDelay is the longest delay BackpressureDelay
+// adds to an update.
+const maxBackpressureDelay = 100 * time.Millisecond
+
+// BackpressurePolicy controls what happens to updates when deleted and
+// overwritten records make up too much of the data file.
+type BackpressurePolicy int
+
+const (
+	// BackpressureNone never throttles updates. This is the default policy.
+	BackpressureNone BackpressurePolicy = iota
+	// BackpressureBlock compacts the collection before the update.
+	BackpressureBlock
+	// BackpressureError rejects the update with ErrBusy and starts a
+	// compaction in the background.
+	BackpressureError
+	// BackpressureDelay starts a compaction in the background and delays
+	// the update by up to 100ms, in proportion to how far the garbage
+	// ratio is over the limit.
+	BackpressureDelay
+)
+
+// SetBackpressure sets the backpressure policy of the collection. The
+// policy applies to updates made while the ratio of deleted and
+// overwritten records to all records in the data file is over
+// maxGarbageRatio, unless cursors or snapshots are open, which the
+// compaction would have to wait for. If onStall is not nil, it is called
+// with the time an update was stalled for every time the policy applies.
+func (c *Collection) SetBackpressure(policy BackpressurePolicy, maxGarbageRatio float64, onStall func(time.Duration)) {
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+	c.backpressure = policy
+	c.maxGarbageRatio = maxGarbageRatio
+	c.onStall = onStall
+}
+
+// garbageOver returns how far the garbage ratio is over the limit as a
+// fraction of the distance from the limit to 1, or 0 if it isn't over.
+// The caller must hold metaLock.
+func (c *Collection) garbageOver() (float64, error) {
+	if err := c.loadCounts(); err != nil {
+		return 0, err
+	}
+	total := c.liveRecords + c.deletedRecords
+	if total == 0 {
+		return 0, nil
+	}
+	ratio := float64(c.deletedRecords) / float64(total)
+	if ratio <= c.maxGarbageRatio {
+		return 0, nil
+	}
+	if c.maxGarbageRatio >= 1 {
+		return 1, nil
+	}
+	return (ratio - c.maxGarbageRatio) / (1 - c.maxGarbageRatio), nil
+}
+
+// throttle applies the backpressure policy before an update.
+func (c *Collection) throttle() error {
+	c.metaLock.Lock()
+	policy, onStall := c.backpressure, c.onStall
+	if policy == BackpressureNone || c.closed {
+		c.metaLock.Unlock()
+		return nil
+	}
+	over, err := c.garbageOver()
+	c.metaLock.Unlock()
+	if err != nil || over == 0 || c.pinned() {
+		// Compaction waits for open cursors and snapshots,
+		// so holding up the update wouldn't help.
+		return err
+	}
+
+	start := time.Now()
+	switch policy {
+	case BackpressureBlock:
+		err = c.compactIfOver()
+	case BackpressureError:
+		c.startCompaction()
+		err = ErrBusy
+	case BackpressureDelay:
+		c.startCompaction()
+		time.Sleep(time.Duration(over * float64(maxBackpressureDelay)))
+	}
+	if onStall != nil {
+		onStall(time.Since(start))
+	}
+	return err
+}
+
+// compactIfOver compacts the collection unless another update already
+// brought the garbage ratio back under the limit, or cursors or
+// snapshots were opened in the meantime.
+func (c *Collection) compactIfOver() (err error) {
+	done := c.startOperation(context.Background(), OpCompact)
+	defer func() { done(err) }()
+	c.compactLock.Lock()
+	defer c.compactLock.Unlock()
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+
+	over, err := c.garbageOver()
+	if err != nil || over == 0 || c.pinned() {
+		return err
+	}
+	return c.compact(context.Background())
+}
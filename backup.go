@@ -0,0 +1,161 @@
+package lm2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"time"
+)
+
+// Backup writes a consistent copy of the latest version of the collection
+// to w as a data file. Only live records are copied, so the backup is
+// also compacted. Reads and updates may continue while the backup is
+// being written. It returns the version the backup was taken at.
+func (c *Collection) Backup(w io.Writer) (int64, error) {
+	// Record offsets have to remain valid for the whole backup, so the
+	// cursors don't need to be counted as open.
+	c.compactLock.RLock()
+	defer c.compactLock.RUnlock()
+
+	snap := c.Snapshot()
+	defer snap.Close()
+	cur, err := snap.newCursor()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { cur.Close() }()
+	// Both passes have to hide the same expired records.
+	now := cur.now
+
+	// First pass: compute the layout of the backup.
+	buf := bytes.NewBuffer(nil)
+	numRecords := 0
+	end := int64(fileHeaderSize)
+	for cur.Next() {
+		if isBlobKey(cur.Key()) {
+			// Shared values are copied into the records set to them.
+			continue
+		}
+		buf.Reset()
+		if err = c.writeRecord(backupRecord(cur), 0, buf); err != nil {
+			return 0, err
+		}
+		numRecords++
+		end += int64(buf.Len())
+	}
+
+	header := fileHeader{
+		Magic:         fileMagic,
+		FormatVersion: formatVersion,
+		Flags:         c.Flags,
+		LastCommit:    end + timedSentinelSize,
+	}
+	if numRecords > 0 {
+		header.Head = fileHeaderSize
+	}
+	if _, err = w.Write(header.bytes()); err != nil {
+		return 0, err
+	}
+
+	// Second pass: write records.
+	cur.Close()
+	cur, err = snap.newCursor()
+	if err != nil {
+		return 0, err
+	}
+	cur.now = now
+	offset := int64(fileHeaderSize)
+	for i := 0; i < numRecords && cur.Next(); {
+		if isBlobKey(cur.Key()) {
+			continue
+		}
+		buf.Reset()
+		if err = c.writeRecord(backupRecord(cur), offset, buf); err != nil {
+			return 0, err
+		}
+		if i < numRecords-1 {
+			// Next is the first field of the encoded record.
+			binary.LittleEndian.PutUint64(buf.Bytes(), uint64(offset)+uint64(buf.Len()))
+		}
+		if _, err = w.Write(buf.Bytes()); err != nil {
+			return 0, err
+		}
+		offset += int64(buf.Len())
+		i++
+	}
+
+	sentinel := sentinelRecord{
+		Magic:     timedSentinelMagic,
+		Offset:    end,
+		Timestamp: time.Now().UnixNano(),
+	}
+	if _, err = w.Write(sentinel.bytes()); err != nil {
+		return 0, err
+	}
+	return snap.Version(), nil
+}
+
+// backupRecord returns a copy of the cursor's current record
+// to be written to a backup.
+func backupRecord(cur *Cursor) *record {
+	return &record{
+		recordHeader: recordHeader{
+			Expires: cur.current.Expires,
+			Flags:   cur.current.Flags & recordCompressionMask,
+		},
+		Key:   cur.Key(),
+		Value: cur.Value(),
+		Meta:  cur.current.Meta,
+	}
+}
+
+// Restore creates a collection at file from a backup written by
+// Backup. Existing files at file are overwritten.
+func Restore(r io.Reader, file string) error {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	// The restored data file is consistent on its own,
+	// so it starts with an empty WAL and cache.
+	if err = resetWALAndCache(file); err != nil {
+		return err
+	}
+
+	// Make sure the backup is a valid collection. The records of an
+	// encrypted backup can't be checked without its key.
+	c, err := OpenCollection(file, 1)
+	if err == ErrEncrypted {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+// resetWALAndCache creates an empty WAL and cache for the data file at
+// file, replacing any existing ones.
+func resetWALAndCache(file string) error {
+	wal, err := newWAL(file + ".wal")
+	if err != nil {
+		return err
+	}
+	wal.Close()
+	cache, err := newCache(0, file+".cache")
+	if err != nil {
+		return err
+	}
+	cache.close()
+	return nil
+}
@@ -0,0 +1,156 @@
+package lm2
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+)
+
+// minBloomFilterKeys is the minimum number of keys
+// a bloom filter is sized for.
+const minBloomFilterKeys = 1024
+
+// bloomFilter is a set of keys that may have false positives.
+type bloomFilter struct {
+	bits              []uint64
+	numHashes         uint64
+	numKeys           int
+	capacity          int
+	falsePositiveRate float64
+}
+
+func newBloomFilter(capacity int, falsePositiveRate float64) *bloomFilter {
+	// Optimal number of bits and hash functions for capacity keys.
+	numBits := math.Ceil(-float64(capacity) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	numHashes := math.Max(1, math.Round(numBits/float64(capacity)*math.Ln2))
+	return &bloomFilter{
+		bits:              make([]uint64, (uint64(numBits)+63)/64),
+		numHashes:         uint64(numHashes),
+		capacity:          capacity,
+		falsePositiveRate: falsePositiveRate,
+	}
+}
+
+// hashes returns the two hashes used to derive the filter's
+// hash functions.
+func (b *bloomFilter) hashes(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h1 := h.Sum64()
+	h2 := h1>>33 | h1<<31
+	return h1, h2 | 1
+}
+
+func (b *bloomFilter) add(key string) {
+	h1, h2 := b.hashes(key)
+	numBits := uint64(len(b.bits)) * 64
+	for i := uint64(0); i < b.numHashes; i++ {
+		bit := (h1 + i*h2) % numBits
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+	b.numKeys++
+}
+
+func (b *bloomFilter) mayContain(key string) bool {
+	h1, h2 := b.hashes(key)
+	numBits := uint64(len(b.bits)) * 64
+	for i := uint64(0); i < b.numHashes; i++ {
+		bit := (h1 + i*h2) % numBits
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// scalableBloomFilter is a bloom filter that grows by adding layers of
+// twice the capacity and half the false positive rate of the last one,
+// which bounds the overall false positive rate at twice the first
+// layer's.
+type scalableBloomFilter struct {
+	layers []*bloomFilter
+}
+
+func newScalableBloomFilter(capacity int, falsePositiveRate float64) *scalableBloomFilter {
+	return &scalableBloomFilter{
+		layers: []*bloomFilter{newBloomFilter(capacity, falsePositiveRate/2)},
+	}
+}
+
+func (b *scalableBloomFilter) add(key string) {
+	last := b.layers[len(b.layers)-1]
+	if last.numKeys >= last.capacity {
+		last = newBloomFilter(2*last.capacity, last.falsePositiveRate/2)
+		b.layers = append(b.layers, last)
+	}
+	last.add(key)
+}
+
+func (b *scalableBloomFilter) mayContain(key string) bool {
+	for _, layer := range b.layers {
+		if layer.mayContain(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetBloomFilter enables a bloom filter of every key in the collection
+// with the given false positive rate, which lets Get return
+// ErrKeyNotFound for most missing keys without reading any records.
+// The filter is kept in memory and is built by walking the record
+// chain, so SetBloomFilter should be called again after reopening
+// the collection. A rate of 0 disables the filter.
+func (c *Collection) SetBloomFilter(falsePositiveRate float64) error {
+	if falsePositiveRate < 0 || falsePositiveRate >= 1 {
+		return errors.New("lm2: false positive rate must be in [0, 1)")
+	}
+
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	if falsePositiveRate == 0 {
+		c.bloom = nil
+		return nil
+	}
+	return c.buildBloomFilter(falsePositiveRate)
+}
+
+// buildBloomFilter replaces the bloom filter with one holding every key
+// in the record chain, including deleted ones so that the filter is
+// valid for older snapshots. The caller must hold metaLock.
+func (c *Collection) buildBloomFilter(falsePositiveRate float64) error {
+	if err := c.loadCounts(); err != nil {
+		return err
+	}
+	capacity := minBloomFilterKeys
+	if records := int(c.liveRecords + c.deletedRecords); capacity < 2*records {
+		capacity = 2 * records
+	}
+
+	bloom := newScalableBloomFilter(capacity, falsePositiveRate)
+	var prev *record
+	for offset := c.Head; offset != 0; {
+		rec, err := c.readRecordAfter(prev, offset)
+		if err != nil {
+			return err
+		}
+		prev = rec
+		rec.lock.RLock()
+		bloom.add(rec.Key)
+		offset = rec.Next
+		rec.lock.RUnlock()
+	}
+	c.bloom = bloom
+	c.bloomFalsePositiveRate = falsePositiveRate
+	return nil
+}
+
+// mayContain returns false if key is definitely not in the collection.
+func (c *Collection) mayContain(key string) bool {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	return c.bloom == nil || c.bloom.mayContain(key)
+}
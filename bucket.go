@@ -0,0 +1,68 @@
+package lm2
+
+// bucketKeyPrefix is the reserved key prefix under which
+// bucket keys are stored.
+const bucketKeyPrefix = "\x00b"
+
+// Bucket is a named keyspace within a collection.
+//
+// Bucket keys are stored in the collection under a prefix derived from
+// the bucket name, so the keys of a bucket are contiguous and never
+// interleave with other buckets.
+type Bucket struct {
+	collection *Collection
+	prefix     string
+}
+
+// Bucket returns a handle to the bucket with the given name.
+// Buckets don't need to be created before they are used.
+func (c *Collection) Bucket(name string) *Bucket {
+	return &Bucket{
+		collection: c,
+		prefix:     bucketPrefix(name),
+	}
+}
+
+// bucketPrefix returns the key prefix of the bucket with the given
+// name. The name is length-prefixed so that no bucket's prefix is
+// a prefix of another's.
+func bucketPrefix(name string) string {
+	return bucketKeyPrefix + lengthPrefixed(name)
+}
+
+// Key returns the collection key that stores key in the bucket.
+// It can be used to include bucket keys in a WriteBatch.
+func (b *Bucket) Key(key string) string {
+	return b.prefix + key
+}
+
+// Get returns the value associated with key in the bucket.
+// ErrKeyNotFound is returned if key does not exist.
+func (b *Bucket) Get(key string) (string, error) {
+	return b.collection.Get(b.Key(key))
+}
+
+// Set sets key to value in the bucket in a single update.
+func (b *Bucket) Set(key, value string) error {
+	return b.collection.Set(b.Key(key), value)
+}
+
+// Delete deletes key from the bucket in a single update.
+func (b *Bucket) Delete(key string) error {
+	return b.collection.Delete(b.Key(key))
+}
+
+// NewCursor returns a new cursor over the bucket's keys with a
+// snapshot view of the current collection state. Keys returned
+// by the cursor don't include the bucket prefix.
+func (b *Bucket) NewCursor() (*Cursor, error) {
+	cur, err := b.collection.NewCursor()
+	if err != nil {
+		return nil, err
+	}
+	cur.prefix = b.prefix
+	cur.start = b.prefix
+	cur.end = prefixEnd(b.prefix)
+	cur.seekFirst(b.prefix)
+	return cur, nil
+}
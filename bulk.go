@@ -0,0 +1,221 @@
+package lm2
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// bulkLoadChunkSize is the number of bytes of records
+// BulkLoad buffers before writing them to the data file.
+const bulkLoadChunkSize = 1 << 20
+
+var (
+	// ErrNotEmpty is returned by BulkLoad when the
+	// collection already has records.
+	ErrNotEmpty = errors.New("lm2: collection is not empty")
+	// ErrUnsorted is returned, wrapped with details, by BulkLoad
+	// when its input keys aren't in increasing order.
+	ErrUnsorted = errors.New("lm2: keys are not in increasing order")
+)
+
+// KeyValueIterator iterates over key-value pairs. A Cursor
+// is a KeyValueIterator.
+type KeyValueIterator interface {
+	// Next moves to the next pair, and returns false
+	// when there are no more pairs.
+	Next() bool
+	Key() string
+	Value() string
+	// Err returns the error, if any, that stopped the iteration.
+	Err() error
+}
+
+// BulkLoad sets every key-value pair from it in a single update, which
+// is much faster than setting them with Update. It is meant for loading
+// an empty collection: ErrNotEmpty is returned if the collection has ever
+// had records. The keys must be in strictly increasing order, or
+// ErrUnsorted is returned; the records are written one after the other,
+// in the order they are read. The collection is left unchanged if
+// BulkLoad fails. It returns the new version.
+//
+// Values are compressed, encrypted and checksummed like values set by
+// Update, but not deduplicated until the collection is compacted. Indexes
+// are built once all the records have been written, in a second update.
+// Subscriptions aren't sent the changes; use ChangesSince to read them.
+func (c *Collection) BulkLoad(it KeyValueIterator) (int64, error) {
+	if c.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	done := c.startOperation(context.Background(), OpUpdate)
+	version, err := c.bulkLoad(it)
+	if err == nil {
+		err = c.rebuildIndexes()
+	}
+	done(err)
+	return version, err
+}
+
+func (c *Collection) bulkLoad(it KeyValueIterator) (int64, error) {
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+
+	if c.closed {
+		return 0, ErrClosed
+	}
+	if c.Head != 0 {
+		return 0, ErrNotEmpty
+	}
+	start, err := c.f.Seek(0, 2)
+	if err != nil {
+		return 0, fmt.Errorf("lm2: couldn't get current file offset: %w", err)
+	}
+
+	n, sampled, err := c.appendSorted(it, start)
+	if err != nil {
+		// Nothing after the last commit is part of the collection.
+		c.f.Truncate(c.LastCommit)
+		return 0, err
+	}
+	if n == 0 {
+		return c.LastCommit, nil
+	}
+
+	committed := time.Now().UnixNano()
+	version, err := c.writeSentinel(committed)
+	if err != nil {
+		return 0, err
+	}
+	if c.syncPolicy == SyncAlways {
+		if err = c.f.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	c.Head = start
+	c.LastCommit = version
+	if err = c.commitWAL(newWALEntry()); err != nil {
+		return 0, err
+	}
+
+	for _, rec := range sampled {
+		c.cache.forcePush(rec)
+	}
+	c.stats.incRecordsWritten(uint64(n))
+	if c.countsLoaded {
+		c.liveRecords += uint64(n)
+	}
+	if c.commitTimesLoaded {
+		c.commitTimes = append(c.commitTimes, commitTime{
+			version:   c.LastCommit,
+			timestamp: committed,
+		})
+	}
+	if c.metrics != nil {
+		c.metrics.ObserveRecords(n, 0)
+	}
+	if c.syncPolicy != SyncAlways {
+		return c.LastCommit, nil
+	}
+	return c.LastCommit, c.f.Sync()
+}
+
+// appendSorted appends records with the pairs from it to the data file,
+// starting at offset, each linked to the next. It returns the number of
+// records and a sample of them, evenly spread by key, for the record
+// cache. The caller must hold metaLock.
+func (c *Collection) appendSorted(it KeyValueIterator, offset int64) (int, []*record, error) {
+	chunk := bytes.NewBuffer(nil)
+	chunkOffset := offset
+	buf := bytes.NewBuffer(nil)
+	var sampled []*record
+	stride := 1
+	n := 0
+	prev := ""
+	for more := it.Next(); more; n++ {
+		key, value := it.Key(), it.Value()
+		if n > 0 && key <= prev {
+			return 0, nil, fmt.Errorf("%w: %q after %q", ErrUnsorted, truncateKey(key), truncateKey(prev))
+		}
+		if isReservedKey(key) {
+			return 0, nil, reservedKeyError(key)
+		}
+		if err := c.checkSize(key, len(value)); err != nil {
+			return 0, nil, err
+		}
+		prev = key
+		more = it.Next()
+
+		rec := &record{
+			recordHeader: recordHeader{
+				Flags: uint16(c.compression),
+			},
+			Key:   key,
+			Value: value,
+		}
+		buf.Reset()
+		if err := c.writeRecord(rec, offset, buf); err != nil {
+			return 0, nil, err
+		}
+		if more {
+			// Next is the first field of the encoded record.
+			rec.Next = offset + int64(buf.Len())
+			binary.LittleEndian.PutUint64(buf.Bytes(), uint64(rec.Next))
+		}
+		chunk.Write(buf.Bytes())
+		offset += int64(buf.Len())
+
+		if c.bloom != nil {
+			c.bloom.add(key)
+		}
+		if c.cache.size > 0 && n%stride == 0 {
+			if len(sampled) == c.cache.size {
+				// Keep every other record.
+				for i := 0; i < len(sampled)/2; i++ {
+					sampled[i] = sampled[2*i]
+				}
+				sampled = sampled[:len(sampled)/2]
+				stride *= 2
+			}
+			if n%stride == 0 {
+				sampled = append(sampled, rec)
+			}
+		}
+
+		if chunk.Len() >= bulkLoadChunkSize || !more {
+			if _, err := c.f.WriteAt(chunk.Bytes(), chunkOffset); err != nil {
+				return 0, nil, err
+			}
+			chunkOffset = offset
+			chunk.Reset()
+		}
+	}
+	if err := it.Err(); err != nil {
+		return 0, nil, err
+	}
+	return n, sampled, nil
+}
+
+// rebuildIndexes brings every index up to date in a single update.
+func (c *Collection) rebuildIndexes() error {
+	c.metaLock.RLock()
+	indexed := len(c.indexes) > 0
+	c.metaLock.RUnlock()
+	if !indexed {
+		return nil
+	}
+
+	wb := NewWriteBatch()
+	_, err := c.update(wb, func() error {
+		for name, extract := range c.indexes {
+			if err := c.buildIndex(wb, name, extract); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err
+}
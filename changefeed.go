@@ -0,0 +1,282 @@
+package lm2
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ErrUnknownVersion is returned when a version doesn't
+// correspond to a commit in the data file.
+var ErrUnknownVersion = errors.New("lm2: unknown version")
+
+// Change is a committed set or delete of a key. Changes of reserved
+// keys aren't reported.
+type Change struct {
+	// Version is the collection version that made the change.
+	Version int64
+	Key     string
+	Value   string
+	// Expires is the value's expiration time in Unix nanoseconds,
+	// or 0 if it doesn't expire.
+	Expires int64
+	// Meta is the value's metadata, or nil if it has none.
+	Meta    map[string]string
+	Deleted bool
+}
+
+// Subscription delivers committed changes on C, in commit order.
+// Changes are queued in memory until they are received, so a
+// subscriber that falls behind doesn't block updates.
+type Subscription struct {
+	C <-chan Change
+
+	collection *Collection
+	c          chan Change
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	queue   []Change
+	stopped bool
+	stop    chan struct{}
+}
+
+// Subscribe returns a subscription to changes committed after version
+// from. Changes since from that are still in the data file are
+// delivered first; changes removed by compaction are not. A from of 0
+// delivers every change in the data file. Compaction doesn't produce
+// changes, but it does renumber versions. The subscription is stopped
+// when the collection is closed.
+func (c *Collection) Subscribe(from int64) (*Subscription, error) {
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+	changes, err := c.changesSince(from, false)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan Change)
+	s := &Subscription{
+		C:          ch,
+		collection: c,
+		c:          ch,
+		queue:      changes,
+		stop:       make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.lock)
+	if c.subscriptions == nil {
+		c.subscriptions = map[*Subscription]struct{}{}
+	}
+	c.subscriptions[s] = struct{}{}
+	go s.run()
+	return s, nil
+}
+
+// Stop ends the subscription and closes C. Changes that haven't
+// been received are dropped.
+func (s *Subscription) Stop() {
+	s.collection.metaLock.Lock()
+	delete(s.collection.subscriptions, s)
+	s.collection.metaLock.Unlock()
+	s.close()
+}
+
+func (s *Subscription) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stopped {
+		return
+	}
+	s.stopped = true
+	close(s.stop)
+	s.cond.Broadcast()
+}
+
+func (s *Subscription) publish(changes []Change) {
+	s.lock.Lock()
+	s.queue = append(s.queue, changes...)
+	s.cond.Broadcast()
+	s.lock.Unlock()
+}
+
+func (s *Subscription) run() {
+	defer close(s.c)
+	for {
+		s.lock.Lock()
+		for len(s.queue) == 0 && !s.stopped {
+			s.cond.Wait()
+		}
+		if s.stopped {
+			s.lock.Unlock()
+			return
+		}
+		change := s.queue[0]
+		s.queue = s.queue[1:]
+		s.lock.Unlock()
+
+		select {
+		case s.c <- change:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// publish sends changes to every subscription.
+// The caller must hold metaLock.
+func (c *Collection) publish(changes []Change) {
+	if len(changes) == 0 {
+		return
+	}
+	for s := range c.subscriptions {
+		s.publish(changes)
+	}
+}
+
+// stopSubscriptions stops every subscription.
+// The caller must hold metaLock.
+func (c *Collection) stopSubscriptions() {
+	for s := range c.subscriptions {
+		delete(c.subscriptions, s)
+		s.close()
+	}
+}
+
+// changesSince returns the changes committed after version from that
+// are still in the data file, in commit order, including the changes of
+// metadata entries if metadata is true. The caller must hold metaLock.
+func (c *Collection) changesSince(from int64, metadata bool) ([]Change, error) {
+	if from < fileHeaderSize {
+		from = fileHeaderSize
+	}
+	if from > c.LastCommit {
+		return nil, ErrUnknownVersion
+	}
+	if from > fileHeaderSize {
+		if _, ok := c.commitAt(from); !ok {
+			return nil, ErrUnknownVersion
+		}
+	}
+
+	versions := map[int64]int64{}
+	err := c.scanCommits(from, func(records []int64, version int64) bool {
+		for _, offset := range records {
+			versions[offset] = version
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Records after from are sets. Records deleted after from are
+	// deletes, unless they were overwritten by a later set.
+	type keyVersion struct {
+		key     string
+		version int64
+	}
+	changes := []Change{}
+	sets := map[keyVersion]struct{}{}
+	var deletes []Change
+	var prev *record
+	for offset := c.Head; offset != 0; {
+		rec, err := c.readRecordAfter(prev, offset)
+		if err != nil {
+			return nil, err
+		}
+		prev = rec
+		rec.lock.RLock()
+		if isReservedKey(rec.Key) && !(metadata && isMetaKey(rec.Key)) {
+			// Shared values are part of the changes of their keys, and
+			// the collection's other entries aren't changes, except for
+			// metadata entries when they are asked for.
+			offset = rec.Next
+			rec.lock.RUnlock()
+			continue
+		}
+		if version, ok := versions[rec.Offset]; ok {
+			changes = append(changes, Change{
+				Version: version,
+				Key:     rec.Key,
+				Value:   rec.Value,
+				Expires: rec.Expires,
+				Meta:    rec.Meta,
+			})
+			sets[keyVersion{rec.Key, version}] = struct{}{}
+		}
+		if rec.Deleted > from {
+			deletes = append(deletes, Change{
+				Version: rec.Deleted,
+				Key:     rec.Key,
+				Deleted: true,
+			})
+		}
+		offset = rec.Next
+		rec.lock.RUnlock()
+	}
+	for _, change := range deletes {
+		if _, ok := sets[keyVersion{change.Key, change.Version}]; !ok {
+			changes = append(changes, change)
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].Version != changes[j].Version {
+			return changes[i].Version < changes[j].Version
+		}
+		return changes[i].Key < changes[j].Key
+	})
+	return changes, nil
+}
+
+// ChangesSince returns the changes committed after version from that
+// are still in the data file, in commit order. A from of 0 returns every
+// change in the data file. Changes removed by compaction are not
+// returned, so a follower that falls behind a compaction must be
+// reseeded, for example from a Backup.
+func (c *Collection) ChangesSince(from int64) ([]Change, error) {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+	return c.changesSince(from, false)
+}
+
+// ApplyChanges applies changes from another collection, as returned by
+// ChangesSince or delivered by a Subscription, in order. Changes with the
+// same version are applied in a single update. The versions of the
+// collection are its own; a follower should track the Version of the
+// last change it applied to know where to resume from.
+func (c *Collection) ApplyChanges(changes []Change) error {
+	return c.applyChanges(changes, false)
+}
+
+// applyChanges is like ApplyChanges, but applies the changes of metadata
+// entries as well if metadata is true.
+func (c *Collection) applyChanges(changes []Change, metadata bool) error {
+	for len(changes) > 0 {
+		wb := NewWriteBatch()
+		n := 0
+		for ; n < len(changes) && changes[n].Version == changes[0].Version; n++ {
+			change := changes[n]
+			if metadata && isMetaKey(change.Key) {
+				wb.entries[change.Key] = struct{}{}
+			}
+			if change.Deleted {
+				wb.Delete(change.Key)
+			} else {
+				wb.setExpiresAt(change.Key, change.Value, change.Expires)
+				wb.setRecordMeta(change.Key, change.Meta)
+			}
+		}
+		if _, err := c.Update(wb); err != nil {
+			return err
+		}
+		changes = changes[n:]
+	}
+	return nil
+}
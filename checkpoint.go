@@ -0,0 +1,218 @@
+package lm2
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+var (
+	// ErrCheckpointExists is returned when creating a checkpoint
+	// with the name of an existing checkpoint.
+	ErrCheckpointExists = errors.New("lm2: checkpoint already exists")
+	// ErrCheckpointed is returned by Compact while the collection has
+	// checkpoints. Compaction would remove the records they read.
+	ErrCheckpointed = errors.New("lm2: collection has checkpoints")
+)
+
+// CheckpointInfo describes a checkpoint.
+type CheckpointInfo struct {
+	Name    string
+	Version int64
+}
+
+// Checkpoint creates a named checkpoint of the current collection state
+// that can be opened with OpenCheckpoint until it is dropped. The data
+// file is append-only, so a checkpoint only pins a version: records are
+// never modified in place, and the ones it reads are kept because the
+// collection can't be compacted while it has checkpoints. Checkpoints are
+// saved in a file next to the data file and survive reopening the
+// collection; checkpoints of in-memory collections don't. Names may be up
+// to 65535 bytes long.
+func (c *Collection) Checkpoint(name string) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+	if err := c.loadCheckpoints(); err != nil {
+		return err
+	}
+	if _, ok := c.checkpoints[name]; ok {
+		return ErrCheckpointExists
+	}
+	// The checkpoint must not outlive the commit it points to.
+	if err := c.sync(); err != nil {
+		return err
+	}
+	c.checkpoints[name] = c.LastCommit
+	if err := c.saveCheckpoints(); err != nil {
+		delete(c.checkpoints, name)
+		return err
+	}
+	return nil
+}
+
+// Checkpoints returns the checkpoints of the collection, oldest first.
+func (c *Collection) Checkpoints() ([]CheckpointInfo, error) {
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+	if err := c.loadCheckpoints(); err != nil {
+		return nil, err
+	}
+	checkpoints := make([]CheckpointInfo, 0, len(c.checkpoints))
+	for name, version := range c.checkpoints {
+		checkpoints = append(checkpoints, CheckpointInfo{Name: name, Version: version})
+	}
+	sort.Slice(checkpoints, func(i, j int) bool {
+		if checkpoints[i].Version != checkpoints[j].Version {
+			return checkpoints[i].Version < checkpoints[j].Version
+		}
+		return checkpoints[i].Name < checkpoints[j].Name
+	})
+	return checkpoints, nil
+}
+
+// OpenCheckpoint returns a snapshot of the collection as of the checkpoint
+// with the given name. ErrDoesNotExist is returned if there isn't one.
+// The snapshot must not be used after the checkpoint is dropped.
+func (c *Collection) OpenCheckpoint(name string) (*Snapshot, error) {
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+	if err := c.loadCheckpoints(); err != nil {
+		return nil, err
+	}
+	version, ok := c.checkpoints[name]
+	if !ok {
+		return nil, ErrDoesNotExist
+	}
+	return c.snapshotAt(version), nil
+}
+
+// DropCheckpoint removes the checkpoint with the given name.
+// ErrDoesNotExist is returned if there isn't one.
+func (c *Collection) DropCheckpoint(name string) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+	if err := c.loadCheckpoints(); err != nil {
+		return err
+	}
+	version, ok := c.checkpoints[name]
+	if !ok {
+		return ErrDoesNotExist
+	}
+	delete(c.checkpoints, name)
+	if err := c.saveCheckpoints(); err != nil {
+		c.checkpoints[name] = version
+		return err
+	}
+	return nil
+}
+
+// checkpointsFile returns the name of the file checkpoints are saved in.
+func (c *Collection) checkpointsFile() string {
+	return c.f.Name() + ".checkpoints"
+}
+
+// loadCheckpoints reads the saved checkpoints if they haven't been read
+// yet. The file is a sequence of entries, each encoded as:
+//
+//	0  Version int64
+//	8  NameLen uint16
+//	10 Name
+//
+// The caller must hold metaLock exclusively.
+func (c *Collection) loadCheckpoints() error {
+	if c.checkpoints != nil {
+		return nil
+	}
+	checkpoints := map[string]int64{}
+	if c.memory {
+		c.checkpoints = checkpoints
+		return nil
+	}
+	b, err := ioutil.ReadFile(c.checkpointsFile())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for len(b) > 0 {
+		if len(b) < 10 {
+			return errCorrupt("partial checkpoint entry")
+		}
+		version := int64(binary.LittleEndian.Uint64(b[0:]))
+		nameLen := int(binary.LittleEndian.Uint16(b[8:]))
+		if len(b) < 10+nameLen {
+			return errCorrupt("partial checkpoint entry")
+		}
+		if version < fileHeaderSize || version > c.LastCommit {
+			return errCorrupt("invalid checkpoint version %d", version)
+		}
+		checkpoints[string(b[10:10+nameLen])] = version
+		b = b[10+nameLen:]
+	}
+	c.checkpoints = checkpoints
+	return nil
+}
+
+// saveCheckpoints replaces the checkpoints file with the current
+// checkpoints. The caller must hold metaLock exclusively.
+func (c *Collection) saveCheckpoints() error {
+	if c.memory {
+		return nil
+	}
+	file := c.checkpointsFile()
+	if len(c.checkpoints) == 0 {
+		err := os.Remove(file)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var b []byte
+	for name, version := range c.checkpoints {
+		entry := make([]byte, 10+len(name))
+		binary.LittleEndian.PutUint64(entry[0:], uint64(version))
+		binary.LittleEndian.PutUint16(entry[8:], uint16(len(name)))
+		copy(entry[10:], name)
+		b = append(b, entry...)
+	}
+	f, err := os.Create(file + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file+".tmp", file)
+	}
+	if err != nil {
+		os.Remove(file + ".tmp")
+	}
+	return err
+}
@@ -0,0 +1,53 @@
+package lm2
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// recordChecksum is set in the flags of a record whose stored value is
+// prefixed with a CRC-32 of its key and stored value.
+const recordChecksum = 1 << 3
+
+// checksumSize is the size of a record checksum.
+const checksumSize = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// SetChecksums enables or disables record checksums for new records.
+// A record with a checksum has its key and stored value checked when
+// it is read from the data file, so that damaged records return an
+// ErrCorrupt error instead of wrong data. Records written before
+// checksums were enabled aren't checked.
+func (c *Collection) SetChecksums(enabled bool) {
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+	c.checksums = enabled
+}
+
+func recordCRC(key string, stored []byte) uint32 {
+	crc := crc32.Update(0, castagnoli, []byte(key))
+	return crc32.Update(crc, castagnoli, stored)
+}
+
+// addChecksum returns stored prefixed with the checksum of key and stored.
+func addChecksum(key string, stored []byte) []byte {
+	b := make([]byte, checksumSize+len(stored))
+	binary.LittleEndian.PutUint32(b, recordCRC(key, stored))
+	copy(b[checksumSize:], stored)
+	return b
+}
+
+// checkChecksum verifies and strips the checksum of
+// the record at offset.
+func checkChecksum(offset int64, key string, stored []byte) ([]byte, error) {
+	if len(stored) < checksumSize {
+		return nil, errCorrupt("record at offset %d is too short for its checksum", offset)
+	}
+	sum := binary.LittleEndian.Uint32(stored)
+	stored = stored[checksumSize:]
+	if recordCRC(key, stored) != sum {
+		return nil, errCorrupt("checksum mismatch in record %q at offset %d", key, offset)
+	}
+	return stored, nil
+}
@@ -0,0 +1,55 @@
+package lm2
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// Clone copies the collection as of its latest version to a new
+// collection at file, which must not be the collection's own file.
+// Unlike Backup, the data file is copied as is, with every version still
+// in it, so the clone supports the same snapshots and history. The copy
+// is done by the kernel, which can share the data on file systems that
+// support it. Updates wait until the copy is complete. Existing files at
+// file are overwritten. The clone has no checkpoints, and an encrypted
+// collection must be opened with the same key.
+func (c *Collection) Clone(file string) error {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	if c.closed {
+		return ErrClosed
+	}
+	if info, err := os.Stat(file); err == nil {
+		if self, err := c.f.Stat(); err == nil && os.SameFile(info, self) {
+			return errors.New("lm2: can't clone a collection onto its own file")
+		}
+	}
+
+	var src io.Reader = io.NewSectionReader(c.f, 0, c.LastCommit)
+	if !c.memory {
+		// A file of its own keeps c.f's offset unchanged and lets
+		// io.Copy use copy_file_range.
+		f, err := os.Open(c.f.Name())
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		src = io.LimitReader(f, c.LastCommit)
+	}
+
+	dst, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	dst.Close()
+	if err != nil {
+		return err
+	}
+	// Everything up to the last commit is in the data file.
+	return resetWALAndCache(file)
+}
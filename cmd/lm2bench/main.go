@@ -0,0 +1,96 @@
+// Command lm2bench generates load against an lm2 collection and
+// reports throughput for writes, point reads, and scans.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/Preetam/lm2"
+)
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Llongfile)
+	filename := flag.String("file", "/tmp/lm2bench.lm2", "data file to create")
+	records := flag.Int("records", 100000, "number of records to write")
+	keySize := flag.Int("key-size", 16, "key size in bytes")
+	valueSize := flag.Int("value-size", 100, "value size in bytes")
+	batchSize := flag.Int("batch", 100, "records per update")
+	reads := flag.Int("reads", 100000, "number of random point reads")
+	cacheSize := flag.Int("cache-size", 100, "record cache size")
+	noSync := flag.Bool("no-sync", false, "don't sync the data file after every update")
+	keep := flag.Bool("keep", false, "keep the data file after the run")
+	flag.Parse()
+
+	c, err := lm2.NewCollection(*filename, *cacheSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *noSync {
+		c.SetSyncPolicy(lm2.SyncNever, 0)
+	}
+	defer func() {
+		if *keep {
+			c.Close()
+			return
+		}
+		c.Destroy()
+	}()
+
+	key := func(i int) string {
+		return fmt.Sprintf("%0*d", *keySize, i)
+	}
+	value := strings.Repeat("v", *valueSize)
+
+	start := time.Now()
+	wb := lm2.NewWriteBatch()
+	n := 0
+	for _, i := range rand.Perm(*records) {
+		wb.Set(key(i), value)
+		n++
+		if n == *batchSize {
+			if _, err = c.Update(wb); err != nil {
+				log.Fatal(err)
+			}
+			wb = lm2.NewWriteBatch()
+			n = 0
+		}
+	}
+	if n > 0 {
+		if _, err = c.Update(wb); err != nil {
+			log.Fatal(err)
+		}
+	}
+	report("write", *records, time.Since(start))
+
+	start = time.Now()
+	for i := 0; i < *reads; i++ {
+		if _, err = c.Get(key(rand.Intn(*records))); err != nil {
+			log.Fatal(err)
+		}
+	}
+	report("read", *reads, time.Since(start))
+
+	start = time.Now()
+	cur, err := c.NewCursor()
+	if err != nil {
+		log.Fatal(err)
+	}
+	scanned := 0
+	for cur.Next() {
+		scanned++
+	}
+	report("scan", scanned, time.Since(start))
+
+	stats := c.Stats()
+	fmt.Printf("file size: %d bytes, cache hits: %d, cache misses: %d\n",
+		stats.FileSize, stats.CacheHits, stats.CacheMisses)
+}
+
+func report(phase string, ops int, elapsed time.Duration) {
+	fmt.Printf("%-6s %10d ops in %v (%.0f ops/s)\n", phase, ops, elapsed, float64(ops)/elapsed.Seconds())
+}
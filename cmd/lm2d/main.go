@@ -0,0 +1,192 @@
+// Command lm2d serves an lm2 collection over HTTP.
+//
+// The API is:
+//
+//	GET    /keys/{key}                    returns the value of key
+//	PUT    /keys/{key}                    sets key to the request body
+//	DELETE /keys/{key}                    deletes key
+//	GET    /keys?start=&end=&limit=       returns the keys in [start, end)
+//	GET    /stats                         returns collection statistics
+//
+// Values are returned as JSON objects with "key" and "value" fields.
+// On SIGINT or SIGTERM, lm2d stops accepting requests, waits for the
+// ones in progress and closes the collection.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Preetam/lm2"
+)
+
+// maxValueSize is the largest request body accepted by PUT.
+const maxValueSize = 1 << 20
+
+type entry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type server struct {
+	c *lm2.Collection
+}
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Llongfile)
+	filename := flag.String("file", "", "data file to serve")
+	addr := flag.String("addr", "localhost:7070", "address to listen on")
+	cacheSize := flag.Int("cache-size", 100, "record cache size")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second,
+		"time to wait for requests and compaction when shutting down")
+	flag.Parse()
+
+	c, err := lm2.Open(*filename, lm2.WithCacheSize(*cacheSize))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s := &server{c: c}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/keys/", s.handleKey)
+	mux.HandleFunc("/keys", s.handleScan)
+	mux.HandleFunc("/stats", s.handleStats)
+	srv := &http.Server{Addr: *addr, Handler: mux}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err = <-served:
+		c.Close()
+		log.Fatal(err)
+	case <-signals:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err = srv.Shutdown(ctx); err != nil {
+		log.Println(err)
+	}
+	if err = c.CloseWithTimeout(*shutdownTimeout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (s *server) handleKey(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/keys/")
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		value, err := s.c.GetContext(r.Context(), key)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, entry{Key: key, Value: value})
+	case http.MethodPut:
+		value, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxValueSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err = s.c.SetContext(r.Context(), key, string(value)); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := s.c.Delete(key); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) handleScan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	limit := 0
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	cur, err := s.c.Range(query.Get("start"), query.Get("end"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer cur.Close()
+	entries := []entry{}
+	for limit == 0 || len(entries) < limit {
+		ok, err := cur.NextContext(r.Context())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if !ok {
+			break
+		}
+		entries = append(entries, entry{Key: cur.Key(), Value: cur.Value()})
+	}
+	writeJSON(w, entries)
+}
+
+func (s *server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.c.Stats())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, lm2.ErrKeyNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, lm2.ErrReadOnly):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -16,15 +16,36 @@ func main() {
 	value := flag.String("value", "", "value of key to set")
 	endKey := flag.String("end-key", "", "end range of scan")
 	limit := flag.Int("limit", 0, "max number of entries to return in a scan")
+	out := flag.String("out", "", "data file to write a repaired collection to")
+	prefixLen := flag.Int("prefix-len", 1, "length of the key prefixes analyze groups keys by")
 	flag.Parse()
 
-	if *cmd == "create" {
+	switch *cmd {
+	case "create":
 		c, err := lm2.NewCollection(*filename, 100)
 		if err != nil {
 			log.Fatal(err)
 		}
 		c.Close()
 		return
+	case "repair":
+		report, err := lm2.Repair(*filename, *out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, problem := range report.Problems {
+			fmt.Println("skipped", problem)
+		}
+		fmt.Println("records recovered:", report.Records)
+		return
+	case "header", "dump", "verify", "analyze":
+		c, err := lm2.OpenCollectionReadOnly(*filename, 100)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer c.Close()
+		inspect(c, *cmd, *prefixLen)
+		return
 	}
 
 	c, err := lm2.OpenCollection(*filename, 100)
@@ -34,18 +55,11 @@ func main() {
 
 	switch *cmd {
 	case "get":
-		cur, err := c.NewCursor()
+		val, err := c.Get(*key)
 		if err != nil {
 			log.Fatal(err)
 		}
-		cur.Seek(*key)
-		if cur.Valid() {
-			if cur.Key() == *key {
-				fmt.Println(cur.Key(), "=>", cur.Value())
-				return
-			}
-		}
-		log.Fatal("key not found")
+		fmt.Println(*key, "=>", val)
 	case "scan":
 		cur, err := c.NewCursor()
 		if err != nil {
@@ -60,17 +74,14 @@ func main() {
 			fmt.Println(cur.Key(), "=>", cur.Value())
 			remaining--
 		}
+		cur.Close()
 	case "set":
-		wb := lm2.NewWriteBatch()
-		wb.Set(*key, *value)
-		_, err = c.Update(wb)
+		err = c.Set(*key, *value)
 		if err != nil {
 			log.Fatal(err)
 		}
 	case "delete":
-		wb := lm2.NewWriteBatch()
-		wb.Delete(*key)
-		_, err = c.Update(wb)
+		err = c.Delete(*key)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -78,3 +89,78 @@ func main() {
 		log.Fatal("unknown command", *cmd)
 	}
 }
+
+func inspect(c *lm2.Collection, cmd string, prefixLen int) {
+	switch cmd {
+	case "header":
+		fmt.Printf("magic: %#x\n", c.Magic)
+		fmt.Println("format version:", c.FormatVersion)
+		fmt.Println("flags:", c.Flags)
+		fmt.Println("head:", c.Head)
+		fmt.Println("last commit:", c.LastCommit)
+		fmt.Println("last valid log entry:", c.LastValidLogEntry)
+	case "dump":
+		err := c.WalkRecords(func(rec lm2.RecordInfo) bool {
+			fmt.Printf("offset=%d next=%d deleted=%d expires=%d %q => %q\n",
+				rec.Offset, rec.Next, rec.Deleted, rec.Expires, rec.Key, rec.Value)
+			return true
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "verify":
+		report, err := c.Verify()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, problem := range report.Problems {
+			fmt.Println(problem)
+		}
+		fmt.Println("records checked:", report.Records)
+		if !report.OK() {
+			log.Fatalf("found %d problems", len(report.Problems))
+		}
+		fmt.Println("OK")
+	case "analyze":
+		report, err := c.Analyze(prefixLen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		analyze(report)
+	}
+}
+
+func analyze(report *lm2.SpaceReport) {
+	percent := func(bytes int64) float64 {
+		if report.FileSize == 0 {
+			return 0
+		}
+		return 100 * float64(bytes) / float64(report.FileSize)
+	}
+	usage := func(name string, u lm2.SpaceUsage) {
+		fmt.Printf("%-14s %10d bytes %5.1f%% %8d records\n", name, u.Bytes, percent(u.Bytes), u.Records)
+	}
+	space := func(name string, bytes int64) {
+		fmt.Printf("%-14s %10d bytes %5.1f%%\n", name, bytes, percent(bytes))
+	}
+
+	fmt.Println("data file:", report.FileSize, "bytes")
+	fmt.Println("WAL:", report.WALSize, "bytes")
+	space("header", report.Header)
+	usage("live", report.Live)
+	usage("indexes", report.Indexes)
+	usage("metadata", report.Metadata)
+	usage("shared values", report.SharedValues)
+	usage("expired", report.Expired)
+	usage("deleted", report.Deleted)
+	usage("overwritten", report.Overwritten)
+	space("commits", report.Commits)
+	space("uncommitted", report.Uncommitted)
+
+	fmt.Println()
+	fmt.Printf("%-20s %10s %8s %10s %8s\n", "prefix", "live", "records", "garbage", "records")
+	for _, p := range report.Prefixes {
+		fmt.Printf("%-20q %10d %8d %10d %8d\n",
+			p.Prefix, p.Live.Bytes, p.Live.Records, p.Garbage.Bytes, p.Garbage.Records)
+	}
+}
@@ -0,0 +1,247 @@
+package lm2
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+)
+
+// compactionBatchSize is the number of records copied per update
+// while compacting.
+const compactionBatchSize = 1000
+
+// Compact rewrites the collection into a new data file containing only
+// the latest version of every live record, reclaiming the space used by
+// deleted and overwritten records. Updates are blocked until compaction
+// completes.
+//
+// ErrCursorsOpen is returned while cursors or snapshots are open, and
+// closed cursors and snapshots must not be used after Compact returns.
+// ErrCheckpointed is returned if the collection has checkpoints. If
+// Compact fails after the new data file has been swapped in, the
+// collection must be reopened.
+func (c *Collection) Compact() error {
+	return c.CompactContext(context.Background())
+}
+
+// CompactContext is like Compact, but stops with ctx's error if ctx is
+// done while live records are being copied. The collection is left
+// unchanged if compaction is cancelled.
+func (c *Collection) CompactContext(ctx context.Context) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+
+	done := c.startOperation(ctx, OpCompact)
+	c.compactLock.Lock()
+	c.metaLock.Lock()
+	err := c.compact(ctx)
+	c.metaLock.Unlock()
+	c.compactLock.Unlock()
+	done(err)
+	return err
+}
+
+// SetAutoCompact enables automatic compaction. Once threshold records
+// have been deleted or overwritten since the collection was opened or
+// last compacted, a compaction is started in the background after the
+// next update that is made while no cursors or snapshots are open.
+// A threshold of 0 disables automatic compaction.
+func (c *Collection) SetAutoCompact(threshold int) {
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+	c.autoCompactThreshold = threshold
+}
+
+// maybeAutoCompact starts a background compaction if the garbage
+// threshold has been reached. The caller must hold metaLock.
+func (c *Collection) maybeAutoCompact() {
+	if c.autoCompactThreshold <= 0 || c.garbage < c.autoCompactThreshold {
+		return
+	}
+	c.startCompaction()
+}
+
+// startCompaction starts a compaction in the background unless one is
+// already running or cursors or snapshots are open.
+func (c *Collection) startCompaction() {
+	c.backgroundLock.Lock()
+	defer c.backgroundLock.Unlock()
+	if c.closing || c.pinned() || !atomic.CompareAndSwapInt32(&c.compacting, 0, 1) {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancelCompaction = cancel
+	c.background.Add(1)
+	go func() {
+		defer c.background.Done()
+		defer atomic.StoreInt32(&c.compacting, 0)
+		defer cancel()
+		c.CompactContext(ctx)
+	}()
+}
+
+// compact does the work of Compact. The caller must hold metaLock.
+func (c *Collection) compact(ctx context.Context) error {
+	if c.closed {
+		return ErrClosed
+	}
+	if err := c.loadCheckpoints(); err != nil {
+		return err
+	}
+	if len(c.checkpoints) > 0 {
+		return ErrCheckpointed
+	}
+	if c.pinned() {
+		return ErrCursorsOpen
+	}
+	file := c.f.Name()
+	compactFile := file + ".compact"
+
+	var dst *Collection
+	var err error
+	if c.memory {
+		dst, err = newMemoryCollection(c.cache.size, c.aead)
+	} else {
+		dst, err = newCollection(compactFile, c.cache.size, c.aead)
+	}
+	if err != nil {
+		return err
+	}
+	dst.SetSyncPolicy(SyncNever, 0)
+	dst.compression = c.compression
+	dst.checksums = c.checksums
+	dst.dedupMinSize = c.dedupMinSize
+
+	err = c.copyLive(ctx, dst)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if err != nil {
+		dst.Destroy()
+		return err
+	}
+
+	if c.memory {
+		// Nothing needs to survive a crash.
+		c.f.Close()
+		c.wal.Close()
+		c.cache.close()
+		c.swap(dst, dst.liveRecords)
+		return c.rebuildBloomFilter()
+	}
+
+	if err = c.replaceFile(dst); err != nil {
+		return err
+	}
+	return c.rebuildBloomFilter()
+}
+
+// replaceFile replaces the data file of the collection with dst's, which
+// has been synced. The caller must hold metaLock.
+func (c *Collection) replaceFile(dst *Collection) error {
+	file, dstFile := c.f.Name(), dst.f.Name()
+
+	// The new data file is consistent on its own,
+	// so its WAL and cache aren't needed.
+	dst.Close()
+	os.Remove(dstFile + ".wal")
+	os.Remove(dstFile + ".cache")
+
+	// Make the current data file consistent without its WAL and cache
+	// so that a crash at any point leaves a usable collection behind.
+	err := c.sync()
+	if err == nil {
+		err = c.wal.f.Truncate(0)
+	}
+	if err == nil {
+		c.wal.lastGoodOffset = 0
+		err = c.cache.f.Truncate(0)
+	}
+	if err == nil {
+		err = os.Rename(dstFile, file)
+	}
+	if err != nil {
+		os.Remove(dstFile)
+		return err
+	}
+
+	reopened, err := openCollection(file, c.cache.size, c.aead)
+	if err != nil {
+		return err
+	}
+
+	c.f.Close()
+	c.wal.Close()
+	c.cache.close()
+	c.swap(reopened, dst.liveRecords)
+	return nil
+}
+
+// swap replaces the files of the collection with those of compacted,
+// which holds liveRecords records. The caller must hold metaLock.
+func (c *Collection) swap(compacted *Collection, liveRecords uint64) {
+	c.fileHeader = compacted.fileHeader
+	c.f = compacted.f
+	c.wal = compacted.wal
+	c.wal.noSync = c.syncPolicy != SyncAlways
+	c.cache = compacted.cache
+	c.cache.c = c
+	c.garbage = 0
+	c.liveRecords = liveRecords
+	c.deletedRecords = 0
+	c.countsLoaded = true
+	c.commitTimes = nil
+	c.commitTimesLoaded = false
+	atomic.AddInt64(&c.generation, 1)
+}
+
+// rebuildBloomFilter rebuilds the bloom filter, if there is one, to drop
+// the keys of records removed by compaction. The caller must hold metaLock.
+func (c *Collection) rebuildBloomFilter() error {
+	if c.bloom == nil {
+		return nil
+	}
+	return c.buildBloomFilter(c.bloomFalsePositiveRate)
+}
+
+// copyLive copies every live record into dst.
+// The caller must hold metaLock.
+func (c *Collection) copyLive(ctx context.Context, dst *Collection) error {
+	cur, err := c.newCursor(c.LastCommit)
+	if err != nil {
+		return err
+	}
+
+	wb := NewWriteBatch()
+	n := 0
+	for {
+		ok, err := cur.NextContext(ctx)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if isBlobKey(cur.Key()) {
+			// Shared values are written again for the keys set to them.
+			continue
+		}
+		wb.setExpiresAt(cur.Key(), cur.Value(), cur.current.Expires)
+		wb.setRecordMeta(cur.Key(), cur.current.Meta)
+		n++
+		if n == compactionBatchSize {
+			if _, err = dst.update(wb, nil); err != nil {
+				return err
+			}
+			wb = NewWriteBatch()
+			n = 0
+		}
+	}
+	if n > 0 {
+		if _, err = dst.update(wb, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
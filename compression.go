@@ -0,0 +1,88 @@
+package lm2
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// Compression is a value compression algorithm.
+type Compression uint16
+
+const (
+	// NoCompression stores values as is.
+	NoCompression Compression = iota
+	// FlateCompression compresses values with DEFLATE.
+	FlateCompression
+)
+
+// ErrUnknownCompression is returned, wrapped, for
+// an unknown Compression.
+var ErrUnknownCompression = errors.New("lm2: unknown compression")
+
+// recordCompressionMask is the part of the record flags
+// that holds the value's Compression.
+const recordCompressionMask = 0x3
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+// SetCompression sets the compression used for values written by
+// subsequent updates. Each record records its own compression, so
+// existing records remain readable and are recompressed when the
+// collection is compacted. Values are stored uncompressed if
+// compression doesn't make them smaller.
+func (c *Collection) SetCompression(compression Compression) error {
+	if compression > FlateCompression {
+		return fmt.Errorf("%w %d", ErrUnknownCompression, compression)
+	}
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+	c.compression = compression
+	return nil
+}
+
+func compressValue(compression Compression, value string) ([]byte, error) {
+	switch compression {
+	case NoCompression:
+		return []byte(value), nil
+	case FlateCompression:
+		buf := bytes.NewBuffer(nil)
+		w := flateWriters.Get().(*flate.Writer)
+		defer flateWriters.Put(w)
+		w.Reset(buf)
+		if _, err := w.Write([]byte(value)); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("%w %d", ErrUnknownCompression, compression)
+	}
+}
+
+func decompressValue(flags uint16, value []byte) (string, error) {
+	switch compression := Compression(flags & recordCompressionMask); compression {
+	case NoCompression:
+		return string(value), nil
+	case FlateCompression:
+		r := flate.NewReader(bytes.NewReader(value))
+		defer r.Close()
+		decompressed, err := ioutil.ReadAll(r)
+		if err != nil {
+			return "", errCorrupt("decompressing value: %v", err)
+		}
+		return string(decompressed), nil
+	default:
+		return "", fmt.Errorf("%w %d", ErrUnknownCompression, compression)
+	}
+}
@@ -1,24 +1,116 @@
 package lm2
 
-// Cursor represents a snapshot cursor.
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrCursorClosed is returned by cursors used after Close.
+	ErrCursorClosed = errors.New("lm2: cursor is closed")
+	// ErrCursorInvalidated is returned by cursors used after they
+	// were invalidated by InvalidateCursors or by compaction.
+	ErrCursorInvalidated = errors.New("lm2: cursor was invalidated")
+	// ErrTooManyCursors is returned when creating a cursor would
+	// exceed the collection's limit on open cursors.
+	ErrTooManyCursors = errors.New("lm2: too many open cursors")
+	// ErrCursorsOpen is returned by Compact while cursors
+	// or snapshots are open.
+	ErrCursorsOpen = errors.New("lm2: collection has open cursors")
+)
+
+// Cursor states.
+const (
+	cursorOpen int32 = iota
+	cursorClosed
+	cursorInvalidated
+)
+
+// Cursor represents a snapshot cursor. It skips records of reserved keys.
+//
+// A cursor reads the collection as of the version it was created at,
+// regardless of updates made while it iterates. It never returns records
+// set after that version, and it still returns records that existed at
+// that version even if they are overwritten or deleted later. Records
+// hidden by their expiration time are decided once, when the cursor is
+// created. Cursors need no locks to iterate, so they don't block
+// updates.
+//
+// A cursor is open until it is closed or Next or Prev returns false.
+// Compact fails with ErrCursorsOpen while cursors are open, and
+// automatic compaction waits until they're closed.
+// A cursor used after the collection was compacted stops with
+// ErrCursorInvalidated.
 type Cursor struct {
 	collection *Collection
 	current    *record
 	first      bool
 	snapshot   int64
+	now        int64  // records that expire at or before now are hidden
+	prefix     string // prefix of every key, stripped by Key
+	start      string // inclusive lower bound used by Prev
+	end        string // exclusive upper bound; empty means unbounded
+	atEnd      bool   // true if the cursor is past the last record
+	err        error  // error that stopped the cursor
+	reserved   bool   // true if records of reserved keys are returned
+
+	generation int64 // the collection's generation when created
+	state      int32 // accessed atomically
+	tracked    bool  // guarded by the collection's cursorLock
 }
 
 // NewCursor returns a new cursor with a snapshot view of the
-// current collection state.
+// current collection state. It should be closed when it is no longer
+// needed, unless it is iterated to the end.
 func (c *Collection) NewCursor() (*Cursor, error) {
 	c.metaLock.RLock()
 	defer c.metaLock.RUnlock()
+	return c.newTrackedCursor(c.LastCommit)
+}
+
+// newTrackedCursor returns a new cursor like newCursor that skips
+// reserved keys and counts it as open until it is closed. The caller
+// must hold metaLock.
+func (c *Collection) newTrackedCursor(snapshot int64) (*Cursor, error) {
+	cur, err := c.newCursor(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	cur.reserved = false
+	c.cursorLock.Lock()
+	defer c.cursorLock.Unlock()
+	if c.maxOpenCursors > 0 && len(c.cursors) >= c.maxOpenCursors {
+		return nil, ErrTooManyCursors
+	}
+	if c.cursors == nil {
+		c.cursors = map[*Cursor]struct{}{}
+	}
+	c.cursors[cur] = struct{}{}
+	cur.tracked = true
+	return cur, nil
+}
+
+// newCursor returns a new cursor with a snapshot view at version snapshot
+// that returns reserved keys. The cursor isn't counted as open, so it
+// must only be used internally for short reads. The caller must hold
+// metaLock.
+func (c *Collection) newCursor(snapshot int64) (*Cursor, error) {
+	if c.closed {
+		return nil, ErrClosed
+	}
+	now := time.Now().UnixNano()
+	generation := atomic.LoadInt64(&c.generation)
 	if c.Head == 0 {
 		return &Cursor{
 			collection: c,
 			current:    nil,
 			first:      false,
-			snapshot:   c.LastCommit,
+			snapshot:   snapshot,
+			now:        now,
+			reserved:   true,
+			generation: generation,
 		}, nil
 	}
 
@@ -30,10 +122,27 @@ func (c *Collection) NewCursor() (*Cursor, error) {
 		collection: c,
 		current:    head,
 		first:      true,
-		snapshot:   c.LastCommit,
+		snapshot:   snapshot,
+		now:        now,
+		reserved:   true,
+		generation: generation,
 	}, nil
 }
 
+// Range returns a new cursor with a snapshot view of the current
+// collection state that iterates over keys greater than or equal to
+// start and less than end. An empty end means there is no upper bound.
+func (c *Collection) Range(start, end string) (*Cursor, error) {
+	cur, err := c.NewCursor()
+	if err != nil {
+		return nil, err
+	}
+	cur.start = start
+	cur.end = end
+	cur.seekFirst(start)
+	return cur, nil
+}
+
 // Valid returns true if the cursor's Key() and Value()
 // methods can be called. It returns false if the cursor
 // isn't at a valid record position.
@@ -42,35 +151,71 @@ func (c *Cursor) Valid() bool {
 }
 
 // Next moves the cursor to the next record. It returns true
-// if it lands on a valid record.
+// if it lands on a valid record. Use Err to tell whether a false
+// return is the end of the records or an error.
 func (c *Cursor) Next() bool {
+	ok, _ := c.next(context.Background())
+	return ok
+}
+
+// NextContext is like Next, but stops early with ctx's error if ctx
+// is done before the next record is found, and returns the error that
+// stopped the cursor if a record can't be read. The cursor is invalid
+// after NextContext returns an error.
+func (c *Cursor) NextContext(ctx context.Context) (bool, error) {
+	return c.next(ctx)
+}
+
+func (c *Cursor) next(ctx context.Context) (bool, error) {
+	ok, err := c.advance(ctx)
+	if !ok {
+		// The cursor is done unless it is moved with Seek or Prev.
+		c.release()
+	}
+	return ok, err
+}
+
+func (c *Cursor) advance(ctx context.Context) (bool, error) {
+	if c.err != nil {
+		return false, c.err
+	}
+	if err := c.usable(); err != nil {
+		return false, c.stop(-1, err)
+	}
 	if !c.Valid() {
-		return false
+		return false, nil
+	}
+	if err := ctx.Err(); err != nil {
+		c.current = nil
+		return false, err
 	}
 
 	if c.first {
 		c.first = false
-		return true
-	}
-
-	c.current.lock.RLock()
-	rec, err := c.collection.readRecord(c.current.Next)
-	if err != nil {
+	} else {
+		c.current.lock.RLock()
+		next := c.current.Next
+		rec, err := c.collection.readRecordAfter(c.current, next)
 		c.current.lock.RUnlock()
-		c.current = nil
-		return false
+		if err != nil {
+			return false, c.stop(next, err)
+		}
+		c.current = rec
 	}
-	c.current.lock.RUnlock()
-	c.current = rec
 
+	// Skip records that aren't part of the snapshot.
 	c.current.lock.RLock()
-	for (c.current.Deleted != 0 && c.current.Deleted <= c.snapshot) ||
-		(c.current.Offset >= c.snapshot) {
-		rec, err = c.collection.readRecord(c.current.Next)
-		if err != nil {
+	for !c.visible(c.current) {
+		if err := ctx.Err(); err != nil {
 			c.current.lock.RUnlock()
 			c.current = nil
-			return false
+			return false, err
+		}
+		next := c.current.Next
+		rec, err := c.collection.readRecordAfter(c.current, next)
+		if err != nil {
+			c.current.lock.RUnlock()
+			return false, c.stop(next, err)
 		}
 		c.current.lock.RUnlock()
 		c.current = rec
@@ -78,14 +223,233 @@ func (c *Cursor) Next() bool {
 	}
 	c.current.lock.RUnlock()
 
+	if c.end != "" && c.current.Key >= c.end {
+		c.current = nil
+		c.atEnd = true
+		return false, nil
+	}
+	return true, nil
+}
+
+// stop invalidates the cursor after reading the record at next failed
+// with err. Reaching the end of the record chain isn't an error.
+func (c *Cursor) stop(next int64, err error) error {
+	c.current = nil
+	if next == 0 {
+		c.atEnd = true
+		return nil
+	}
+	c.err = err
+	return err
+}
+
+// Close closes the cursor, which then stops with ErrCursorClosed.
+// Closing a cursor again has no effect.
+func (c *Cursor) Close() {
+	atomic.CompareAndSwapInt32(&c.state, cursorOpen, cursorClosed)
+	c.release()
+	c.current = nil
+}
+
+// release stops counting the cursor as open.
+func (c *Cursor) release() {
+	c.collection.cursorLock.Lock()
+	defer c.collection.cursorLock.Unlock()
+	if c.tracked {
+		delete(c.collection.cursors, c)
+		c.tracked = false
+	}
+}
+
+// usable returns an error if the cursor was closed or invalidated, or
+// if the collection has been compacted since the cursor was created.
+func (c *Cursor) usable() error {
+	switch atomic.LoadInt32(&c.state) {
+	case cursorClosed:
+		return ErrCursorClosed
+	case cursorInvalidated:
+		return ErrCursorInvalidated
+	}
+	if c.generation != atomic.LoadInt64(&c.collection.generation) {
+		return ErrCursorInvalidated
+	}
+	return nil
+}
+
+// SetMaxOpenCursors limits the number of cursors that can be open at
+// once. Creating a cursor beyond the limit fails with ErrTooManyCursors.
+// A limit of 0 removes it.
+func (c *Collection) SetMaxOpenCursors(n int) {
+	c.cursorLock.Lock()
+	defer c.cursorLock.Unlock()
+	c.maxOpenCursors = n
+}
+
+// InvalidateCursors invalidates every open cursor, so that each one
+// stops with ErrCursorInvalidated the next time it is used, and closes
+// every open snapshot. It returns how many cursors and snapshots there
+// were. It is meant for cursors and snapshots that were leaked without
+// being closed, which keep the collection from being compacted. Closed
+// snapshots can still be read until the collection is compacted.
+func (c *Collection) InvalidateCursors() int {
+	c.cursorLock.Lock()
+	defer c.cursorLock.Unlock()
+	n := len(c.cursors) + len(c.snapshots)
+	for cur := range c.cursors {
+		atomic.CompareAndSwapInt32(&cur.state, cursorOpen, cursorInvalidated)
+		cur.tracked = false
+	}
+	for s := range c.snapshots {
+		s.tracked = false
+	}
+	c.cursors = nil
+	c.snapshots = nil
+	return n
+}
+
+// openCursors returns the number of open cursors.
+func (c *Collection) openCursors() int {
+	c.cursorLock.Lock()
+	defer c.cursorLock.Unlock()
+	return len(c.cursors)
+}
+
+// pinned returns true if cursors or snapshots are open,
+// which keeps the collection from being compacted.
+func (c *Collection) pinned() bool {
+	c.cursorLock.Lock()
+	defer c.cursorLock.Unlock()
+	return len(c.cursors) > 0 || len(c.snapshots) > 0
+}
+
+// Err returns the error, if any, that stopped the cursor early,
+// such as a corrupt record. Seek clears it.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// Prev moves the cursor to the record with the greatest key less than
+// the current record's key. If the cursor has gone past the last record
+// with Next, or was created by ReverseRange, Prev moves it to the last
+// record. It returns false if there is no such record, after which the
+// cursor is invalid.
+//
+// Records only link forward, so Prev searches forward from the closest
+// cached record before the current key.
+func (c *Cursor) Prev() bool {
+	if err := c.usable(); err != nil {
+		c.stop(-1, err)
+		return false
+	}
+	bound, bounded := "", true
+	switch {
+	case c.current != nil:
+		bound = c.current.Key
+	case c.atEnd:
+		bound, bounded = c.end, c.end != ""
+	default:
+		return false
+	}
+
+	rec := c.lastBefore(bound, bounded)
+	c.atEnd = false
+	if rec == nil || rec.Key < c.start {
+		c.current = nil
+		c.release()
+		return false
+	}
+	c.current = rec
+	c.first = false
 	return true
 }
 
+// lastBefore returns the last visible record with a key less than bound,
+// or the last visible record if bounded is false.
+func (c *Cursor) lastBefore(bound string, bounded bool) *record {
+	offset := c.collection.cache.findLast()
+	if bounded {
+		offset = c.collection.cache.findLastLessThan(bound)
+	}
+	if offset != 0 {
+		rec, err := c.collection.readRecord(offset)
+		if err == nil {
+			if last := c.lastVisibleFrom(rec, bound, bounded); last != nil {
+				return last
+			}
+		}
+	}
+
+	// Nothing visible after the cached record. Start over from the head.
+	c.collection.metaLock.RLock()
+	head := c.collection.Head
+	c.collection.metaLock.RUnlock()
+	if head == 0 {
+		return nil
+	}
+	rec, err := c.collection.readRecord(head)
+	if err != nil {
+		return nil
+	}
+	return c.lastVisibleFrom(rec, bound, bounded)
+}
+
+// lastVisibleFrom walks forward from rec and returns the last visible
+// record with a key less than bound, if bounded.
+func (c *Cursor) lastVisibleFrom(rec *record, bound string, bounded bool) *record {
+	var last *record
+	for rec != nil {
+		rec.lock.RLock()
+		if bounded && rec.Key >= bound {
+			rec.lock.RUnlock()
+			break
+		}
+		if c.visible(rec) {
+			last = rec
+		}
+		oldRec := rec
+		if rec.Next == 0 {
+			rec = nil
+		} else {
+			rec = c.collection.nextRecord(rec)
+		}
+		oldRec.lock.RUnlock()
+	}
+	return last
+}
+
+// ReverseRange returns a cursor over keys in [start, end) that is
+// positioned after the last key, so that Prev iterates from the last
+// key down to start. An empty end means there is no upper bound.
+func (c *Collection) ReverseRange(start, end string) (*Cursor, error) {
+	cur, err := c.NewCursor()
+	if err != nil {
+		return nil, err
+	}
+	cur.start = start
+	cur.end = end
+	cur.current = nil
+	cur.first = false
+	cur.atEnd = true
+	return cur, nil
+}
+
+// visible returns true if rec is part of the cursor's snapshot, hasn't
+// expired and isn't skipped as reserved. The caller must hold rec's lock.
+func (c *Cursor) visible(rec *record) bool {
+	if rec.Offset >= c.snapshot || (!c.reserved && isReservedKey(rec.Key)) {
+		return false
+	}
+	if rec.Expires != 0 && rec.Expires <= c.now {
+		return false
+	}
+	return rec.Deleted == 0 || rec.Deleted > c.snapshot
+}
+
 // Key returns the key of the current record. It returns an empty
 // string if the cursor is not valid.
 func (c *Cursor) Key() string {
 	if c.Valid() {
-		return c.current.Key
+		return c.current.Key[len(c.prefix):]
 	}
 	return ""
 }
@@ -102,43 +466,100 @@ func (c *Cursor) Value() string {
 // Seek positions the cursor at the last key less than
 // or equal to the provided key.
 func (c *Cursor) Seek(key string) {
-	var rec *record
-	var err error
+	c.seek(c.prefix + key)
+	if c.prefix != "" && c.current != nil && c.current.Key < c.prefix {
+		// Don't land on a record before the start of the keyspace.
+		c.first = false
+	}
+}
+
+// seek positions the cursor at the last key less than or equal
+// to key, ignoring the cursor's prefix.
+func (c *Cursor) seek(key string) {
+	c.atEnd = false
+	c.err = nil
+	if err := c.usable(); err != nil {
+		c.stop(-1, err)
+		return
+	}
 	offset := c.collection.cache.findLastLessThan(key)
-	if offset == 0 {
-		c.collection.metaLock.RLock()
-		rec, err = c.collection.readRecord(c.collection.Head)
-		c.collection.metaLock.RUnlock()
-		if err != nil {
-			c.current = nil
+	if offset != 0 {
+		rec, err := c.collection.readRecord(offset)
+		if err == nil && c.seekFrom(rec, key) {
 			return
 		}
-	} else {
-		rec, err = c.collection.readRecord(offset)
-		if err != nil {
-			c.current = nil
-			return
+	}
+
+	// Nothing visible after the cached record. Start over from the head.
+	c.collection.metaLock.RLock()
+	rec, err := c.collection.readRecord(c.collection.Head)
+	c.collection.metaLock.RUnlock()
+	if err != nil {
+		c.current = nil
+		return
+	}
+	c.seekFrom(rec, key)
+}
+
+// SeekPrefix positions the cursor before the first key with the
+// given prefix and limits iteration to keys with that prefix.
+// The limit remains in effect for subsequent calls to Seek.
+func (c *Cursor) SeekPrefix(prefix string) {
+	c.start = c.prefix + prefix
+	c.end = prefixEnd(c.prefix + prefix)
+	c.seekFirst(c.prefix + prefix)
+}
+
+// prefixEnd returns the smallest key greater than every key with
+// the given prefix, or an empty string if there isn't one.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
 		}
 	}
+	return ""
+}
+
+// seekFirst positions the cursor so that the next call to Next
+// lands on the first record with a key greater than or equal to key.
+func (c *Cursor) seekFirst(key string) {
+	c.seek(key)
+	if c.current != nil && c.current.Key < key {
+		c.first = false
+	}
+}
+
+// seekFrom walks forward from rec and positions the cursor at the last
+// visible record with a key less than or equal to key. If there isn't one,
+// the cursor is positioned at rec. It returns true if a record was found.
+func (c *Cursor) seekFrom(rec *record, key string) bool {
 	c.current = rec
 	c.first = true
+	found := false
 	for rec != nil {
 		rec.lock.RLock()
 		if rec.Key > key {
 			rec.lock.RUnlock()
 			break
 		}
-		if (rec.Deleted > 0 && rec.Deleted <= c.snapshot) || (rec.Offset >= c.snapshot) {
-			oldRec := rec
-			rec = c.collection.nextRecord(rec)
-			oldRec.lock.RUnlock()
-			continue
-		}
-		if rec.Key <= key {
+		if c.visible(rec) {
 			c.current = rec
+			found = true
+		}
+		next := rec.Next
+		rec.lock.RUnlock()
+		if next == 0 {
+			break
+		}
+		var err error
+		rec, err = c.collection.readRecordAfter(rec, next)
+		if err != nil {
+			c.err = err
+			return true
 		}
-		oldRec := rec
-		rec = c.collection.nextRecord(rec)
-		oldRec.lock.RUnlock()
 	}
+	return found
 }
@@ -0,0 +1,158 @@
+package lm2
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"strings"
+)
+
+// blobKeyPrefix is the reserved key prefix under which shared values
+// are stored, followed by the SHA-256 hash of the value. Keys aren't
+// encrypted, so the values of encrypted collections are hashed with
+// HMAC-SHA-256 instead, keyed by blobHashKey.
+const blobKeyPrefix = "\x00v"
+
+// blobHashLabel is encrypted to derive the key that shared values of an
+// encrypted collection are hashed with.
+const blobHashLabel = "lm2 shared value hash key"
+
+// recordShared is set in the flags of a record whose stored value is
+// the offset of the record that holds its value.
+const recordShared = 1 << 5
+
+// blobRefSize is the size of the stored value of a shared record.
+const blobRefSize = 8
+
+// SetDeduplication stores values of at least minSize bytes once, however
+// many keys they are set under. A deduplicated value is stored in a
+// record of its own, under a reserved key, and records of keys set to it
+// refer to that record. Values that are no longer set under any key
+// are removed by compaction, which deduplicates the values it copies if
+// deduplication is enabled, and stores them under every key otherwise.
+// A minSize of 0 disables deduplication of new values.
+func (c *Collection) SetDeduplication(minSize int) {
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+	c.dedupMinSize = minSize
+}
+
+// blobHashKey derives the key that shared values of a collection
+// encrypted with aead are hashed with, or returns nil if aead is nil.
+// The label is sealed with a fixed nonce, which is safe because the
+// plaintext is fixed as well, so the result only depends on the key.
+func blobHashKey(aead cipher.AEAD) []byte {
+	if aead == nil {
+		return nil
+	}
+	nonce := make([]byte, aead.NonceSize())
+	sealed := aead.Seal(nil, nonce, []byte(blobHashLabel), nil)
+	sum := sha256.Sum256(sealed)
+	return sum[:]
+}
+
+// blobKey returns the key the shared value is stored under.
+func (c *Collection) blobKey(value string) string {
+	if c.blobHashKey == nil {
+		sum := sha256.Sum256([]byte(value))
+		return blobKeyPrefix + string(sum[:])
+	}
+	mac := hmac.New(sha256.New, c.blobHashKey)
+	mac.Write([]byte(value))
+	return blobKeyPrefix + string(mac.Sum(nil))
+}
+
+// isBlobKey returns true if key is the key of a shared value.
+func isBlobKey(key string) bool {
+	return strings.HasPrefix(key, blobKeyPrefix)
+}
+
+// applyDedup makes the sets in wb of values that are large enough refer
+// to shared values, and adds the shared values that don't exist yet to
+// wb. The caller must hold metaLock.
+func (c *Collection) applyDedup(wb *WriteBatch) error {
+	wb.shared, wb.blobs = nil, nil
+	if c.dedupMinSize <= 0 {
+		return nil
+	}
+
+	var keys []string
+	for key, value := range wb.sets {
+		if len(value) >= c.dedupMinSize && !isBlobKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		value := wb.sets[key]
+		blobKey := c.blobKey(value)
+		if _, ok := wb.sets[blobKey]; !ok {
+			offset := int64(0)
+			err := c.walkKey(blobKey, func(rec *record) bool {
+				if rec.Deleted == 0 {
+					offset = rec.Offset
+					return false
+				}
+				return true
+			})
+			if err != nil {
+				return err
+			}
+			if offset == 0 {
+				wb.Set(blobKey, value)
+			} else {
+				if wb.blobs == nil {
+					wb.blobs = map[string]int64{}
+				}
+				wb.blobs[blobKey] = offset
+			}
+		}
+		if wb.shared == nil {
+			wb.shared = map[string]string{}
+		}
+		wb.shared[key] = blobKey
+	}
+	return nil
+}
+
+// blobOffset returns the offset of the record with the shared value of
+// key, or 0 if its value isn't shared. Shared values written by the
+// update must be in newlyInserted.
+func (wb *WriteBatch) blobOffset(key string, newlyInserted map[string]int64) int64 {
+	blobKey, ok := wb.shared[key]
+	if !ok {
+		return 0
+	}
+	if offset, ok := newlyInserted[blobKey]; ok {
+		return offset
+	}
+	return wb.blobs[blobKey]
+}
+
+// blobRef encodes the stored value of a shared record.
+func blobRef(offset int64) string {
+	b := make([]byte, blobRefSize)
+	binary.LittleEndian.PutUint64(b, uint64(offset))
+	return string(b)
+}
+
+// readShared returns the offset and the value of the record that holds
+// the value of the shared record at offset, whose stored value is ref.
+func (c *Collection) readShared(offset int64, ref string) (int64, string, error) {
+	if len(ref) != blobRefSize {
+		return 0, "", errCorrupt("invalid shared value in record at offset %d", offset)
+	}
+	blobOffset := int64(binary.LittleEndian.Uint64([]byte(ref)))
+	// Shared values are written before the records that refer to them.
+	if blobOffset >= offset {
+		return 0, "", errCorrupt("invalid shared value in record at offset %d", offset)
+	}
+	blob, err := c.readRecord(blobOffset)
+	if err != nil {
+		return 0, "", err
+	}
+	if !isBlobKey(blob.Key) || blob.blob != 0 {
+		return 0, "", errCorrupt("invalid shared value in record at offset %d", offset)
+	}
+	return blobOffset, blob.Value, nil
+}
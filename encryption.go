@@ -0,0 +1,110 @@
+package lm2
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+)
+
+// flagEncrypted is set in the file header of an encrypted collection.
+const flagEncrypted = 1 << 0
+
+// recordEncrypted is set in the flags of a record with an encrypted value.
+const recordEncrypted = 1 << 2
+
+var (
+	// ErrEncrypted is returned when opening an encrypted
+	// collection without an encryption key.
+	ErrEncrypted = errors.New("lm2: collection is encrypted")
+	// ErrNotEncrypted is returned when opening an unencrypted
+	// collection with an encryption key.
+	ErrNotEncrypted = errors.New("lm2: collection is not encrypted")
+	// ErrDecryptionFailed is returned when a record value fails
+	// authentication, either because the encryption key is wrong
+	// or because the record has been modified.
+	ErrDecryptionFailed = errors.New("lm2: decryption failed")
+)
+
+// NewEncryptedCollection is like NewCollection, but record values are
+// encrypted with AES-GCM using key, which must be 16, 24, or 32 bytes
+// long to select AES-128, AES-192, or AES-256. Keys are not encrypted.
+func NewEncryptedCollection(file string, cacheSize int, key []byte) (*Collection, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return newCollection(file, cacheSize, aead)
+}
+
+// OpenEncryptedCollection is like OpenCollection for a collection
+// created by NewEncryptedCollection with the same key.
+func OpenEncryptedCollection(file string, cacheSize int, key []byte) (*Collection, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return openCollection(file, cacheSize, aead)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// checkEncryption checks that the collection has an encryption key if
+// and only if its data file is encrypted. If it does, the key is checked
+// against the head record.
+func (c *Collection) checkEncryption() error {
+	encrypted := c.Flags&flagEncrypted != 0
+	if encrypted && c.aead == nil {
+		return ErrEncrypted
+	}
+	if !encrypted && c.aead != nil {
+		return ErrNotEncrypted
+	}
+	if encrypted && c.Head != 0 {
+		_, err := c.readRecord(c.Head)
+		return err
+	}
+	return nil
+}
+
+// additionalData returns the data authenticated along with the value
+// of the record with key at offset, so that encrypted values can't be
+// moved to other records.
+func additionalData(offset int64, key string) []byte {
+	data := make([]byte, 8+len(key))
+	binary.LittleEndian.PutUint64(data, uint64(offset))
+	copy(data[8:], key)
+	return data
+}
+
+// encryptValue returns value encrypted with a random nonce,
+// which is prepended to the result.
+func (c *Collection) encryptValue(offset int64, key string, value []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(value)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, value, additionalData(offset, key)), nil
+}
+
+func (c *Collection) decryptValue(offset int64, key string, value []byte) ([]byte, error) {
+	if c.aead == nil {
+		return nil, ErrEncrypted
+	}
+	if len(value) < c.aead.NonceSize() {
+		return nil, ErrDecryptionFailed
+	}
+	nonce, ciphertext := value[:c.aead.NonceSize()], value[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, additionalData(offset, key))
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,81 @@
+package lm2
+
+import (
+	"context"
+	"time"
+)
+
+// ExpireNow deletes every key whose value has expired in a single update,
+// and returns the number of keys deleted. Expired values are hidden from
+// reads as soon as they expire, but they still count as live records, so
+// they don't make automatic compaction or backpressure kick in until they
+// are deleted. Subscriptions receive the deletes.
+func (c *Collection) ExpireNow() (int, error) {
+	if c.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	done := c.startOperation(context.Background(), OpUpdate)
+	wb := NewWriteBatch()
+	_, err := c.update(wb, func() error {
+		now := time.Now().UnixNano()
+		return c.walkRange("", "", func(rec *record) {
+			if rec.Deleted == 0 && rec.Expires != 0 && rec.Expires <= now {
+				wb.Delete(rec.Key)
+			}
+		})
+	})
+	done(err)
+	if err != nil {
+		return 0, err
+	}
+	// Index entries expire with their keys, but aren't counted.
+	n := 0
+	for key := range wb.deletes {
+		if !isReservedKey(key) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// SetExpiryInterval starts calling ExpireNow in the background every
+// interval, replacing any previous interval. An interval of 0 stops it.
+func (c *Collection) SetExpiryInterval(interval time.Duration) {
+	c.expiryLock.Lock()
+	defer c.expiryLock.Unlock()
+
+	c.stopExpiry()
+	if interval > 0 {
+		c.expiryStop = make(chan struct{})
+		c.expiryDone = make(chan struct{})
+		go c.periodicExpiry(interval, c.expiryStop, c.expiryDone)
+	}
+}
+
+func (c *Collection) periodicExpiry(interval time.Duration, stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.ExpireNow()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// stopExpiry stops the background expiry goroutine, if any, and waits
+// for it to exit. The caller must hold expiryLock but not metaLock,
+// which ExpireNow needs.
+func (c *Collection) stopExpiry() {
+	if c.expiryStop == nil {
+		return
+	}
+	close(c.expiryStop)
+	<-c.expiryDone
+	c.expiryStop = nil
+	c.expiryDone = nil
+}
@@ -0,0 +1,127 @@
+package lm2
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// Format is a format used by Export and Import.
+type Format int
+
+const (
+	// JSONLines is one JSON object per line with "key" and "value"
+	// string fields. Keys and values must be valid UTF-8.
+	JSONLines Format = iota
+	// CSV is comma-separated values with one key,value record per line.
+	CSV
+)
+
+// importBatchSize is the number of records committed per update
+// by Import.
+const importBatchSize = 1000
+
+// ErrUnknownFormat is returned by Export and Import
+// for an unknown Format.
+var ErrUnknownFormat = errors.New("lm2: unknown format")
+
+type jsonRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Export writes the latest version of every live record to w
+// in key order using format.
+func (c *Collection) Export(w io.Writer, format Format) error {
+	cur, err := c.NewCursor()
+	if err != nil {
+		return err
+	}
+	defer cur.Close()
+
+	switch format {
+	case JSONLines:
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		for cur.Next() {
+			if !utf8.ValidString(cur.Key()) || !utf8.ValidString(cur.Value()) {
+				return fmt.Errorf("lm2: record %q is not valid UTF-8", cur.Key())
+			}
+			err = enc.Encode(jsonRecord{Key: cur.Key(), Value: cur.Value()})
+			if err != nil {
+				return err
+			}
+		}
+		return bw.Flush()
+	case CSV:
+		cw := csv.NewWriter(w)
+		for cur.Next() {
+			if err = cw.Write([]string{cur.Key(), cur.Value()}); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return ErrUnknownFormat
+}
+
+// Import reads records from r in format and sets them in the collection.
+// Records are committed in batches, so an import that fails part of
+// the way through leaves the records before the failure committed.
+func (c *Collection) Import(r io.Reader, format Format) error {
+	var next func() (string, string, error)
+
+	switch format {
+	case JSONLines:
+		dec := json.NewDecoder(r)
+		next = func() (string, string, error) {
+			rec := jsonRecord{}
+			err := dec.Decode(&rec)
+			return rec.Key, rec.Value, err
+		}
+	case CSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = 2
+		next = func() (string, string, error) {
+			fields, err := cr.Read()
+			if err != nil {
+				return "", "", err
+			}
+			return fields[0], fields[1], nil
+		}
+	default:
+		return ErrUnknownFormat
+	}
+
+	wb := NewWriteBatch()
+	n := 0
+	for {
+		key, value, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		wb.Set(key, value)
+		n++
+		if n == importBatchSize {
+			if _, err = c.Update(wb); err != nil {
+				return err
+			}
+			wb = NewWriteBatch()
+			n = 0
+		}
+	}
+	if n > 0 {
+		if _, err := c.Update(wb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
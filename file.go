@@ -0,0 +1,184 @@
+package lm2
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// file is the part of *os.File used by collections.
+type file interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	io.WriterAt
+	io.Seeker
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+	Name() string
+	Stat() (os.FileInfo, error)
+}
+
+// memFile is a file kept in memory.
+type memFile struct {
+	name   string
+	lock   sync.Mutex
+	data   []byte
+	offset int64
+	closed bool
+}
+
+func newMemFile(name string) *memFile {
+	return &memFile{name: name}
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.readAt(p, off)
+}
+
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, errors.New("lm2: negative offset")
+	}
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	n, err := f.writeAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.writeAt(p, off)
+}
+
+func (f *memFile) writeAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, errors.New("lm2: negative offset")
+	}
+	if end := off + int64(len(p)); end > int64(len(f.data)) {
+		f.resize(end)
+	}
+	return copy(f.data[off:], p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.data))
+	}
+	if offset < 0 {
+		return 0, errors.New("lm2: negative offset")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.resize(size)
+	return nil
+}
+
+// resize grows or shrinks the file to size. New bytes are zeroed.
+func (f *memFile) resize(size int64) {
+	if size <= int64(cap(f.data)) {
+		old := len(f.data)
+		f.data = f.data[:size]
+		for i := old; i < len(f.data); i++ {
+			f.data[i] = 0
+		}
+		return
+	}
+	data := make([]byte, size, 2*size)
+	copy(data, f.data)
+	f.data = data
+}
+
+func (f *memFile) Sync() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	f.data = nil
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return nil, os.ErrClosed
+	}
+	return memFileInfo{name: f.name, size: int64(len(f.data))}, nil
+}
+
+// memFileInfo describes a memFile.
+type memFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() os.FileMode  { return 0666 }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,150 @@
+package lm2
+
+import (
+	"sync"
+	"time"
+)
+
+// commitGroup is a set of concurrent updates committed together.
+type commitGroup struct {
+	wb      *WriteBatch
+	batches int
+
+	// full is closed when the group can't take more batches,
+	// and done once it has been committed.
+	full    chan struct{}
+	done    chan struct{}
+	version int64
+	err     error
+}
+
+// groupCommit holds the group commit settings of a collection
+// and the group that updates can join.
+type groupCommit struct {
+	lock    sync.Mutex
+	size    int
+	window  time.Duration
+	pending *commitGroup
+
+	// commitLock serializes the commits of groups, so that updates
+	// join the next group while the previous one is committed.
+	commitLock sync.Mutex
+}
+
+// SetGroupCommit makes concurrent calls to Update and UpdateContext
+// commit up to size write batches together, in a single update that
+// writes the WAL and the file header and syncs once for all of them. An
+// update waits up to window for others to join it, and updates made while
+// the previous group is being committed join the next group, so a window
+// of 0 still groups updates when there are many of them. Batches are
+// applied in the order they joined the group, and every update in a group
+// returns the same version. If the combined update fails, each batch is
+// committed on its own, so that it returns its own error. Transactions
+// and other updates that read the collection are not grouped. A size of
+// 0 or 1 disables group commit.
+func (c *Collection) SetGroupCommit(size int, window time.Duration) {
+	c.group.lock.Lock()
+	defer c.group.lock.Unlock()
+	c.group.size = size
+	c.group.window = window
+}
+
+// groupUpdate commits wb, together with concurrent updates
+// if group commit is enabled.
+func (c *Collection) groupUpdate(wb *WriteBatch) (int64, error) {
+	c.group.lock.Lock()
+	size, window := c.group.size, c.group.window
+	if size <= 1 {
+		c.group.lock.Unlock()
+		return c.update(wb, nil)
+	}
+
+	if g := c.group.pending; g != nil && g.wb.add(wb) {
+		g.batches++
+		if g.batches >= size {
+			c.group.pending = nil
+			close(g.full)
+		}
+		c.group.lock.Unlock()
+		<-g.done
+		if g.err != nil && g.batches > 1 {
+			return c.update(wb, nil)
+		}
+		return g.version, g.err
+	}
+
+	// Start a new group.
+	g := &commitGroup{
+		wb:      NewWriteBatch(),
+		batches: 1,
+		full:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	g.wb.add(wb)
+	c.group.pending = g
+	c.group.lock.Unlock()
+
+	if window > 0 {
+		timer := time.NewTimer(window)
+		select {
+		case <-g.full:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+
+	c.group.commitLock.Lock()
+	c.group.lock.Lock()
+	if c.group.pending == g {
+		c.group.pending = nil
+	}
+	c.group.lock.Unlock()
+	g.version, g.err = c.update(g.wb, nil)
+	c.group.commitLock.Unlock()
+	close(g.done)
+
+	if g.err != nil && g.batches > 1 {
+		return c.update(wb, nil)
+	}
+	return g.version, g.err
+}
+
+// add adds the changes in other to wb, as if other were applied after
+// wb, and returns true. It returns false and leaves wb unchanged if the
+// two can't be applied as one batch, which is the case when other
+// merges into a key wb deletes without setting it first.
+func (wb *WriteBatch) add(other *WriteBatch) bool {
+	for key := range other.merges {
+		_, deleted := wb.deletes[key]
+		_, set := other.sets[key]
+		_, otherDeleted := other.deletes[key]
+		if deleted && !set && !otherDeleted {
+			return false
+		}
+	}
+
+	for key := range other.deletes {
+		wb.deletes[key] = struct{}{}
+	}
+	for key, value := range other.sets {
+		if _, ok := other.deletes[key]; ok {
+			continue
+		}
+		delete(wb.deletes, key)
+		delete(wb.merges, key)
+		wb.setExpiresAt(key, value, other.expires[key])
+		if meta, ok := other.meta[key]; ok {
+			wb.setRecordMeta(key, meta)
+		}
+		if _, ok := other.entries[key]; ok {
+			wb.entries[key] = struct{}{}
+		}
+	}
+	for key, operands := range other.merges {
+		if _, ok := other.deletes[key]; ok {
+			continue
+		}
+		wb.merges[key] = append(wb.merges[key], operands...)
+	}
+	return true
+}
@@ -0,0 +1,178 @@
+package lm2
+
+import (
+	"io"
+	"sort"
+	"time"
+)
+
+// KeyVersion is a version of a key's value, as returned by History.
+type KeyVersion struct {
+	Value string
+	// Created is the collection version that set the value.
+	Created int64
+	// Deleted is the collection version that deleted or overwrote
+	// the value, or 0 if it is the current value.
+	Deleted int64
+	// Expires is the value's expiration time in Unix nanoseconds,
+	// or 0 if it doesn't expire.
+	Expires int64
+	// Meta is the value's metadata, or nil if it has none.
+	Meta map[string]string
+}
+
+// GetAt returns the value associated with key as of version, which is
+// a version returned by Update or Version. ErrKeyNotFound is returned
+// if key did not exist at that version. Old versions are only
+// available until the collection is compacted, and versions from before
+// a compaction are not meaningful after it.
+func (c *Collection) GetAt(key string, version int64) (string, error) {
+	c.metaLock.RLock()
+	s := c.snapshotAt(version)
+	c.metaLock.RUnlock()
+	return s.Get(key)
+}
+
+// History returns every version of key still in the data file, oldest
+// first. Compaction drops all but the current value.
+func (c *Collection) History(key string) ([]KeyVersion, error) {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+	var versions []KeyVersion
+	var walkErr error
+	err := c.walkKey(key, func(rec *record) bool {
+		if rec.Offset >= c.LastCommit {
+			return false
+		}
+		created, err := c.commitVersion(rec.Offset)
+		if err != nil {
+			walkErr = err
+			return false
+		}
+		versions = append(versions, KeyVersion{
+			Value:   rec.Value,
+			Created: created,
+			Deleted: rec.Deleted,
+			Expires: rec.Expires,
+			Meta:    rec.Meta,
+		})
+		return true
+	})
+	if err == nil {
+		err = walkErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// commitVersion returns the version of the commit that appended the
+// record at offset. The caller must hold metaLock.
+func (c *Collection) commitVersion(offset int64) (int64, error) {
+	version := int64(0)
+	err := c.scanCommits(offset, func(records []int64, v int64) bool {
+		version = v
+		return false
+	})
+	return version, err
+}
+
+// scanCommits calls fn with the record offsets and version of every
+// commit in the data file from offset, which must be the start of a
+// record, until fn returns false. Each commit appends its records
+// followed by a sentinel, so commits are found by reading records until
+// a sentinel. The caller must hold metaLock.
+func (c *Collection) scanCommits(offset int64, fn func(records []int64, version int64) bool) error {
+	buf := [recordHeaderSize]byte{}
+	var records []int64
+	for offset < c.LastCommit {
+		n, err := c.f.ReadAt(buf[:], offset)
+		if n < sentinelSize {
+			if err == nil || err == io.EOF {
+				return errCorrupt("partial read at offset %d", offset)
+			}
+			return err
+		}
+		sentinel, ok := decodeSentinelRecord(buf[:n])
+		if ok && sentinel.Offset == offset {
+			offset += sentinel.size()
+			if !fn(records, offset) {
+				return nil
+			}
+			records = records[:0]
+			continue
+		}
+		if n != recordHeaderSize {
+			return errCorrupt("partial read of record header at offset %d", offset)
+		}
+		header := decodeRecordHeader(buf[:])
+		records = append(records, offset)
+		offset += recordHeaderSize + int64(header.KeyLen) + int64(header.ValLen)
+	}
+	if len(records) > 0 {
+		return errCorrupt("missing commit sentinel before offset %d", c.LastCommit)
+	}
+	return nil
+}
+
+// commitTime is the version and commit time of a commit.
+type commitTime struct {
+	version   int64
+	timestamp int64
+}
+
+// SnapshotAt returns a snapshot of the collection as of the last commit
+// made at or before t. ErrUnknownVersion is returned if no commit with a
+// recorded time was made at or before t. Commit times are wall-clock
+// times, so the result is only meaningful if the clock didn't go
+// backwards between commits. Compact replaces old commits with its own,
+// which are timed when the compaction runs.
+func (c *Collection) SnapshotAt(t time.Time) (*Snapshot, error) {
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+	if err := c.loadCommitTimes(); err != nil {
+		return nil, err
+	}
+	timestamp := t.UnixNano()
+	i := sort.Search(len(c.commitTimes), func(i int) bool {
+		return c.commitTimes[i].timestamp > timestamp
+	})
+	if i == 0 {
+		return nil, ErrUnknownVersion
+	}
+	return c.trackedSnapshot(c.commitTimes[i-1].version), nil
+}
+
+// loadCommitTimes loads the times of the commits in the data file.
+// Commits without a recorded time are left out. The caller must hold
+// metaLock.
+func (c *Collection) loadCommitTimes() error {
+	if c.commitTimesLoaded {
+		return nil
+	}
+	var times []commitTime
+	err := c.scanCommits(fileHeaderSize, func(records []int64, version int64) bool {
+		if sentinel, ok := c.commitAt(version); ok && sentinel.Magic == timedSentinelMagic {
+			times = append(times, commitTime{
+				version:   version,
+				timestamp: sentinel.Timestamp,
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	c.commitTimes = times
+	c.commitTimesLoaded = true
+	return nil
+}
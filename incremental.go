@@ -0,0 +1,192 @@
+package lm2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	incrementalMagic      = 0x1DB4C0DE
+	incrementalHeaderSize = 4 + 4 + 8 + 8 + 8
+	changeHeaderSize      = 8 + 8 + 1 + 2 + 4
+
+	// changeDeleted is set in the flags of a deleted key's change.
+	changeDeleted = 1 << 0
+	// changeMeta is set in the flags of a change whose value is
+	// prefixed with its metadata.
+	changeMeta = 1 << 1
+)
+
+// BackupSince writes the changes committed after version from to w as an
+// incremental backup, and returns the version the backup was taken at.
+// Applied with ApplyIncremental to a collection restored from a Backup
+// taken at version from, or brought up to it by earlier incremental
+// backups, it brings that collection up to the returned version. Only
+// changes are written, including those of metadata entries, not the
+// records they didn't touch. Changes removed by compaction can't be
+// backed up, so ErrUnknownVersion is returned if from is older than the
+// last compaction. The values of an encrypted collection are written
+// encrypted, and can only be applied to a collection with the same key.
+func (c *Collection) BackupSince(from int64, w io.Writer) (int64, error) {
+	c.metaLock.RLock()
+	if c.closed {
+		c.metaLock.RUnlock()
+		return 0, ErrClosed
+	}
+	to := c.LastCommit
+	flags := c.Flags
+	changes, err := c.changesSince(from, true)
+	c.metaLock.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+
+	crc := crc32.New(castagnoli)
+	mw := io.MultiWriter(w, crc)
+	header := make([]byte, incrementalHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:], incrementalMagic)
+	binary.LittleEndian.PutUint32(header[4:], flags)
+	binary.LittleEndian.PutUint64(header[8:], uint64(from))
+	binary.LittleEndian.PutUint64(header[16:], uint64(to))
+	binary.LittleEndian.PutUint64(header[24:], uint64(len(changes)))
+	if _, err = mw.Write(header); err != nil {
+		return 0, err
+	}
+	for _, change := range changes {
+		var flags byte
+		value := []byte(change.Value)
+		if len(change.Meta) > 0 {
+			flags |= changeMeta
+			value = []byte(encodeMeta(change.Meta) + change.Value)
+		}
+		if change.Deleted {
+			flags |= changeDeleted
+		}
+		if c.aead != nil && !change.Deleted {
+			if value, err = c.encryptValue(change.Version, change.Key, value); err != nil {
+				return 0, err
+			}
+		}
+		b := make([]byte, changeHeaderSize, changeHeaderSize+len(change.Key)+len(value))
+		binary.LittleEndian.PutUint64(b[0:], uint64(change.Version))
+		binary.LittleEndian.PutUint64(b[8:], uint64(change.Expires))
+		b[16] = flags
+		binary.LittleEndian.PutUint16(b[17:], uint16(len(change.Key)))
+		binary.LittleEndian.PutUint32(b[19:], uint32(len(value)))
+		b = append(b, change.Key...)
+		b = append(b, value...)
+		if _, err = mw.Write(b); err != nil {
+			return 0, err
+		}
+	}
+	trailer := make([]byte, checksumSize)
+	binary.LittleEndian.PutUint32(trailer, crc.Sum32())
+	if _, err = w.Write(trailer); err != nil {
+		return 0, err
+	}
+	return to, nil
+}
+
+// ApplyIncremental applies an incremental backup written by BackupSince.
+// The whole backup is read and checked before any change is applied, so a
+// damaged backup returns an ErrCorrupt error and leaves the collection
+// unchanged. Incremental backups must be applied in the order they were
+// taken, each starting at the version the previous one returned.
+func (c *Collection) ApplyIncremental(r io.Reader) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	crc := crc32.New(castagnoli)
+	tr := io.TeeReader(r, crc)
+
+	header := make([]byte, incrementalHeaderSize)
+	if _, err := io.ReadFull(tr, header); err != nil {
+		return incrementalReadError(err)
+	}
+	if binary.LittleEndian.Uint32(header[0:]) != incrementalMagic {
+		return ErrInvalidFile
+	}
+	encrypted := binary.LittleEndian.Uint32(header[4:])&flagEncrypted != 0
+	if encrypted && c.aead == nil {
+		return ErrEncrypted
+	}
+	if !encrypted && c.aead != nil {
+		return ErrNotEncrypted
+	}
+
+	numChanges := binary.LittleEndian.Uint64(header[24:])
+	var changes []Change
+	for i := uint64(0); i < numChanges; i++ {
+		change, err := c.readChange(tr)
+		if err != nil {
+			return err
+		}
+		changes = append(changes, change)
+	}
+	if err := checkIncrementalCRC(r, crc); err != nil {
+		return err
+	}
+	return c.applyChanges(changes, true)
+}
+
+// readChange reads a change written by BackupSince from r.
+func (c *Collection) readChange(r io.Reader) (Change, error) {
+	b := make([]byte, changeHeaderSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return Change{}, incrementalReadError(err)
+	}
+	change := Change{
+		Version: int64(binary.LittleEndian.Uint64(b[0:])),
+		Expires: int64(binary.LittleEndian.Uint64(b[8:])),
+		Deleted: b[16]&changeDeleted != 0,
+	}
+	keyLen := int64(binary.LittleEndian.Uint16(b[17:]))
+	valLen := int64(binary.LittleEndian.Uint32(b[19:]))
+
+	// Let the buffer grow with the data rather than trusting the lengths.
+	buf := bytes.NewBuffer(nil)
+	if _, err := io.CopyN(buf, r, keyLen+valLen); err != nil {
+		return Change{}, incrementalReadError(err)
+	}
+	change.Key = string(buf.Next(int(keyLen)))
+	value := buf.Bytes()
+	if c.aead != nil && !change.Deleted {
+		var err error
+		if value, err = c.decryptValue(change.Version, change.Key, value); err != nil {
+			return Change{}, err
+		}
+	}
+	change.Value = string(value)
+	if b[16]&changeMeta != 0 {
+		var ok bool
+		if change.Meta, change.Value, ok = decodeMeta(change.Value); !ok {
+			return Change{}, errCorrupt("invalid metadata in incremental backup")
+		}
+	}
+	return change, nil
+}
+
+// checkIncrementalCRC reads the trailer of an incremental backup from r
+// and checks it against crc, the checksum of everything before it.
+func checkIncrementalCRC(r io.Reader, crc hash.Hash32) error {
+	trailer := make([]byte, checksumSize)
+	if _, err := io.ReadFull(r, trailer); err != nil {
+		return incrementalReadError(err)
+	}
+	if binary.LittleEndian.Uint32(trailer) != crc.Sum32() {
+		return errCorrupt("incremental backup checksum mismatch")
+	}
+	return nil
+}
+
+// incrementalReadError returns the error for a failed read of an
+// incremental backup. Running out of data means it was truncated.
+func incrementalReadError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errCorrupt("truncated incremental backup")
+	}
+	return err
+}
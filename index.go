@@ -0,0 +1,235 @@
+package lm2
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+)
+
+// indexKeyPrefix is the reserved key prefix under which
+// index entries are stored.
+const indexKeyPrefix = "\x00i"
+
+// IndexFunc returns the values a record is indexed under. It is called
+// while an update is applied and must not use the collection.
+type IndexFunc func(key, value string) []string
+
+// CreateIndex creates a secondary index with the given name that maps
+// every value returned by extract for a key and its value to the key.
+// The index is kept up to date by every update from then on, in the same
+// update as the change to the key, and IndexCursor looks keys up in it.
+//
+// Index entries are stored in the collection under reserved keys, as
+// described in the package documentation. Extract functions are not
+// saved, so an index must be created again after the collection is
+// opened, before any update. CreateIndex checks the index against every
+// key and fixes any entries that are missing or stale in a single
+// update, so creating an index that exists only updates the entries
+// that changed. Entries of keys set with a TTL expire with them.
+func (c *Collection) CreateIndex(name string, extract IndexFunc) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+
+	done := c.startOperation(context.Background(), OpUpdate)
+	wb := NewWriteBatch()
+	var previous IndexFunc
+	registered := false
+	_, err := c.update(wb, func() error {
+		if err := c.buildIndex(wb, name, extract); err != nil {
+			return err
+		}
+		previous = c.indexes[name]
+		if c.indexes == nil {
+			c.indexes = map[string]IndexFunc{}
+		}
+		c.indexes[name] = extract
+		registered = true
+		return nil
+	})
+	if err != nil && registered {
+		// The index wasn't built.
+		c.metaLock.Lock()
+		if previous != nil {
+			c.indexes[name] = previous
+		} else {
+			delete(c.indexes, name)
+		}
+		c.metaLock.Unlock()
+	}
+	done(err)
+	return err
+}
+
+// DropIndex removes the index with the given name and its entries in a
+// single update. ErrDoesNotExist is returned if there isn't one.
+func (c *Collection) DropIndex(name string) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+
+	done := c.startOperation(context.Background(), OpUpdate)
+	wb := NewWriteBatch()
+	var dropped IndexFunc
+	_, err := c.update(wb, func() error {
+		extract := c.indexes[name]
+		if extract == nil {
+			return ErrDoesNotExist
+		}
+		prefix := indexPrefix(name)
+		err := c.walkRange(prefix, prefixEnd(prefix), func(rec *record) {
+			if rec.Deleted == 0 {
+				wb.Delete(rec.Key)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		delete(c.indexes, name)
+		dropped = extract
+		return nil
+	})
+	if err != nil && dropped != nil {
+		// The entries weren't deleted.
+		c.metaLock.Lock()
+		c.indexes[name] = dropped
+		c.metaLock.Unlock()
+	}
+	done(err)
+	return err
+}
+
+// IndexCursor returns a new cursor over the keys indexed under value in
+// the index with the given name, with a snapshot view of the current
+// collection state. The cursor's Key returns the indexed keys, in order.
+// ErrDoesNotExist is returned if the index hasn't been created.
+func (c *Collection) IndexCursor(name, value string) (*Cursor, error) {
+	c.metaLock.RLock()
+	_, ok := c.indexes[name]
+	c.metaLock.RUnlock()
+	if !ok {
+		return nil, ErrDoesNotExist
+	}
+
+	cur, err := c.NewCursor()
+	if err != nil {
+		return nil, err
+	}
+	// Index entries are reserved keys.
+	cur.reserved = true
+	cur.prefix = indexPrefix(name) + lengthPrefixed(value)
+	cur.start = cur.prefix
+	cur.end = prefixEnd(cur.prefix)
+	cur.seekFirst(cur.prefix)
+	return cur, nil
+}
+
+// indexPrefix returns the key prefix of the entries of the index
+// with the given name.
+func indexPrefix(name string) string {
+	return indexKeyPrefix + lengthPrefixed(name)
+}
+
+// indexEntry returns the key of the entry of the index with prefix
+// that maps value to key.
+func indexEntry(prefix, value, key string) string {
+	return prefix + lengthPrefixed(value) + key
+}
+
+// lengthPrefixed returns s prefixed with its length, so that
+// no length-prefixed string is a prefix of another.
+func lengthPrefixed(s string) string {
+	length := [binary.MaxVarintLen64]byte{}
+	n := binary.PutUvarint(length[:], uint64(len(s)))
+	return string(length[:n]) + s
+}
+
+// buildIndex adds the changes that make the entries of the index with
+// the given name match extract to wb. The caller must hold metaLock.
+func (c *Collection) buildIndex(wb *WriteBatch, name string, extract IndexFunc) error {
+	now := time.Now().UnixNano()
+	prefix := indexPrefix(name)
+
+	// Entries mapped to their expiration times.
+	entries := map[string]int64{}
+	err := c.walkRange("", "", func(rec *record) {
+		if rec.Deleted != 0 || (rec.Expires != 0 && rec.Expires <= now) ||
+			isReservedKey(rec.Key) {
+			return
+		}
+		for _, value := range extract(rec.Key, rec.Value) {
+			entries[indexEntry(prefix, value, rec.Key)] = rec.Expires
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	err = c.walkRange(prefix, prefixEnd(prefix), func(rec *record) {
+		if rec.Deleted != 0 {
+			return
+		}
+		expires, ok := entries[rec.Key]
+		if !ok {
+			wb.Delete(rec.Key)
+			return
+		}
+		if expires == rec.Expires {
+			// Already up to date.
+			delete(entries, rec.Key)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for entry, expires := range entries {
+		wb.setExpiresAt(entry, "", expires)
+	}
+	return nil
+}
+
+// applyIndexes adds the changes to index entries made by the sets and
+// deletes in wb to wb. The caller must hold metaLock.
+func (c *Collection) applyIndexes(wb *WriteBatch) error {
+	if len(c.indexes) == 0 {
+		return nil
+	}
+
+	var keys []string
+	for key := range wb.sets {
+		keys = append(keys, key)
+	}
+	for key := range wb.deletes {
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		if isReservedKey(key) {
+			continue
+		}
+		existing, _, found, err := c.latest(key)
+		if err != nil {
+			return err
+		}
+		value, set := wb.sets[key]
+		for name, extract := range c.indexes {
+			prefix := indexPrefix(name)
+			entries := map[string]struct{}{}
+			if set {
+				for _, indexed := range extract(key, value) {
+					entry := indexEntry(prefix, indexed, key)
+					wb.setExpiresAt(entry, "", wb.expires[key])
+					entries[entry] = struct{}{}
+				}
+			}
+			if found {
+				for _, indexed := range extract(key, existing) {
+					entry := indexEntry(prefix, indexed, key)
+					if _, ok := entries[entry]; !ok {
+						wb.Delete(entry)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
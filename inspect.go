@@ -0,0 +1,53 @@
+package lm2
+
+// RecordInfo describes a record as stored in the data file.
+type RecordInfo struct {
+	// Offset is the record's offset in the data file.
+	Offset int64
+	// Next is the offset of the next record in the chain,
+	// or 0 if this is the last record.
+	Next int64
+	// Deleted is the version at which the record was deleted or
+	// overwritten, or 0 if it is live.
+	Deleted int64
+	// Expires is the record's expiration time in Unix nanoseconds,
+	// or 0 if it doesn't expire.
+	Expires int64
+	Key     string
+	Value   string
+}
+
+// WalkRecords calls fn for every record in the record chain, including
+// deleted and overwritten records, until fn returns false. It is meant
+// for debugging and inspection tools; use a Cursor to read data.
+func (c *Collection) WalkRecords(fn func(RecordInfo) bool) error {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+	var prev *record
+	for offset := c.Head; offset != 0; {
+		rec, err := c.readRecordAfter(prev, offset)
+		if err != nil {
+			return err
+		}
+		prev = rec
+		rec.lock.RLock()
+		info := RecordInfo{
+			Offset:  rec.Offset,
+			Next:    rec.Next,
+			Deleted: rec.Deleted,
+			Expires: rec.Expires,
+			Key:     rec.Key,
+			Value:   rec.Value,
+		}
+		rec.lock.RUnlock()
+		if !fn(info) {
+			return nil
+		}
+		offset = info.Next
+	}
+	return nil
+}
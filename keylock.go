@@ -0,0 +1,94 @@
+package lm2
+
+import (
+	"context"
+	"sync"
+)
+
+// Unlocker releases a lock.
+type Unlocker interface {
+	Unlock()
+}
+
+// keyLock is the lock of a key. held has room for one value,
+// which is in it while the lock is held.
+type keyLock struct {
+	held chan struct{}
+	// refs is the number of holders and waiters.
+	refs int
+}
+
+// keyLocks is the table of the keys that are locked or being waited for.
+type keyLocks struct {
+	lock  sync.Mutex
+	locks map[string]*keyLock
+}
+
+// keyUnlocker unlocks a key once.
+type keyUnlocker struct {
+	once   sync.Once
+	unlock func()
+}
+
+func (u *keyUnlocker) Unlock() {
+	u.once.Do(u.unlock)
+}
+
+// LockKey locks key, waiting until it's unlocked if it's locked, and
+// returns the Unlocker that unlocks it. Key locks are advisory: they
+// don't stop reads or updates of the key, and they aren't saved and
+// aren't shared between processes. They let goroutines that read, modify
+// and write a key take turns, and a key doesn't need to exist to be
+// locked. ErrClosed is returned if the collection is closed.
+func (c *Collection) LockKey(key string) (Unlocker, error) {
+	return c.LockKeyContext(context.Background(), key)
+}
+
+// LockKeyContext is like LockKey, but stops waiting and returns ctx's
+// error if ctx is done before key is unlocked.
+func (c *Collection) LockKeyContext(ctx context.Context, key string) (Unlocker, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.metaLock.RLock()
+	closed := c.closed
+	c.metaLock.RUnlock()
+	if closed {
+		return nil, ErrClosed
+	}
+
+	l := &c.keyLocks
+	l.lock.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*keyLock{}
+	}
+	kl := l.locks[key]
+	if kl == nil {
+		kl = &keyLock{held: make(chan struct{}, 1)}
+		l.locks[key] = kl
+	}
+	kl.refs++
+	l.lock.Unlock()
+
+	select {
+	case kl.held <- struct{}{}:
+	case <-ctx.Done():
+		l.release(key, kl)
+		return nil, ctx.Err()
+	}
+	return &keyUnlocker{unlock: func() {
+		<-kl.held
+		l.release(key, kl)
+	}}, nil
+}
+
+// release drops a reference to the lock kl of key, and removes
+// it from the table once it has no holders or waiters.
+func (l *keyLocks) release(key string, kl *keyLock) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	kl.refs--
+	if kl.refs == 0 {
+		delete(l.locks, key)
+	}
+}
@@ -0,0 +1,112 @@
+package lm2
+
+import "encoding/binary"
+
+// The structures of the data file are encoded field by field rather than
+// with binary.Write and binary.Read on the structs, so the on-disk layout
+// is fixed by the code below and not by Go's struct layout. All integers
+// are little-endian with no padding.
+
+// bytes encodes h as:
+//
+//	0  Magic             uint32
+//	4  FormatVersion     uint32
+//	8  Flags             uint32
+//	12 Head              int64
+//	20 LastCommit        int64
+//	28 LastValidLogEntry int64
+func (h fileHeader) bytes() []byte {
+	b := make([]byte, fileHeaderSize)
+	binary.LittleEndian.PutUint32(b[0:], h.Magic)
+	binary.LittleEndian.PutUint32(b[4:], h.FormatVersion)
+	binary.LittleEndian.PutUint32(b[8:], h.Flags)
+	binary.LittleEndian.PutUint64(b[12:], uint64(h.Head))
+	binary.LittleEndian.PutUint64(b[20:], uint64(h.LastCommit))
+	binary.LittleEndian.PutUint64(b[28:], uint64(h.LastValidLogEntry))
+	return b
+}
+
+// decodeFileHeader decodes a file header encoded by fileHeader.bytes.
+// b must be at least fileHeaderSize bytes long.
+func decodeFileHeader(b []byte) fileHeader {
+	return fileHeader{
+		Magic:             binary.LittleEndian.Uint32(b[0:]),
+		FormatVersion:     binary.LittleEndian.Uint32(b[4:]),
+		Flags:             binary.LittleEndian.Uint32(b[8:]),
+		Head:              int64(binary.LittleEndian.Uint64(b[12:])),
+		LastCommit:        int64(binary.LittleEndian.Uint64(b[20:])),
+		LastValidLogEntry: int64(binary.LittleEndian.Uint64(b[28:])),
+	}
+}
+
+// bytes encodes h as:
+//
+//	0  Next    int64
+//	8  Deleted int64
+//	16 Expires int64
+//	24 Flags   uint16
+//	26 KeyLen  uint16
+//	28 ValLen  uint32
+//
+// The key and stored value follow the header.
+func (h recordHeader) bytes() []byte {
+	b := make([]byte, recordHeaderSize)
+	binary.LittleEndian.PutUint64(b[0:], uint64(h.Next))
+	binary.LittleEndian.PutUint64(b[8:], uint64(h.Deleted))
+	binary.LittleEndian.PutUint64(b[16:], uint64(h.Expires))
+	binary.LittleEndian.PutUint16(b[24:], h.Flags)
+	binary.LittleEndian.PutUint16(b[26:], h.KeyLen)
+	binary.LittleEndian.PutUint32(b[28:], h.ValLen)
+	return b
+}
+
+// decodeRecordHeader decodes a record header encoded by
+// recordHeader.bytes. b must be at least recordHeaderSize bytes long.
+func decodeRecordHeader(b []byte) recordHeader {
+	return recordHeader{
+		Next:    int64(binary.LittleEndian.Uint64(b[0:])),
+		Deleted: int64(binary.LittleEndian.Uint64(b[8:])),
+		Expires: int64(binary.LittleEndian.Uint64(b[16:])),
+		Flags:   binary.LittleEndian.Uint16(b[24:]),
+		KeyLen:  binary.LittleEndian.Uint16(b[26:]),
+		ValLen:  binary.LittleEndian.Uint32(b[28:]),
+	}
+}
+
+// bytes encodes s as:
+//
+//	0  Magic     uint32
+//	4  Offset    int64
+//	12 Timestamp int64, if Magic is timedSentinelMagic
+func (s sentinelRecord) bytes() []byte {
+	b := make([]byte, s.size())
+	binary.LittleEndian.PutUint32(b[0:], s.Magic)
+	binary.LittleEndian.PutUint64(b[4:], uint64(s.Offset))
+	if s.Magic == timedSentinelMagic {
+		binary.LittleEndian.PutUint64(b[12:], uint64(s.Timestamp))
+	}
+	return b
+}
+
+// decodeSentinelRecord decodes a sentinel encoded by sentinelRecord.bytes.
+// It returns false if b doesn't start with a complete sentinel.
+func decodeSentinelRecord(b []byte) (sentinelRecord, bool) {
+	if len(b) < sentinelSize {
+		return sentinelRecord{}, false
+	}
+	s := sentinelRecord{
+		Magic:  binary.LittleEndian.Uint32(b[0:]),
+		Offset: int64(binary.LittleEndian.Uint64(b[4:])),
+	}
+	switch s.Magic {
+	case sentinelMagic:
+		return s, true
+	case timedSentinelMagic:
+		if len(b) < timedSentinelSize {
+			return s, false
+		}
+		s.Timestamp = int64(binary.LittleEndian.Uint64(b[12:]))
+		return s, true
+	}
+	return s, false
+}
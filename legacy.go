@@ -0,0 +1,145 @@
+package lm2
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// legacyFormatVersion is the format version of data files written before
+// the file header had a magic number and a format version.
+const legacyFormatVersion = 0
+
+// legacyFileHeaderSize is the size of the file header of legacy data
+// files, which only holds Head, LastCommit and LastValidLogEntry.
+const legacyFileHeaderSize = 8 + 8 + 8
+
+// legacyRecordHeaderSizes are the record header sizes of the format
+// versions before version 3. Versions 0 and 1 records are encoded as:
+//
+//	0  Next    int64
+//	8  Deleted int64
+//	16 KeyLen  uint16
+//	18 ValLen  uint32
+//
+// and version 2 records have an Expires int64 after Deleted.
+var legacyRecordHeaderSizes = map[uint32]int{
+	legacyFormatVersion: 8 + 8 + 2 + 4,
+	1:                   8 + 8 + 2 + 4,
+	2:                   8 + 8 + 8 + 2 + 4,
+}
+
+func init() {
+	// Records before version 3 have smaller headers, and files before
+	// version 1 a smaller file header, so they are rewritten. This can't
+	// be part of formatUpgrades' initializer, which upgradeRecords
+	// refers back to through openCollection.
+	for version := range legacyRecordHeaderSizes {
+		formatUpgrades[version] = upgradeRecords
+	}
+}
+
+// decodeLegacyFileHeader decodes the file header of a legacy data file
+// of size bytes. It returns false if b can't be one.
+func decodeLegacyFileHeader(b []byte, size int64) (fileHeader, bool) {
+	if len(b) < legacyFileHeaderSize {
+		return fileHeader{}, false
+	}
+	h := fileHeader{
+		FormatVersion:     legacyFormatVersion,
+		Head:              int64(binary.LittleEndian.Uint64(b[0:])),
+		LastCommit:        int64(binary.LittleEndian.Uint64(b[8:])),
+		LastValidLogEntry: int64(binary.LittleEndian.Uint64(b[16:])),
+	}
+	if h.LastCommit < legacyFileHeaderSize || h.LastCommit > size || h.LastValidLogEntry < 0 {
+		return fileHeader{}, false
+	}
+	if h.Head != 0 && (h.Head < legacyFileHeaderSize || h.Head >= h.LastCommit) {
+		return fileHeader{}, false
+	}
+	return h, true
+}
+
+// decodeLegacyRecordHeader decodes a record header of format version
+// version, which must be at least legacyRecordHeaderSizes[version] bytes.
+func decodeLegacyRecordHeader(b []byte, version uint32) recordHeader {
+	h := recordHeader{
+		Next:    int64(binary.LittleEndian.Uint64(b[0:])),
+		Deleted: int64(binary.LittleEndian.Uint64(b[8:])),
+	}
+	if version == 2 {
+		h.Expires = int64(binary.LittleEndian.Uint64(b[16:]))
+		b = b[8:]
+	}
+	h.KeyLen = binary.LittleEndian.Uint16(b[16:])
+	h.ValLen = binary.LittleEndian.Uint32(b[18:])
+	return h
+}
+
+// upgradeRecords upgrades a collection whose records have a legacy
+// layout by copying its live records into a new data file, like Compact.
+// Records that have expired aren't copied.
+func upgradeRecords(c *Collection) error {
+	dst, err := newCollection(c.f.Name()+".upgrade", c.cache.size, c.aead)
+	if err != nil {
+		return err
+	}
+	dst.SetSyncPolicy(SyncNever, 0)
+
+	err = c.copyLegacy(dst)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if err != nil {
+		dst.Destroy()
+		return err
+	}
+	return c.replaceFile(dst)
+}
+
+// copyLegacy copies the live records of a collection whose records
+// have a legacy layout into dst.
+func (c *Collection) copyLegacy(dst *Collection) error {
+	headerSize := legacyRecordHeaderSizes[c.FormatVersion]
+	start := int64(fileHeaderSize)
+	if c.FormatVersion == legacyFormatVersion {
+		start = legacyFileHeaderSize
+	}
+	now := time.Now().UnixNano()
+
+	// A chain with more records than fit in the file has a cycle.
+	maxRecords := (c.LastCommit - start) / int64(headerSize)
+	wb := NewWriteBatch()
+	n := 0
+	for offset, records := c.Head, int64(0); offset != 0; records++ {
+		if offset < start || offset+int64(headerSize) > c.LastCommit || records >= maxRecords {
+			return errCorrupt("invalid record offset %d", offset)
+		}
+		b := make([]byte, headerSize)
+		if _, err := c.f.ReadAt(b, offset); err != nil {
+			return err
+		}
+		header := decodeLegacyRecordHeader(b, c.FormatVersion)
+		end := offset + int64(headerSize) + int64(header.KeyLen) + int64(header.ValLen)
+		if end > c.LastCommit {
+			return errCorrupt("record at offset %d extends past the last commit", offset)
+		}
+		if header.Deleted == 0 && (header.Expires == 0 || header.Expires > now) {
+			b = make([]byte, int(header.KeyLen)+int(header.ValLen))
+			if _, err := c.f.ReadAt(b, offset+int64(headerSize)); err != nil {
+				return err
+			}
+			key, value := string(b[:header.KeyLen]), string(b[header.KeyLen:])
+			wb.setExpiresAt(key, value, header.Expires)
+			n++
+		}
+		if n == compactionBatchSize || (header.Next == 0 && n > 0) {
+			if _, err := dst.update(wb, nil); err != nil {
+				return err
+			}
+			wb = NewWriteBatch()
+			n = 0
+		}
+		offset = header.Next
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package lm2
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// MaxKeySize is the largest key size a record can hold.
+	MaxKeySize = math.MaxUint16
+	// MaxValueSize is the largest value size, including metadata, that
+	// a record can hold with room for compression, encryption and
+	// checksum overhead.
+	MaxValueSize = math.MaxInt32
+)
+
+// SetSizeLimits sets the largest key and value sizes, in bytes, that
+// updates may set. Updates that set a larger key or value fail with
+// ErrKeyTooLarge or ErrValueTooLarge and change nothing. The sizes of
+// values include their metadata. A limit of 0, or one above MaxKeySize
+// or MaxValueSize, uses that maximum instead. Index entries and shared
+// values are only limited by the maximums. Lowering the limits doesn't
+// affect records that are already stored.
+func (c *Collection) SetSizeLimits(maxKeySize, maxValueSize int) {
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+	if maxKeySize <= 0 || maxKeySize > MaxKeySize {
+		maxKeySize = MaxKeySize
+	}
+	if maxValueSize <= 0 || maxValueSize > MaxValueSize {
+		maxValueSize = MaxValueSize
+	}
+	c.maxKeySize, c.maxValueSize = maxKeySize, maxValueSize
+}
+
+// checkSizes returns an error if wb sets a key or value larger than the
+// size limits. Index entries and shared values are only limited by the
+// record format. The caller must hold metaLock.
+func (c *Collection) checkSizes(wb *WriteBatch) error {
+	for key, value := range wb.sets {
+		size := len(value)
+		if meta := wb.meta[key]; len(meta) > 0 {
+			size += len(encodeMeta(meta))
+		}
+		if err := c.checkSize(key, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSize returns an error if key or a value of size bytes set under
+// it is larger than the size limits. The caller must hold metaLock.
+func (c *Collection) checkSize(key string, size int) error {
+	maxKeySize, maxValueSize := c.maxKeySize, c.maxValueSize
+	if maxKeySize == 0 || isReservedKey(key) {
+		maxKeySize, maxValueSize = MaxKeySize, MaxValueSize
+	}
+	if len(key) > maxKeySize {
+		return fmt.Errorf("%w: %d bytes", ErrKeyTooLarge, len(key))
+	}
+	if size > maxValueSize {
+		return fmt.Errorf("%w: %d bytes for key %q", ErrValueTooLarge, size, truncateKey(key))
+	}
+	return nil
+}
+
+// truncateKey shortens key for error messages.
+func truncateKey(key string) string {
+	const maxLen = 64
+	if len(key) > maxLen {
+		return key[:maxLen] + "..."
+	}
+	return key
+}
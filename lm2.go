@@ -1,66 +1,289 @@
+// Package lm2 implements an ordered key-value store.
+//
+// Keys and values are arbitrary byte strings. They may contain any bytes,
+// including NULs, and are stored with explicit lengths. Keys are ordered
+// by byte-wise comparison. Keys may be up to MaxKeySize (65535) bytes long
+// and values up to MaxValueSize (2 GiB - 1); SetSizeLimits lowers those.
+//
+// The collection stores index entries under keys starting with "\x00i",
+// metadata entries under keys starting with "\x00m" and shared values
+// under keys starting with "\x00v". Keys with these reserved prefixes are
+// kept apart from the collection's own keys: updating one other than with
+// SetMeta fails with ErrReservedKey, and cursors, Len and Export skip
+// them. Bucket keys start with "\x00b", which other keys should avoid so
+// as not to end up in a bucket.
 package lm2
 
 import (
 	"bytes"
+	"context"
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
 	"sort"
 	"sync"
+	"time"
 )
 
-const sentinelMagic = 0xDEAD10CC
+const (
+	sentinelMagic = 0xDEAD10CC
+	fileMagic     = 0x4C4D3246 // "LM2F"
+
+	// timedSentinelMagic starts sentinels that record their commit time.
+	timedSentinelMagic = 0xDEAD10CD
+
+	// formatVersion is the current data file format version.
+	// Version 2 added record expiration times.
+	// Version 3 added record flags.
+	// Version 4 added record checksums.
+	// Version 5 added commit times to sentinels.
+	// Version 6 added record metadata.
+	// Version 7 added shared values.
+	formatVersion = 7
+)
 
 var (
 	// ErrDoesNotExist is returned when a collection's data file
 	// doesn't exist.
 	ErrDoesNotExist = errors.New("lm2: does not exist")
+	// ErrKeyNotFound is returned when a key doesn't exist
+	// in a collection.
+	ErrKeyNotFound = errors.New("lm2: key not found")
+	// ErrInvalidFile is returned when a data file doesn't
+	// start with a valid lm2 file header.
+	ErrInvalidFile = errors.New("lm2: invalid data file")
+	// ErrIncompatibleVersion is returned when a data file uses
+	// a format version that can't be read nor upgraded.
+	ErrIncompatibleVersion = errors.New("lm2: incompatible file format version")
+	// ErrReadOnly is returned when attempting to modify
+	// a collection opened in read-only mode.
+	ErrReadOnly = errors.New("lm2: collection is read-only")
+	// ErrTxConflict is returned by Tx.Commit when a key the
+	// transaction read or wrote was modified after it began.
+	ErrTxConflict = errors.New("lm2: transaction conflict")
+	// ErrTxDone is returned when using a transaction that has
+	// already been committed or rolled back.
+	ErrTxDone = errors.New("lm2: transaction has already been committed or rolled back")
+	// ErrCorrupt is returned, usually wrapped with details, when a data
+	// or WAL file contains inconsistent data such as a truncated record.
+	// Use errors.Is to check for it.
+	ErrCorrupt = errors.New("lm2: corrupt data")
+	// ErrCorruptChain is returned, wrapped with details, when a record
+	// links to a record that can't follow it, which would make the
+	// record chain loop. It is also an ErrCorrupt error.
+	ErrCorruptChain = fmt.Errorf("%w: record chain is out of order", ErrCorrupt)
+	// ErrClosed is returned when using a closed collection.
+	ErrClosed = errors.New("lm2: collection is closed")
+	// ErrLocked is returned when opening a collection that is locked
+	// by another open collection, usually in another process. Only one
+	// collection at a time can be opened for writing.
+	ErrLocked = errors.New("lm2: collection is locked")
+	// ErrConflict is returned by conditional writes such as
+	// CompareAndSwap when their precondition doesn't hold.
+	ErrConflict = errors.New("lm2: conditional write failed")
+	// ErrKeyTooLarge is returned, wrapped with details, by updates
+	// that set a key larger than the collection's size limit.
+	ErrKeyTooLarge = errors.New("lm2: key too large")
+	// ErrValueTooLarge is returned, wrapped with details, by updates
+	// that set a value larger than the collection's size limit.
+	ErrValueTooLarge = errors.New("lm2: value too large")
 )
 
+// errCorrupt returns an ErrCorrupt error with details.
+func errCorrupt(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrCorrupt, fmt.Sprintf(format, args...))
+}
+
+// formatUpgrades maps a format version to a function that migrates
+// a collection from that version to a later one. Each function must
+// update and persist the file header's FormatVersion.
+var formatUpgrades = map[uint32]func(*Collection) error{
+	// Versions before 3 are rewritten by upgradeRecords, which is
+	// registered by legacy.go.
+	// Version 3 records are valid version 4 records.
+	3: upgradeFormatVersion,
+	// Version 4 sentinels are valid version 5 sentinels
+	// without a commit time.
+	4: upgradeFormatVersion,
+	// Version 5 records are valid version 6 records without metadata.
+	5: upgradeFormatVersion,
+	// Version 6 records are valid version 7 records without shared values.
+	6: upgradeFormatVersion,
+}
+
+// upgradeFormatVersion upgrades a collection whose records don't need
+// to change by updating the file header's FormatVersion.
+func upgradeFormatVersion(c *Collection) error {
+	c.FormatVersion++
+	if _, err := c.f.WriteAt(c.fileHeader.bytes(), 0); err != nil {
+		return err
+	}
+	return c.f.Sync()
+}
+
 // Collection represents an ordered linked list map.
 type Collection struct {
 	fileHeader
-	f     *os.File
+	f     file
+	name  string // the name of f, which compaction doesn't change
 	wal   *wal
 	cache *recordCache
 	stats Stats
 
+	readOnly bool
+
+	syncPolicy SyncPolicy
+	syncStop   chan struct{}
+	syncDone   chan struct{}
+
+	// expiryLock guards the background expiry goroutine's channels.
+	expiryLock sync.Mutex
+	expiryStop chan struct{}
+	expiryDone chan struct{}
+
+	// garbage is the number of records deleted or overwritten
+	// since the collection was opened or last compacted.
+	garbage              int
+	autoCompactThreshold int
+	compacting           int32
+	background           sync.WaitGroup
+
+	// backgroundLock guards cancelCompaction, which cancels the running
+	// background compaction, the open AsyncWriters, and closing, which
+	// is set once Close stops background work from starting.
+	backgroundLock   sync.Mutex
+	cancelCompaction context.CancelFunc
+	asyncWriters     map[*AsyncWriter]struct{}
+	closing          bool
+
+	// Record counts are loaded lazily by walking the record
+	// chain and then maintained by Update.
+	countsLoaded   bool
+	liveRecords    uint64
+	deletedRecords uint64
+
+	metrics     Metrics
+	tracer      Tracer
+	logger      Logger
+	compression Compression
+	checksums   bool
+
+	// aead encrypts record values if the collection is encrypted,
+	// and blobHashKey keys the hashes of its shared values.
+	aead        cipher.AEAD
+	blobHashKey []byte
+
+	mergeFunc MergeFunc
+
+	// dedupMinSize is the size above which values are shared,
+	// or 0 if they aren't.
+	dedupMinSize int
+
+	// Size limits of keys and values set by updates,
+	// or 0 for the maximums.
+	maxKeySize   int
+	maxValueSize int
+
+	// indexes maps index names to their extract functions.
+	indexes map[string]IndexFunc
+
+	backpressure    BackpressurePolicy
+	maxGarbageRatio float64
+	onStall         func(time.Duration)
+
+	// bloom contains every key in the record chain if it isn't nil.
+	bloom                  *scalableBloomFilter
+	bloomFalsePositiveRate float64
+
+	subscriptions map[*Subscription]struct{}
+
+	group    groupCommit
+	keyLocks keyLocks
+
+	// cursors and snapshots hold the open cursors and snapshots.
+	// generation is incremented, atomically, by every compaction,
+	// which invalidates them.
+	cursorLock     sync.Mutex
+	cursors        map[*Cursor]struct{}
+	snapshots      map[*Snapshot]struct{}
+	maxOpenCursors int
+	generation     int64
+
+	// Commit times are loaded lazily by scanning the data
+	// file and then maintained by Update.
+	commitTimesLoaded bool
+	commitTimes       []commitTime
+
+	// checkpoints maps checkpoint names to versions.
+	// It is nil until the checkpoints are loaded.
+	checkpoints map[string]int64
+
+	// What opening the collection recovered from: the last WAL entry
+	// was discarded if it was incomplete, and data written after the
+	// last commit was truncated.
+	discardedWALEntry bool
+	truncatedBytes    int64
+
+	// compactLock is held exclusively by Compact and shared by
+	// operations that need record offsets to remain valid.
+	compactLock sync.RWMutex
+
 	metaLock sync.RWMutex
+	closed   bool
+
+	// memory is true if the collection's files are kept in memory.
+	memory bool
 }
 
 type fileHeader struct {
+	Magic             uint32
+	FormatVersion     uint32
+	Flags             uint32 // format feature flags
 	Head              int64
 	LastCommit        int64
 	LastValidLogEntry int64
 }
 
-func (h fileHeader) bytes() []byte {
-	buf := bytes.NewBuffer(nil)
-	binary.Write(buf, binary.LittleEndian, h)
-	return buf.Bytes()
-}
+const fileHeaderSize = 4 + 4 + 4 + 8 + 8 + 8
 
 type recordHeader struct {
 	Next    int64
 	Deleted int64
+	Expires int64  // Unix time in nanoseconds, or 0 if the record doesn't expire
+	Flags   uint16 // compression of the stored value, in the low bits, and encryption
 	KeyLen  uint16
-	ValLen  uint32
+	ValLen  uint32 // length of the stored value
 }
 
-const recordHeaderSize = 8 + 8 + 2 + 4
+const recordHeaderSize = 8 + 8 + 8 + 2 + 2 + 4
 
-func (h recordHeader) bytes() []byte {
-	buf := bytes.NewBuffer(nil)
-	binary.Write(buf, binary.LittleEndian, h)
-	return buf.Bytes()
-}
+// largeRecordSize is the key and value size above which a record's
+// length is checked against the file size before the record is read.
+const largeRecordSize = 1 << 20
 
 type sentinelRecord struct {
-	Magic  uint32 // some fixed pattern
-	Offset int64  // this record's offset
+	Magic     uint32 // sentinelMagic or timedSentinelMagic
+	Offset    int64  // this record's offset
+	Timestamp int64  // commit time in Unix nanoseconds; only in timed sentinels
+}
+
+const (
+	sentinelSize      = 4 + 8
+	timedSentinelSize = 4 + 8 + 8
+)
+
+// size returns the encoded size of s.
+func (s sentinelRecord) size() int64 {
+	if s.Magic == timedSentinelMagic {
+		return timedSentinelSize
+	}
+	return sentinelSize
 }
 
 type record struct {
@@ -68,19 +291,25 @@ type record struct {
 	Offset int64
 	Key    string
 	Value  string
+	Meta   map[string]string // nil if the record has no metadata
+	blob   int64             // offset of the record with the shared value, if any
 
 	lock sync.RWMutex
 }
 
 type recordCache struct {
-	cache            map[int64]*record
+	cache map[int64]*record
+	// sorted holds the cached records ordered by key
+	// and offset to allow binary searches by key.
+	sorted           []*record
 	maxKeyRecord     *record
 	size             int
 	preventPurge     bool
+	readOnly         bool
 	lock             sync.RWMutex
 	updatesSinceSave int
 
-	f *os.File
+	f file
 
 	c *Collection
 }
@@ -95,16 +324,24 @@ func newCache(size int, file string) (*recordCache, error) {
 		f.Close()
 		return nil, err
 	}
+	return newCacheFile(size, f), nil
+}
+
+func newCacheFile(size int, f file) *recordCache {
 	return &recordCache{
 		cache:        map[int64]*record{},
 		maxKeyRecord: nil,
 		size:         size,
 		f:            f,
-	}, nil
+	}
 }
 
-func openCache(size int, file string) (*recordCache, error) {
-	f, err := os.OpenFile(file, os.O_RDWR, 0666)
+func openCache(size int, file string, readOnly bool) (*recordCache, error) {
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(file, flag, 0666)
 	if err != nil {
 		return nil, err
 	}
@@ -113,6 +350,7 @@ func openCache(size int, file string) (*recordCache, error) {
 		cache:        map[int64]*record{},
 		maxKeyRecord: nil,
 		size:         size,
+		readOnly:     readOnly,
 		f:            f,
 	}, nil
 }
@@ -122,7 +360,9 @@ func (rc *recordCache) reload() {
 	b, err := ioutil.ReadAll(rc.f)
 	maxNumRecords := len(b) / 8
 	if err != nil {
-		rc.f.Truncate(int64(maxNumRecords * 8))
+		if !rc.readOnly {
+			rc.f.Truncate(int64(maxNumRecords * 8))
+		}
 		return
 	}
 	buf := bytes.NewReader(b)
@@ -143,11 +383,13 @@ func (rc *recordCache) reload() {
 		numRecords++
 	}
 
-	rc.f.Truncate(int64(numRecords * 8))
+	if !rc.readOnly {
+		rc.f.Truncate(int64(numRecords * 8))
+	}
 }
 
-func (rc *recordCache) close() {
-	rc.f.Close()
+func (rc *recordCache) close() error {
+	return rc.f.Close()
 }
 
 func (rc *recordCache) destroy() error {
@@ -164,19 +406,61 @@ func (rc *recordCache) findLastLessThan(key string) int64 {
 			return rc.maxKeyRecord.Offset
 		}
 	}
-	max := ""
-	maxOffset := int64(0)
 
-	for offset, record := range rc.cache {
-		if record.Key >= key {
-			continue
+	i := sort.Search(len(rc.sorted), func(i int) bool {
+		return rc.sorted[i].Key >= key
+	})
+	if i == 0 {
+		return 0
+	}
+	return rc.sorted[i-1].Offset
+}
+
+// findLast returns the offset of the cached record with
+// the greatest key, or 0 if the cache is empty.
+func (rc *recordCache) findLast() int64 {
+	rc.lock.RLock()
+	defer rc.lock.RUnlock()
+	if rc.maxKeyRecord == nil {
+		return 0
+	}
+	return rc.maxKeyRecord.Offset
+}
+
+// searchSorted returns the index in sorted where rec belongs.
+func (rc *recordCache) searchSorted(rec *record) int {
+	return sort.Search(len(rc.sorted), func(i int) bool {
+		other := rc.sorted[i]
+		if other.Key != rec.Key {
+			return other.Key > rec.Key
 		}
-		if record.Key > max {
-			max = record.Key
-			maxOffset = offset
+		return other.Offset >= rec.Offset
+	})
+}
+
+// set adds rec to the cache, replacing any record
+// cached at the same offset.
+func (rc *recordCache) set(rec *record) {
+	if old := rc.cache[rec.Offset]; old != nil {
+		if old == rec {
+			return
 		}
+		rc.remove(old)
+	}
+	rc.cache[rec.Offset] = rec
+	i := rc.searchSorted(rec)
+	rc.sorted = append(rc.sorted, nil)
+	copy(rc.sorted[i+1:], rc.sorted[i:])
+	rc.sorted[i] = rec
+}
+
+// remove removes rec from the cache.
+func (rc *recordCache) remove(rec *record) {
+	delete(rc.cache, rec.Offset)
+	i := rc.searchSorted(rec)
+	if i < len(rc.sorted) && rc.sorted[i] == rec {
+		rc.sorted = append(rc.sorted[:i], rc.sorted[i+1:]...)
 	}
-	return maxOffset
 }
 
 func (rc *recordCache) push(rec *record) {
@@ -188,7 +472,7 @@ func (rc *recordCache) push(rec *record) {
 	} else if len(rc.cache) == rc.size && rand.Float32() >= 0.01 {
 		return
 	}
-	rc.cache[rec.Offset] = rec
+	rc.set(rec)
 	rc.updatesSinceSave++
 	if !rc.preventPurge {
 		rc.purge()
@@ -196,6 +480,9 @@ func (rc *recordCache) push(rec *record) {
 }
 
 func (rc *recordCache) save() {
+	if rc.readOnly {
+		return
+	}
 	_, err := rc.f.Seek(0, 0)
 	if err != nil {
 		return
@@ -220,7 +507,10 @@ func (rc *recordCache) purge() {
 			deletedKey = k
 			break
 		}
-		delete(rc.cache, deletedKey)
+		if deletedKey == 0 {
+			break
+		}
+		rc.remove(rc.cache[deletedKey])
 		purged++
 	}
 	if rc.updatesSinceSave > 4*rc.size {
@@ -235,12 +525,12 @@ func (rc *recordCache) forcePush(rec *record) {
 	if rc.maxKeyRecord == nil || rc.maxKeyRecord.Key < rec.Key {
 		rc.maxKeyRecord = rec
 	}
-	rc.cache[rec.Offset] = rec
+	rc.set(rec)
 }
 
 func (c *Collection) readRecord(offset int64) (*record, error) {
-	if offset == 0 {
-		return nil, errors.New("lm2: invalid record offset 0")
+	if offset < fileHeaderSize {
+		return nil, errCorrupt("invalid record offset %d", offset)
 	}
 
 	c.cache.lock.RLock()
@@ -254,36 +544,74 @@ func (c *Collection) readRecord(offset int64) (*record, error) {
 
 	recordHeaderBytes := [recordHeaderSize]byte{}
 	n, err := c.f.ReadAt(recordHeaderBytes[:], offset)
-	if err != nil {
-		return nil, err
-	}
 	if n != recordHeaderSize {
-		return nil, errors.New("lm2: partial read")
+		if err == nil || err == io.EOF {
+			return nil, errCorrupt("partial read of record header at offset %d", offset)
+		}
+		return nil, err
 	}
 
-	header := recordHeader{}
-	err = binary.Read(bytes.NewReader(recordHeaderBytes[:]), binary.LittleEndian, &header)
-	if err != nil {
+	header := decodeRecordHeader(recordHeaderBytes[:])
+
+	size := int64(header.KeyLen) + int64(header.ValLen)
+	if size > largeRecordSize {
+		// Don't trust a corrupt length with a large allocation.
+		info, err := c.f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if offset+recordHeaderSize+size > info.Size() {
+			return nil, errCorrupt("record at offset %d extends past the end of the file", offset)
+		}
+	}
+	keyValBuf := make([]byte, size)
+	n, err = c.f.ReadAt(keyValBuf, offset+recordHeaderSize)
+	if n != len(keyValBuf) {
+		if err == nil || err == io.EOF {
+			return nil, errCorrupt("partial read of record at offset %d", offset)
+		}
 		return nil, err
 	}
 
-	keyValBuf := make([]byte, int(header.KeyLen)+int(header.ValLen))
-	n, err = c.f.ReadAt(keyValBuf, offset+recordHeaderSize)
+	key := string(keyValBuf[:int(header.KeyLen)])
+	storedValue := keyValBuf[int(header.KeyLen):]
+	if header.Flags&recordChecksum != 0 {
+		storedValue, err = checkChecksum(offset, key, storedValue)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if header.Flags&recordEncrypted != 0 {
+		storedValue, err = c.decryptValue(offset, key, storedValue)
+		if err != nil {
+			return nil, err
+		}
+	}
+	value, err := decompressValue(header.Flags, storedValue)
 	if err != nil {
 		return nil, err
 	}
-	if n != len(keyValBuf) {
-		return nil, errors.New("lm2: partial read")
+	var meta map[string]string
+	if header.Flags&recordMeta != 0 {
+		var ok bool
+		if meta, value, ok = decodeMeta(value); !ok {
+			return nil, errCorrupt("invalid metadata in record at offset %d", offset)
+		}
+	}
+	var blob int64
+	if header.Flags&recordShared != 0 {
+		if blob, value, err = c.readShared(offset, value); err != nil {
+			return nil, err
+		}
 	}
-
-	key := string(keyValBuf[:int(header.KeyLen)])
-	value := string(keyValBuf[int(header.KeyLen):])
 
 	rec := &record{
 		recordHeader: header,
 		Offset:       offset,
 		Key:          key,
 		Value:        value,
+		Meta:         meta,
+		blob:         blob,
 	}
 	c.stats.incRecordsRead(1)
 	c.stats.incCacheMisses(1)
@@ -297,18 +625,74 @@ func (c *Collection) nextRecord(rec *record) *record {
 	if rec == nil {
 		return nil
 	}
-	nextRec, err := c.readRecord(rec.Next)
+	nextRec, err := c.readRecordAfter(rec, rec.Next)
 	if err != nil {
 		return nil
 	}
 	return nextRec
 }
 
-func writeRecord(rec *record, currentOffset int64, buf *bytes.Buffer) error {
+// readRecordAfter reads the record at offset, which prev links to. prev
+// is nil for the head record. Records are linked in increasing order of
+// key and then offset, so a record that doesn't follow prev means the
+// chain is corrupt, and following it could loop forever.
+func (c *Collection) readRecordAfter(prev *record, offset int64) (*record, error) {
+	rec, err := c.readRecord(offset)
+	if err != nil {
+		return nil, err
+	}
+	if prev != nil && (rec.Key < prev.Key || rec.Key == prev.Key && rec.Offset <= prev.Offset) {
+		return nil, fmt.Errorf("%w: record at offset %d follows offset %d", ErrCorruptChain, offset, prev.Offset)
+	}
+	return rec, nil
+}
+
+// writeRecord appends rec to buf. The value is compressed with the
+// compression in rec.Flags, which is cleared if it doesn't make the
+// value smaller, then encrypted if the collection is encrypted, and
+// then prefixed with a checksum if checksums are enabled.
+func (c *Collection) writeRecord(rec *record, currentOffset int64, buf *bytes.Buffer) error {
+	payload := rec.Value
+	rec.Flags &^= recordMeta | recordShared
+	if rec.blob != 0 {
+		payload = blobRef(rec.blob)
+		rec.Flags |= recordShared
+	}
+	if len(rec.Meta) > 0 {
+		payload = encodeMeta(rec.Meta) + payload
+		rec.Flags |= recordMeta
+	}
+	value, err := compressValue(Compression(rec.Flags&recordCompressionMask), payload)
+	if err != nil {
+		return err
+	}
+	if len(value) >= len(payload) {
+		rec.Flags &^= recordCompressionMask
+		value = []byte(payload)
+	}
+	rec.Flags &^= recordEncrypted
+	if c.aead != nil {
+		value, err = c.encryptValue(currentOffset, rec.Key, value)
+		if err != nil {
+			return err
+		}
+		rec.Flags |= recordEncrypted
+	}
+	rec.Flags &^= recordChecksum
+	if c.checksums {
+		value = addChecksum(rec.Key, value)
+		rec.Flags |= recordChecksum
+	}
+	if len(rec.Key) > MaxKeySize {
+		return fmt.Errorf("%w: %d bytes", ErrKeyTooLarge, len(rec.Key))
+	}
+	if uint64(len(value)) > math.MaxUint32 {
+		return fmt.Errorf("%w: %d bytes stored", ErrValueTooLarge, len(value))
+	}
 	rec.KeyLen = uint16(len(rec.Key))
-	rec.ValLen = uint32(len(rec.Value))
+	rec.ValLen = uint32(len(value))
 
-	err := binary.Write(buf, binary.LittleEndian, rec.recordHeader)
+	_, err = buf.Write(rec.recordHeader.bytes())
 	if err != nil {
 		return err
 	}
@@ -317,7 +701,7 @@ func writeRecord(rec *record, currentOffset int64, buf *bytes.Buffer) error {
 	if err != nil {
 		return err
 	}
-	_, err = buf.WriteString(rec.Value)
+	_, err = buf.Write(value)
 	if err != nil {
 		return err
 	}
@@ -326,20 +710,47 @@ func writeRecord(rec *record, currentOffset int64, buf *bytes.Buffer) error {
 	return nil
 }
 
-func (c *Collection) writeSentinel() (int64, error) {
+// writeSentinel appends a sentinel with commit time timestamp
+// and returns the version of the commit.
+func (c *Collection) writeSentinel(timestamp int64) (int64, error) {
 	offset, err := c.f.Seek(0, 2)
 	if err != nil {
 		return 0, err
 	}
 	sentinel := sentinelRecord{
-		Magic:  sentinelMagic,
-		Offset: offset,
+		Magic:     timedSentinelMagic,
+		Offset:    offset,
+		Timestamp: timestamp,
 	}
-	err = binary.Write(c.f, binary.LittleEndian, sentinel)
+	_, err = c.f.Write(sentinel.bytes())
 	if err != nil {
 		return 0, err
 	}
-	return offset + 12, nil
+	return offset + timedSentinelSize, nil
+}
+
+// sentinelAt returns the sentinel at offset. It returns false if
+// there isn't one or it can't be read.
+func (c *Collection) sentinelAt(offset int64) (sentinelRecord, bool) {
+	buf := [timedSentinelSize]byte{}
+	n, _ := c.f.ReadAt(buf[:], offset)
+	sentinel, ok := decodeSentinelRecord(buf[:n])
+	return sentinel, ok && sentinel.Offset == offset
+}
+
+// commitAt returns the sentinel of the commit at version. It returns
+// false if version isn't the version of a commit.
+func (c *Collection) commitAt(version int64) (sentinelRecord, bool) {
+	for _, size := range []int64{timedSentinelSize, sentinelSize} {
+		if version-size < fileHeaderSize {
+			continue
+		}
+		sentinel, ok := c.sentinelAt(version - size)
+		if ok && sentinel.size() == size {
+			return sentinel, true
+		}
+	}
+	return sentinelRecord{}, false
 }
 
 func (c *Collection) findLastLessThanOrEqual(key string, startingOffset int64) (int64, error) {
@@ -397,12 +808,100 @@ func (c *Collection) findLastLessThanOrEqual(key string, startingOffset int64) (
 // Update atomically and durably applies a WriteBatch (a set of updates) to the collection.
 // It returns the new version (on success) and an error.
 func (c *Collection) Update(wb *WriteBatch) (int64, error) {
+	return c.UpdateContext(context.Background(), wb)
+}
+
+// walkKey calls fn with every record with key, including deleted and
+// overwritten records, until fn returns false. The record is read locked
+// while fn runs. The caller must hold metaLock.
+func (c *Collection) walkKey(key string, fn func(*record) bool) error {
+	offset := c.cache.findLastLessThan(key)
+	if offset == 0 {
+		offset = c.Head
+	}
+	if offset == 0 {
+		return nil
+	}
+	rec, err := c.readRecord(offset)
+	if err != nil {
+		return err
+	}
+	for rec != nil {
+		rec.lock.RLock()
+		if rec.Key > key {
+			rec.lock.RUnlock()
+			break
+		}
+		if rec.Key == key && !fn(rec) {
+			rec.lock.RUnlock()
+			break
+		}
+		next := rec.Next
+		rec.lock.RUnlock()
+		if next == 0 {
+			break
+		}
+		if rec, err = c.readRecordAfter(rec, next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateContext is like Update, but returns ctx's error without
+// applying wb if ctx is done before the update starts.
+func (c *Collection) UpdateContext(ctx context.Context, wb *WriteBatch) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if c.readOnly {
+		return 0, ErrReadOnly
+	}
+	if err := wb.checkReserved(); err != nil {
+		return 0, err
+	}
+
+	done := c.startOperation(ctx, OpUpdate)
+	version, err := c.groupUpdate(wb)
+	done(err)
+	return version, err
+}
+
+// update applies wb. If check is not nil, it is called once metaLock
+// is held and the update is aborted if it returns an error.
+func (c *Collection) update(wb *WriteBatch, check func() error) (int64, error) {
+	if err := c.throttle(); err != nil {
+		return 0, err
+	}
+
 	c.metaLock.Lock()
 	defer c.metaLock.Unlock()
 
+	if c.closed {
+		return 0, ErrClosed
+	}
+	if check != nil {
+		if err := check(); err != nil {
+			return 0, err
+		}
+	}
+
 	// Clean up WriteBatch.
 	wb.cleanup()
 
+	if err := c.applyMerges(wb); err != nil {
+		return 0, err
+	}
+	if err := c.applyIndexes(wb); err != nil {
+		return 0, err
+	}
+	if err := c.applyDedup(wb); err != nil {
+		return 0, err
+	}
+	if err := c.checkSizes(wb); err != nil {
+		return 0, err
+	}
+
 	// Find and load records that will be modified into the cache.
 
 	mergedSetDeleteKeys := map[string]struct{}{}
@@ -471,15 +970,24 @@ func (c *Collection) Update(wb *WriteBatch) (int64, error) {
 
 	walEntry := newWALEntry()
 
+	// Shared values are written before the records that refer to them.
+	order := keys
+	if len(wb.shared) > 0 {
+		order = append([]string(nil), keys...)
+		sort.SliceStable(order, func(i, j int) bool {
+			return isBlobKey(order[i]) && !isBlobKey(order[j])
+		})
+	}
+
 	// Append new records with the appropriate "next" pointers.
 	overwrittenRecords := []int64{}
 	newlyInserted := map[string]int64{}
 	appendBuf := bytes.NewBuffer(nil)
 	currentOffset, err := c.f.Seek(0, 2)
 	if err != nil {
-		return 0, errors.New("lm2: couldn't get current file offset")
+		return 0, fmt.Errorf("lm2: couldn't get current file offset: %w", err)
 	}
-	for _, key := range keys {
+	for _, key := range order {
 		value, ok := wb.sets[key]
 		if !ok {
 			// Key is part of a delete.
@@ -489,13 +997,13 @@ func (c *Collection) Update(wb *WriteBatch) (int64, error) {
 		// Find last less than.
 		offset := lastLessThanOrEqualCache[key]
 		if offset == 0 {
-			maxLessThan := ""
+			maxLessThan, found := "", false
 			for newlyInsertedKey := range newlyInserted {
-				if newlyInsertedKey <= key && newlyInsertedKey > maxLessThan {
-					maxLessThan = newlyInsertedKey
+				if newlyInsertedKey <= key && (!found || newlyInsertedKey > maxLessThan) {
+					maxLessThan, found = newlyInsertedKey, true
 				}
 			}
-			if maxLessThan != "" {
+			if found {
 				offset = newlyInserted[maxLessThan]
 			}
 		}
@@ -503,13 +1011,17 @@ func (c *Collection) Update(wb *WriteBatch) (int64, error) {
 			// Head.
 			rec := &record{
 				recordHeader: recordHeader{
-					Next: c.Head,
+					Next:    c.Head,
+					Expires: wb.expires[key],
+					Flags:   uint16(c.compression),
 				},
 				Key:   key,
 				Value: value,
+				Meta:  wb.meta[key],
+				blob:  wb.blobOffset(key, newlyInserted),
 			}
 			newRecordOffset := currentOffset + int64(appendBuf.Len())
-			err = writeRecord(rec, newRecordOffset, appendBuf)
+			err = c.writeRecord(rec, newRecordOffset, appendBuf)
 			if err != nil {
 				return 0, err
 			}
@@ -523,14 +1035,14 @@ func (c *Collection) Update(wb *WriteBatch) (int64, error) {
 			return 0, err
 		}
 		{
-			maxLessThan := ""
+			maxLessThan, found := "", false
 			for newlyInsertedKey := range newlyInserted {
 				if newlyInsertedKey <= key && newlyInsertedKey >= prevRec.Key &&
-					newlyInsertedKey > maxLessThan {
-					maxLessThan = newlyInsertedKey
+					(!found || newlyInsertedKey > maxLessThan) {
+					maxLessThan, found = newlyInsertedKey, true
 				}
 			}
-			if maxLessThan != "" {
+			if found {
 				prevRec, err = c.readRecord(newlyInserted[maxLessThan])
 				if err != nil {
 					return 0, err
@@ -539,13 +1051,17 @@ func (c *Collection) Update(wb *WriteBatch) (int64, error) {
 		}
 		rec := &record{
 			recordHeader: recordHeader{
-				Next: prevRec.Next,
+				Next:    prevRec.Next,
+				Expires: wb.expires[key],
+				Flags:   uint16(c.compression),
 			},
 			Key:   key,
 			Value: value,
+			Meta:  wb.meta[key],
+			blob:  wb.blobOffset(key, newlyInserted),
 		}
 		newRecordOffset := currentOffset + int64(appendBuf.Len())
-		err = writeRecord(rec, newRecordOffset, appendBuf)
+		err = c.writeRecord(rec, newRecordOffset, appendBuf)
 		if err != nil {
 			return 0, err
 		}
@@ -553,7 +1069,7 @@ func (c *Collection) Update(wb *WriteBatch) (int64, error) {
 		c.cache.forcePush(rec)
 		prevRec.Next = newRecordOffset
 		walEntry.Push(newWALRecord(prevRec.Offset, prevRec.recordHeader.bytes()))
-		if prevRec.Key == key {
+		if prevRec.Key == key && prevRec.Deleted == 0 {
 			overwrittenRecords = append(overwrittenRecords, prevRec.Offset)
 		}
 		c.cache.forcePush(rec)
@@ -561,37 +1077,54 @@ func (c *Collection) Update(wb *WriteBatch) (int64, error) {
 	}
 	n, err := c.f.Write(appendBuf.Bytes())
 	if err != nil {
-		return 0, errors.New("lm2: appending records failed")
+		return 0, fmt.Errorf("lm2: appending records failed: %w", err)
 	}
 	if n != appendBuf.Len() {
-		return 0, errors.New("lm2: partial write")
+		return 0, fmt.Errorf("lm2: appending records failed: %w", io.ErrShortWrite)
 	}
 
 	// Write sentinel record.
 
-	currentOffset, err = c.writeSentinel()
+	committed := time.Now().UnixNano()
+	currentOffset, err = c.writeSentinel(committed)
 	if err != nil {
 		return 0, err
 	}
 
 	// fsync data file.
-	err = c.f.Sync()
-	if err != nil {
-		return 0, err
+	if c.syncPolicy == SyncAlways {
+		err = c.f.Sync()
+		if err != nil {
+			return 0, err
+		}
 	}
 
 	// Mark deleted and overwritten records as "deleted" at sentinel offset.
 	// (This happens in memory.)
 
+	newGarbage := 0
+	numDeleted := 0
+	deleted := map[string]struct{}{}
 	for key := range wb.deletes {
 		offset := lastLessThanOrEqualCache[key]
+		if offset == 0 {
+			// Key doesn't exist.
+			continue
+		}
 		rec, err := c.readRecord(offset)
 		if err != nil {
 			return 0, err
 		}
+		if rec.Key != key {
+			// Key doesn't exist.
+			continue
+		}
 		if rec.Deleted == 0 {
 			rec.Deleted = currentOffset
 			walEntry.Push(newWALRecord(rec.Offset, rec.recordHeader.bytes()))
+			newGarbage++
+			numDeleted++
+			deleted[key] = struct{}{}
 		}
 	}
 
@@ -602,15 +1135,75 @@ func (c *Collection) Update(wb *WriteBatch) (int64, error) {
 		}
 		rec.Deleted = currentOffset
 		walEntry.Push(newWALRecord(rec.Offset, rec.recordHeader.bytes()))
+		newGarbage++
 	}
 
 	// ^ record changes should have been serialized + buffered. Write those entries
 	// out to the WAL.
 	c.LastCommit = currentOffset
+	if err = c.commitWAL(walEntry); err != nil {
+		return 0, err
+	}
+
+	c.stats.incRecordsWritten(uint64(len(newlyInserted)))
+	c.garbage += newGarbage
+	if c.countsLoaded {
+		c.liveRecords += uint64(len(newlyInserted))
+		c.liveRecords -= uint64(newGarbage)
+		c.deletedRecords += uint64(newGarbage)
+	}
+	if c.bloom != nil {
+		for key := range newlyInserted {
+			c.bloom.add(key)
+		}
+	}
+	if c.commitTimesLoaded {
+		c.commitTimes = append(c.commitTimes, commitTime{
+			version:   c.LastCommit,
+			timestamp: committed,
+		})
+	}
+	if c.metrics != nil {
+		c.metrics.ObserveRecords(len(newlyInserted), numDeleted)
+	}
+	if len(c.subscriptions) > 0 {
+		changes := make([]Change, 0, len(newlyInserted)+len(deleted))
+		for _, key := range keys {
+			if isReservedKey(key) {
+				continue
+			}
+			if _, ok := newlyInserted[key]; ok {
+				changes = append(changes, Change{
+					Version: c.LastCommit,
+					Key:     key,
+					Value:   wb.sets[key],
+					Expires: wb.expires[key],
+					Meta:    wb.meta[key],
+				})
+			} else if _, ok := deleted[key]; ok {
+				changes = append(changes, Change{
+					Version: c.LastCommit,
+					Key:     key,
+					Deleted: true,
+				})
+			}
+		}
+		c.publish(changes)
+	}
+	c.maybeAutoCompact()
+	if c.syncPolicy != SyncAlways {
+		return c.LastCommit, nil
+	}
+	return c.LastCommit, c.f.Sync()
+}
+
+// commitWAL appends walEntry and the file header to the WAL, and then
+// applies them to the data file.
+func (c *Collection) commitWAL(walEntry *walEntry) error {
 	walEntry.Push(newWALRecord(0, c.fileHeader.bytes()))
 	logCommit, err := c.wal.Append(walEntry)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
 	c.LastValidLogEntry = logCommit
@@ -620,24 +1213,202 @@ func (c *Collection) Update(wb *WriteBatch) (int64, error) {
 	for _, walRec := range walEntry.records {
 		n, err := c.f.WriteAt(walRec.Data, walRec.Offset)
 		if err != nil {
-			return 0, err
+			return err
 		}
 		if int64(n) != walRec.Size {
-			return 0, errors.New("lm2: incomplete data write")
+			return fmt.Errorf("lm2: incomplete data write: %w", io.ErrShortWrite)
 		}
 	}
+	return nil
+}
 
-	c.stats.incRecordsWritten(uint64(len(newlyInserted)))
-	return c.LastCommit, c.f.Sync()
+// Get returns the value associated with key in the latest version
+// of the collection. ErrKeyNotFound is returned if key does not exist.
+func (c *Collection) Get(key string) (string, error) {
+	return c.GetContext(context.Background(), key)
+}
+
+// Has returns true if key exists in the latest version of the collection.
+func (c *Collection) Has(key string) (bool, error) {
+	done := c.startOperation(context.Background(), OpGet)
+	found, err := c.latestSnapshot().Has(key)
+	done(err)
+	return found, err
+}
+
+// GetMulti returns the values of keys in the latest version of the
+// collection. Keys that don't exist are left out of the result.
+func (c *Collection) GetMulti(keys []string) (map[string]string, error) {
+	done := c.startOperation(context.Background(), OpGet)
+	values, err := c.latestSnapshot().GetMulti(keys)
+	done(err)
+	return values, err
+}
+
+// GetContext is like Get, but returns ctx's error
+// if ctx is done before the lookup starts.
+func (c *Collection) GetContext(ctx context.Context, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	done := c.startOperation(ctx, OpGet)
+	value, err := c.latestSnapshot().Get(key)
+	if err == ErrKeyNotFound {
+		done(nil)
+	} else {
+		done(err)
+	}
+	return value, err
+}
+
+// Set sets key to value in a single update.
+func (c *Collection) Set(key, value string) error {
+	wb := NewWriteBatch()
+	wb.Set(key, value)
+	_, err := c.Update(wb)
+	return err
+}
+
+// SetContext is like Set, but returns ctx's error without
+// setting key if ctx is done before the update starts.
+func (c *Collection) SetContext(ctx context.Context, key, value string) error {
+	wb := NewWriteBatch()
+	wb.Set(key, value)
+	_, err := c.UpdateContext(ctx, wb)
+	return err
+}
+
+// SetWithTTL sets key to value in a single update. The record
+// expires ttl after SetWithTTL is called.
+func (c *Collection) SetWithTTL(key, value string, ttl time.Duration) error {
+	wb := NewWriteBatch()
+	wb.SetWithTTL(key, value, ttl)
+	_, err := c.Update(wb)
+	return err
+}
+
+// Delete deletes key in a single update. Deleting a key
+// that does not exist is not an error.
+func (c *Collection) Delete(key string) error {
+	wb := NewWriteBatch()
+	wb.Delete(key)
+	_, err := c.Update(wb)
+	return err
+}
+
+// CompareAndSwap sets key to new if its current value is expected.
+// ErrConflict is returned if key doesn't exist or has a different value.
+func (c *Collection) CompareAndSwap(key, expected, new string) error {
+	return c.setIf(key, new, func(value string, found bool) bool {
+		return found && value == expected
+	})
+}
+
+// PutIfAbsent sets key to value if key doesn't exist.
+// ErrConflict is returned if it does.
+func (c *Collection) PutIfAbsent(key, value string) error {
+	return c.setIf(key, value, func(_ string, found bool) bool {
+		return !found
+	})
+}
+
+// setIf sets key to value if cond returns true for the current
+// value of key. The check and the set are a single update.
+func (c *Collection) setIf(key, value string, cond func(value string, found bool) bool) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	if isReservedKey(key) {
+		return reservedKeyError(key)
+	}
+
+	done := c.startOperation(context.Background(), OpUpdate)
+	wb := NewWriteBatch()
+	wb.Set(key, value)
+	_, err := c.update(wb, func() error {
+		current, _, found, err := c.latest(key)
+		if err != nil {
+			return err
+		}
+		if !cond(current, found) {
+			return ErrConflict
+		}
+		return nil
+	})
+	done(err)
+	return err
+}
+
+// DeleteRange deletes every key greater than or equal to start and less
+// than end in a single update. An empty end means there is no upper bound.
+// Reserved keys in the range are left alone.
+func (c *Collection) DeleteRange(start, end string) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+
+	done := c.startOperation(context.Background(), OpUpdate)
+	wb := NewWriteBatch()
+	_, err := c.update(wb, func() error {
+		// Find the keys while metaLock is held so that
+		// keys set concurrently can't be missed.
+		return c.walkRange(start, end, func(rec *record) {
+			if rec.Deleted == 0 && !isReservedKey(rec.Key) {
+				wb.Delete(rec.Key)
+			}
+		})
+	})
+	done(err)
+	return err
+}
+
+// walkRange calls fn with every record with a key greater than or equal
+// to start and less than end, including deleted and overwritten records.
+// An empty end means there is no upper bound. The record is read locked
+// while fn runs. The caller must hold metaLock.
+func (c *Collection) walkRange(start, end string, fn func(*record)) error {
+	offset := c.cache.findLastLessThan(start)
+	if offset == 0 {
+		offset = c.Head
+	}
+	var prev *record
+	for offset != 0 {
+		rec, err := c.readRecordAfter(prev, offset)
+		if err != nil {
+			return err
+		}
+		prev = rec
+		rec.lock.RLock()
+		if end != "" && rec.Key >= end {
+			rec.lock.RUnlock()
+			break
+		}
+		if rec.Key >= start {
+			fn(rec)
+		}
+		offset = rec.Next
+		rec.lock.RUnlock()
+	}
+	return nil
 }
 
 // NewCollection creates a new collection with a data file at file.
 // cacheSize represents the size of the collection cache.
 func NewCollection(file string, cacheSize int) (*Collection, error) {
+	return newCollection(file, cacheSize, nil)
+}
+
+func newCollection(file string, cacheSize int, aead cipher.AEAD) (*Collection, error) {
 	f, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR, 0666)
 	if err != nil {
 		return nil, err
 	}
+	err = lockFile(f, false)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
 	err = f.Truncate(0)
 	if err != nil {
 		f.Close()
@@ -656,18 +1427,32 @@ func NewCollection(file string, cacheSize int) (*Collection, error) {
 		wal.Close()
 		return nil, err
 	}
+	return initCollection(f, wal, cache, aead)
+}
+
+// initCollection creates a collection in empty files.
+func initCollection(f file, wal *wal, cache *recordCache, aead cipher.AEAD) (*Collection, error) {
 	c := &Collection{
-		f:     f,
-		wal:   wal,
-		cache: cache,
+		f:            f,
+		name:         f.Name(),
+		wal:          wal,
+		cache:        cache,
+		countsLoaded: true,
+		aead:         aead,
+		blobHashKey:  blobHashKey(aead),
 	}
 	c.cache.c = c
 
 	// write file header
+	c.fileHeader.Magic = fileMagic
+	c.fileHeader.FormatVersion = formatVersion
+	if aead != nil {
+		c.fileHeader.Flags |= flagEncrypted
+	}
 	c.fileHeader.Head = 0
-	c.fileHeader.LastCommit = int64(8 * 3)
+	c.fileHeader.LastCommit = fileHeaderSize
 	c.f.Seek(0, 0)
-	err = binary.Write(c.f, binary.LittleEndian, c.fileHeader)
+	_, err := c.f.Write(c.fileHeader.bytes())
 	if err != nil {
 		c.f.Close()
 		c.wal.Close()
@@ -680,39 +1465,55 @@ func NewCollection(file string, cacheSize int) (*Collection, error) {
 // cacheSize represents the size of the collection cache.
 // ErrDoesNotExist is returned if file does not exist.
 func OpenCollection(file string, cacheSize int) (*Collection, error) {
+	return openCollection(file, cacheSize, nil)
+}
+
+func openCollection(file string, cacheSize int, aead cipher.AEAD) (*Collection, error) {
 	f, err := os.OpenFile(file, os.O_RDWR, 0666)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, ErrDoesNotExist
 		}
-		return nil, fmt.Errorf("lm2: error opening data file: %v", err)
+		return nil, fmt.Errorf("lm2: error opening data file: %w", err)
+	}
+	err = lockFile(f, false)
+	if err != nil {
+		f.Close()
+		return nil, err
 	}
 
 	wal, err := openWAL(file + ".wal")
 	if err != nil {
 		f.Close()
-		return nil, fmt.Errorf("lm2: error WAL: %v", err)
+		return nil, fmt.Errorf("lm2: error WAL: %w", err)
 	}
 
-	cache, err := openCache(cacheSize, file+".cache")
+	cache, err := openCache(cacheSize, file+".cache", false)
 	if err != nil {
 		f.Close()
 		wal.Close()
 		return nil, err
 	}
 	c := &Collection{
-		f:     f,
-		wal:   wal,
-		cache: cache,
+		f:           f,
+		name:        f.Name(),
+		wal:         wal,
+		cache:       cache,
+		aead:        aead,
+		blobHashKey: blobHashKey(aead),
 	}
 	c.cache.c = c
 
 	// read file header
-	c.f.Seek(0, 0)
-	err = binary.Read(c.f, binary.LittleEndian, &c.fileHeader)
+	err = c.readFileHeader()
 	if err != nil {
 		c.Close()
-		return nil, fmt.Errorf("lm2: error reading file header: %v", err)
+		return nil, err
+	}
+	err = c.checkEncryption()
+	if err != nil {
+		c.Close()
+		return nil, err
 	}
 
 	// Read last WAL entry.
@@ -735,6 +1536,7 @@ func OpenCollection(file string, cacheSize int) (*Collection, error) {
 			}
 		} else {
 			c.wal.Truncate()
+			c.discardedWALEntry = true
 		}
 	}
 
@@ -748,11 +1550,21 @@ func OpenCollection(file string, cacheSize int) (*Collection, error) {
 			}
 			if int64(n) != walRec.Size {
 				c.Close()
-				return nil, errors.New("lm2: incomplete data write")
+				return nil, fmt.Errorf("lm2: incomplete data write: %w", io.ErrShortWrite)
 			}
 		}
 	}
 
+	// The WAL entry may have rewritten the file header.
+	err = c.readFileHeader()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if stat, err := c.f.Stat(); err == nil && stat.Size() > c.LastCommit {
+		c.truncatedBytes = stat.Size() - c.LastCommit
+	}
 	c.f.Truncate(c.LastCommit)
 
 	err = c.sync()
@@ -761,44 +1573,340 @@ func OpenCollection(file string, cacheSize int) (*Collection, error) {
 		return nil, err
 	}
 
+	for c.FormatVersion < formatVersion {
+		upgrade, ok := formatUpgrades[c.FormatVersion]
+		if !ok {
+			c.Close()
+			return nil, ErrIncompatibleVersion
+		}
+		err = upgrade(c)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("lm2: error upgrading from version %d: %w", c.FormatVersion, err)
+		}
+	}
+
+	// Reload cached entries.
+	c.cache.reload()
+
+	return c, nil
+}
+
+// OpenCollectionReadOnly opens a collection with a data file at file
+// without modifying any of its files. Updates return ErrReadOnly.
+// cacheSize represents the size of the collection cache.
+// ErrDoesNotExist is returned if file does not exist.
+//
+// The WAL is not replayed, so the collection reflects the last commit
+// whose file header reached the data file. Changes committed by another
+// process after the collection is opened are not visible.
+func OpenCollectionReadOnly(file string, cacheSize int) (*Collection, error) {
+	return openCollectionReadOnly(file, cacheSize, nil, false)
+}
+
+func openCollectionReadOnly(file string, cacheSize int, aead cipher.AEAD, lock bool) (*Collection, error) {
+	f, err := os.OpenFile(file, os.O_RDONLY, 0666)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrDoesNotExist
+		}
+		return nil, fmt.Errorf("lm2: error opening data file: %w", err)
+	}
+	if lock {
+		err = lockFile(f, true)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	cache, err := openCache(cacheSize, file+".cache", true)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	c := &Collection{
+		f:        f,
+		name:     f.Name(),
+		cache:    cache,
+		readOnly: true,
+		aead:     aead,
+	}
+	c.cache.c = c
+
+	err = c.readFileHeader()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if c.FormatVersion < formatVersion {
+		// Upgrades need to write to the data file.
+		c.Close()
+		return nil, ErrIncompatibleVersion
+	}
+	err = c.checkEncryption()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
 	// Reload cached entries.
 	c.cache.reload()
 
 	return c, nil
 }
 
-func (c *Collection) sync() error {
+func (c *Collection) readFileHeader() error {
+	_, err := c.f.Seek(0, 0)
+	if err != nil {
+		return fmt.Errorf("lm2: error reading file header: %w", err)
+	}
+	buf := [fileHeaderSize]byte{}
+	n, err := io.ReadFull(c.f, buf[:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("lm2: error reading file header: %w", err)
+	}
+	c.fileHeader = decodeFileHeader(buf[:])
+	if n < fileHeaderSize || c.Magic != fileMagic || c.FormatVersion == legacyFormatVersion {
+		// Data files written before the header had a magic number and a
+		// format version start with a shorter header.
+		info, err := c.f.Stat()
+		if err != nil {
+			return fmt.Errorf("lm2: error reading file header: %w", err)
+		}
+		legacy, ok := decodeLegacyFileHeader(buf[:n], info.Size())
+		if !ok {
+			return ErrInvalidFile
+		}
+		c.fileHeader = legacy
+		return nil
+	}
+	if c.FormatVersion > formatVersion {
+		return ErrIncompatibleVersion
+	}
+	if c.LastCommit < fileHeaderSize {
+		return errCorrupt("invalid last commit offset %d", c.LastCommit)
+	}
+	if c.Head != 0 && (c.Head < fileHeaderSize || c.Head >= c.LastCommit) {
+		return errCorrupt("invalid head offset %d", c.Head)
+	}
+	return nil
+}
+
+func (c *Collection) sync() (err error) {
+	if c.readOnly {
+		return nil
+	}
+	done := c.startOperation(context.Background(), OpSync)
+	defer func() {
+		done(err)
+	}()
 	if err := c.wal.f.Sync(); err != nil {
-		return errors.New("lm2: error syncing WAL")
+		return fmt.Errorf("lm2: error syncing WAL: %w", err)
 	}
 	if err := c.f.Sync(); err != nil {
-		return errors.New("lm2: error syncing data file")
+		return fmt.Errorf("lm2: error syncing data file: %w", err)
 	}
 	return nil
 }
 
-// Close closes a collection and all of its resources.
-func (c *Collection) Close() {
-	c.f.Close()
-	c.wal.Close()
-	c.cache.close()
+// Close syncs pending writes and closes a collection and all of its
+// resources. It waits for a background compaction to complete and commits
+// the writes buffered by AsyncWriters first. Operations on a closed
+// collection return ErrClosed.
+func (c *Collection) Close() error {
+	c.stopBackground()
+	c.background.Wait()
+	return c.close()
+}
+
+// close closes the collection once background compaction has stopped.
+func (c *Collection) close() error {
+	flushErr := c.flushAsyncWriters()
+	c.expiryLock.Lock()
+	c.stopExpiry()
+	c.expiryLock.Unlock()
+	c.metaLock.Lock()
+	if c.closed {
+		c.metaLock.Unlock()
+		return ErrClosed
+	}
+	c.closed = true
+	c.stopPeriodicSync()
+	c.stopSubscriptions()
+	var err error
+	if c.syncPolicy != SyncAlways {
+		err = c.sync()
+	}
+	c.metaLock.Unlock()
+	if closeErr := c.f.Close(); err == nil {
+		err = closeErr
+	}
+	if c.wal != nil {
+		if closeErr := c.wal.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := c.cache.close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = flushErr
+	}
+	return err
 }
 
 // Version returns the last committed version.
+//
+// A version is the size of the data file's committed data, so every
+// commit has a greater version than the ones before it, and a version
+// can't overflow before the data file reaches the maximum file size.
+// Compact renumbers versions, so versions from before a compaction
+// must not be used after it.
 func (c *Collection) Version() int64 {
 	c.metaLock.RLock()
 	defer c.metaLock.RUnlock()
 	return c.LastCommit
 }
 
-// Stats returns collection statistics.
+// CommitTime returns the time the commit at version was made.
+// ErrUnknownVersion is returned if version isn't the version of a commit.
+// Commits made before the data file was upgraded to format version 5
+// have no recorded time and return the zero Time.
+func (c *Collection) CommitTime(version int64) (time.Time, error) {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+
+	if c.closed {
+		return time.Time{}, ErrClosed
+	}
+	if version > c.LastCommit {
+		return time.Time{}, ErrUnknownVersion
+	}
+	sentinel, ok := c.commitAt(version)
+	if !ok {
+		return time.Time{}, ErrUnknownVersion
+	}
+	if sentinel.Magic != timedSentinelMagic {
+		return time.Time{}, nil
+	}
+	return time.Unix(0, sentinel.Timestamp), nil
+}
+
+// Stats returns collection statistics. The first call walks
+// the record chain to count records.
 func (c *Collection) Stats() Stats {
-	return c.stats.clone()
+	stats := c.stats.clone()
+
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+
+	if err := c.loadCounts(); err == nil {
+		stats.LiveRecords = c.liveRecords
+		stats.DeletedRecords = c.deletedRecords
+	}
+	if info, err := c.f.Stat(); err == nil {
+		stats.FileSize = info.Size()
+	}
+	stats.Version = c.LastCommit
+	stats.OpenCursors = c.openCursors()
+	return stats
+}
+
+// Len returns the number of live records in the latest version of
+// the collection. Records that have expired are counted until they are
+// deleted or removed by Compact. Records of reserved keys aren't counted.
+func (c *Collection) Len() (int, error) {
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+
+	if c.closed {
+		return 0, ErrClosed
+	}
+	if err := c.loadCounts(); err != nil {
+		return 0, err
+	}
+	reserved, err := c.countReserved()
+	if err != nil {
+		return 0, err
+	}
+	return int(c.liveRecords) - reserved, nil
+}
+
+// EstimateSize returns an estimate of the number of bytes used by the
+// live records with keys greater than or equal to start and less than
+// end. An empty end means there is no upper bound. The estimate is
+// extrapolated from the records in the record cache, so it gets better
+// with larger cache sizes.
+func (c *Collection) EstimateSize(start, end string) (int64, error) {
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+
+	if c.closed {
+		return 0, ErrClosed
+	}
+	if err := c.loadCounts(); err != nil {
+		return 0, err
+	}
+
+	sampled, inRange := 0, int64(0)
+	c.cache.lock.RLock()
+	for _, rec := range c.cache.sorted {
+		rec.lock.RLock()
+		if rec.Deleted == 0 {
+			sampled++
+			if rec.Key >= start && (end == "" || rec.Key < end) {
+				inRange += recordHeaderSize + int64(rec.KeyLen) + int64(rec.ValLen)
+			}
+		}
+		rec.lock.RUnlock()
+	}
+	c.cache.lock.RUnlock()
+
+	if sampled == 0 {
+		return 0, nil
+	}
+	return inRange * int64(c.liveRecords) / int64(sampled), nil
+}
+
+// loadCounts counts live and deleted records if they haven't been
+// counted yet. The caller must hold metaLock exclusively.
+func (c *Collection) loadCounts() error {
+	if c.countsLoaded {
+		return nil
+	}
+	live, deleted := uint64(0), uint64(0)
+	var prev *record
+	for offset := c.Head; offset != 0; {
+		rec, err := c.readRecordAfter(prev, offset)
+		if err != nil {
+			return err
+		}
+		prev = rec
+		rec.lock.RLock()
+		if rec.Deleted == 0 {
+			live++
+		} else {
+			deleted++
+		}
+		offset = rec.Next
+		rec.lock.RUnlock()
+	}
+	c.liveRecords, c.deletedRecords = live, deleted
+	c.countsLoaded = true
+	return nil
 }
 
 // Destroy closes the collection and removes its associated data files.
+// ErrReadOnly is returned for read-only collections.
 func (c *Collection) Destroy() error {
 	c.Close()
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	if c.memory {
+		return nil
+	}
 	var err error
 	err = os.Remove(c.f.Name())
 	if err != nil {
@@ -812,5 +1920,9 @@ func (c *Collection) Destroy() error {
 	if err != nil {
 		return err
 	}
+	err = os.Remove(c.checkpointsFile())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return nil
 }
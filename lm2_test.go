@@ -1,8 +1,20 @@
 package lm2
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"math/rand"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -549,3 +561,4653 @@ func TestOverwriteFirstKey(t *testing.T) {
 		t.Fatalf("expected cursor key to be 'b', got %v", cur.Key())
 	}
 }
+
+func TestGetSetDelete(t *testing.T) {
+	c, err := NewCollection("/tmp/test_getsetdelete.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	if _, err = c.Get("a"); err != ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	if err = c.Set("b", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set("a", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	val, err := c.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "2" {
+		t.Errorf("expected value %v, got %v", "2", val)
+	}
+
+	// Deleting a missing key shouldn't affect its predecessor.
+	if err = c.Delete("aa"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Get("a"); err != ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+	val, err = c.Get("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "1" {
+		t.Errorf("expected value %v, got %v", "1", val)
+	}
+}
+
+func TestCursorSkipsDeletedHead(t *testing.T) {
+	c, err := NewCollection("/tmp/test_cursorskipsdeletedhead.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	wb.Set("b", "1")
+	wb.Set("c", "1")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wb = NewWriteBatch()
+	wb.Delete("a")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cur, err := c.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cur.Next() {
+		t.Fatal("expected Next() to return true")
+	}
+	if cur.Key() != "b" {
+		t.Fatalf("expected cursor key to be 'b', got %v", cur.Key())
+	}
+
+	cur.Seek("a")
+	if !cur.Next() {
+		t.Fatal("expected Next() to return true")
+	}
+	if cur.Key() != "b" {
+		t.Fatalf("expected cursor key to be 'b', got %v", cur.Key())
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	c, err := NewCollection("/tmp/test_snapshot.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	if err = c.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set("b", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	snap := c.Snapshot()
+
+	if err = c.Set("a", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set("c", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	val, err := snap.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "1" {
+		t.Errorf("expected value %v, got %v", "1", val)
+	}
+	if _, err = snap.Get("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = snap.Get("c"); err != ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	cur, err := snap.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for cur.Next() {
+		count++
+	}
+	if count != 2 {
+		t.Errorf("expected %d records in snapshot, got %d", 2, count)
+	}
+}
+
+func TestOpenInvalidHeader(t *testing.T) {
+	c, err := NewCollection("/tmp/test_openinvalidheader.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	c.Close()
+
+	f, err := os.OpenFile("/tmp/test_openinvalidheader.lm2", os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Bump the format version.
+	if _, err = f.WriteAt([]byte{formatVersion + 1, 0, 0, 0}, 4); err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenCollection("/tmp/test_openinvalidheader.lm2", 100)
+	if err != ErrIncompatibleVersion {
+		t.Errorf("expected ErrIncompatibleVersion, got %v", err)
+	}
+
+	// Clobber the magic.
+	if _, err = f.WriteAt([]byte{0, 0, 0, 0}, 0); err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenCollection("/tmp/test_openinvalidheader.lm2", 100)
+	if err != ErrInvalidFile {
+		t.Errorf("expected ErrInvalidFile, got %v", err)
+	}
+
+	// Too small to hold a header.
+	if err = f.Truncate(fileHeaderSize - 1); err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenCollection("/tmp/test_openinvalidheader.lm2", 100)
+	if err != ErrInvalidFile {
+		t.Errorf("expected ErrInvalidFile for a short file, got %v", err)
+	}
+}
+
+func TestOpenReplaysFileHeader(t *testing.T) {
+	c, err := NewCollection("/tmp/test_openreplaysfileheader.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	staleHeader := c.fileHeader.bytes()
+	if err = c.Set("b", "1"); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// Simulate a crash after the WAL append but before
+	// the file header was updated.
+	f, err := os.OpenFile("/tmp/test_openreplaysfileheader.lm2", os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt(staleHeader, 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	c, err = OpenCollection("/tmp/test_openreplaysfileheader.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	if _, err = c.Get("b"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	c, err := NewCollection("/tmp/test_verify.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	wb.Set("b", "1")
+	wb.Set("c", "1")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := c.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("unexpected problems: %v", report.Problems)
+	}
+	if report.Records != 3 {
+		t.Errorf("expected %d records, got %d", 3, report.Records)
+	}
+
+	// Point the head's next pointer past the end of the file.
+	head, err := c.readRecord(c.Head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head.Next = c.LastCommit + 100
+
+	report, err = c.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() {
+		t.Fatal("expected problems to be reported")
+	}
+	if report.Problems[0].Offset != head.Offset {
+		t.Errorf("expected problem at offset %d, got %v", head.Offset, report.Problems[0])
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	c, err := NewCollection("/tmp/test_openreadonly.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	if err = c.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := ioutil.ReadFile("/tmp/test_openreadonly.lm2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ro, err := OpenCollectionReadOnly("/tmp/test_openreadonly.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := ro.Get("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "2" {
+		t.Errorf("expected value %v, got %v", "2", val)
+	}
+	if err = ro.Set("c", "3"); err != ErrReadOnly {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+	if err = ro.Destroy(); err != ErrReadOnly {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+
+	after, err := ioutil.ReadFile("/tmp/test_openreadonly.lm2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("data file was modified by a read-only collection")
+	}
+}
+
+func TestSyncPolicy(t *testing.T) {
+	c, err := NewCollection("/tmp/test_syncpolicy.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetSyncPolicy(SyncNever, 0)
+	if err = c.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetSyncPolicy(SyncPeriodic, time.Millisecond)
+	if err = c.Set("b", "1"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	c.Close()
+
+	c, err = OpenCollection("/tmp/test_syncpolicy.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	for _, key := range []string{"a", "b"} {
+		if _, err = c.Get(key); err != nil {
+			t.Errorf("error getting %v: %v", key, err)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	c, err := NewCollection("/tmp/test_compact.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	const N = 100
+	for i := 0; i < N; i++ {
+		wb := NewWriteBatch()
+		wb.Set(fmt.Sprintf("%03d", i), "1")
+		wb.Set(fmt.Sprintf("%03d", i/2), "2")
+		if _, err = c.Update(wb); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < N; i += 10 {
+		if err = c.Delete(fmt.Sprintf("%03d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before, err := os.Stat("/tmp/test_compact.lm2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := os.Stat("/tmp/test_compact.lm2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() >= before.Size() {
+		t.Errorf("expected file to shrink, got %d bytes before and %d after",
+			before.Size(), after.Size())
+	}
+
+	if count := verifyOrder(t, c); count != N-N/10 {
+		t.Errorf("expected %d records, got %d", N-N/10, count)
+	}
+	val, err := c.Get("049")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "2" {
+		t.Errorf("expected value %v, got %v", "2", val)
+	}
+	if _, err = c.Get("050"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	// The collection should still be writable and reopenable.
+	if err = c.Set("050", "3"); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	c, err = OpenCollection("/tmp/test_compact.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := verifyOrder(t, c); count != N-N/10+1 {
+		t.Errorf("expected %d records, got %d", N-N/10+1, count)
+	}
+}
+
+func TestAutoCompact(t *testing.T) {
+	c, err := NewCollection("/tmp/test_autocompact.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	c.SetAutoCompact(10)
+	for i := 0; i < 20; i++ {
+		if err = c.Set("a", fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.background.Wait()
+
+	val, err := c.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "19" {
+		t.Errorf("expected value %v, got %v", "19", val)
+	}
+	if c.garbage >= 10 {
+		t.Errorf("expected garbage to be reclaimed, got %d", c.garbage)
+	}
+}
+
+func TestCacheFindLastLessThan(t *testing.T) {
+	rc := &recordCache{
+		cache: map[int64]*record{},
+		size:  100,
+	}
+	for i, key := range []string{"d", "b", "f", "b", "a"} {
+		rc.forcePush(&record{Offset: int64(i + 1), Key: key})
+	}
+
+	tests := []struct {
+		key    string
+		offset int64
+	}{
+		{"a", 0},
+		{"b", 5},
+		{"c", 4},
+		{"e", 1},
+		{"z", 3},
+	}
+	for _, test := range tests {
+		if offset := rc.findLastLessThan(test.key); offset != test.offset {
+			t.Errorf("expected offset %d for %v, got %d", test.offset, test.key, offset)
+		}
+	}
+
+	rc.remove(rc.cache[4])
+	if offset := rc.findLastLessThan("c"); offset != 2 {
+		t.Errorf("expected offset %d for %v, got %d", 2, "c", offset)
+	}
+}
+
+func TestRange(t *testing.T) {
+	c, err := NewCollection("/tmp/test_range.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		wb.Set(key, "1")
+	}
+	if _, err = c.Update(wb); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		start, end string
+		expected   []string
+	}{
+		{"a", "d", []string{"a", "c"}},
+		{"b", "e", []string{"c", "d"}},
+		{"bb", "", []string{"c", "d", "e"}},
+		{"", "b", []string{"a"}},
+		{"f", "", nil},
+		{"c", "c", nil},
+	}
+	for _, test := range tests {
+		cur, err := c.Range(test.start, test.end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for cur.Next() {
+			keys = append(keys, cur.Key())
+		}
+		if fmt.Sprint(keys) != fmt.Sprint(test.expected) {
+			t.Errorf("range [%q, %q): expected %v, got %v", test.start, test.end, test.expected, keys)
+		}
+	}
+}
+
+func TestSeekPrefix(t *testing.T) {
+	c, err := NewCollection("/tmp/test_seekprefix.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for _, key := range []string{"user:1", "user:1:name", "user:2", "user\xff", "users", "\xff\xff"} {
+		wb.Set(key, "1")
+	}
+	if _, err = c.Update(wb); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		prefix   string
+		expected []string
+	}{
+		{"user:1", []string{"user:1", "user:1:name"}},
+		{"user:", []string{"user:1", "user:1:name", "user:2"}},
+		{"user\xff", []string{"user\xff"}},
+		{"\xff", []string{"\xff\xff"}},
+		{"group:", nil},
+	}
+	for _, test := range tests {
+		cur, err := c.NewCursor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cur.SeekPrefix(test.prefix)
+		var keys []string
+		for cur.Next() {
+			keys = append(keys, cur.Key())
+		}
+		if fmt.Sprintf("%q", keys) != fmt.Sprintf("%q", test.expected) {
+			t.Errorf("prefix %q: expected %q, got %q", test.prefix, test.expected, keys)
+		}
+	}
+}
+
+func TestBinaryKeysAndValues(t *testing.T) {
+	c, err := NewCollection("/tmp/test_binarykeysandvalues.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pairs := [][2]string{
+		{"", "empty key"},
+		{"\x00", "\x00\x00\x00"},
+		{"\x00\x01", ""},
+		{"a\x00b", "\xff\xfe\x00"},
+		{"\xff", "\x00value\x00"},
+	}
+	wb := NewWriteBatch()
+	for _, pair := range pairs {
+		wb.Set(pair[0], pair[1])
+	}
+	if _, err = c.Update(wb); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	c, err = OpenCollection("/tmp/test_binarykeysandvalues.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	cur, err := c.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := 0
+	for cur.Next() {
+		if i == len(pairs) {
+			t.Fatalf("unexpected key %q", cur.Key())
+		}
+		if cur.Key() != pairs[i][0] || cur.Value() != pairs[i][1] {
+			t.Errorf("expected %q => %q, got %q => %q",
+				pairs[i][0], pairs[i][1], cur.Key(), cur.Value())
+		}
+		i++
+	}
+	if i != len(pairs) {
+		t.Errorf("expected %d records, got %d", len(pairs), i)
+	}
+}
+
+func TestStatsRecordCounts(t *testing.T) {
+	c, err := NewCollection("/tmp/test_statsrecordcounts.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkCounts := func(live, deleted uint64) {
+		stats := c.Stats()
+		if stats.LiveRecords != live || stats.DeletedRecords != deleted {
+			t.Errorf("expected %d live and %d deleted records, got %d and %d",
+				live, deleted, stats.LiveRecords, stats.DeletedRecords)
+		}
+		if stats.Version != c.Version() {
+			t.Errorf("expected version %d, got %d", c.Version(), stats.Version)
+		}
+		if stats.FileSize != c.Version() {
+			t.Errorf("expected file size %d, got %d", c.Version(), stats.FileSize)
+		}
+	}
+
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	wb.Set("b", "1")
+	wb.Set("c", "1")
+	if _, err = c.Update(wb); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(3, 0)
+
+	if err = c.Set("a", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Delete("missing"); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(2, 2)
+
+	// Counts are recomputed after reopening.
+	c.Close()
+	c, err = OpenCollection("/tmp/test_statsrecordcounts.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	checkCounts(2, 2)
+
+	if err = c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(2, 0)
+}
+
+type testMetrics struct {
+	sync.Mutex
+	ops     map[Operation]int
+	sets    int
+	deletes int
+}
+
+func (m *testMetrics) ObserveOperation(op Operation, d time.Duration, err error) {
+	m.Lock()
+	defer m.Unlock()
+	m.ops[op]++
+}
+
+func (m *testMetrics) ObserveRecords(sets, deletes int) {
+	m.Lock()
+	defer m.Unlock()
+	m.sets += sets
+	m.deletes += deletes
+}
+
+func TestMetrics(t *testing.T) {
+	c, err := NewCollection("/tmp/test_metrics.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	m := &testMetrics{ops: map[Operation]int{}}
+	c.SetMetrics(m)
+
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	wb.Set("b", "1")
+	if _, err = c.Update(wb); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	c.Get("a")
+	c.Get("b")
+	if err = c.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[Operation]int{
+		OpUpdate:  2,
+		OpGet:     2,
+		OpCompact: 1,
+	}
+	for op, count := range expected {
+		if m.ops[op] != count {
+			t.Errorf("expected %d %v operations, got %d", count, op, m.ops[op])
+		}
+	}
+	if m.ops[OpSync] == 0 {
+		t.Error("expected sync operations to be observed")
+	}
+	if m.sets != 2 || m.deletes != 1 {
+		t.Errorf("expected 2 sets and 1 delete, got %d and %d", m.sets, m.deletes)
+	}
+}
+
+func TestWalkRecords(t *testing.T) {
+	c, err := NewCollection("/tmp/test_walkrecords.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	if err = c.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set("a", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set("b", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	var records []RecordInfo
+	err = c.WalkRecords(func(rec RecordInfo) bool {
+		records = append(records, rec)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected %d records, got %d", 3, len(records))
+	}
+	if records[0].Key != "a" || records[0].Value != "1" || records[0].Deleted == 0 {
+		t.Errorf("expected overwritten record a => 1, got %+v", records[0])
+	}
+	if records[1].Key != "a" || records[1].Value != "2" || records[1].Deleted != 0 {
+		t.Errorf("expected live record a => 2, got %+v", records[1])
+	}
+	if records[0].Next != records[1].Offset || records[1].Next != records[2].Offset {
+		t.Errorf("unexpected record chain: %+v", records)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	c, err := NewCollection("/tmp/test_backup.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	const N = 100
+	for i := 0; i < N; i++ {
+		if err = c.Set(fmt.Sprintf("%03d", i), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = c.Delete("050"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set("000", "updated"); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	version, err := c.Backup(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != c.Version() {
+		t.Errorf("expected backup version %d, got %d", c.Version(), version)
+	}
+
+	// Changes after the backup aren't included.
+	if err = c.Set("001", "updated"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = Restore(buf, "/tmp/test_backup_restored.lm2"); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := OpenCollection("/tmp/test_backup_restored.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Destroy()
+
+	if count := verifyOrder(t, restored); count != N-1 {
+		t.Errorf("expected %d records, got %d", N-1, count)
+	}
+	for key, expected := range map[string]string{"000": "updated", "001": "1", "099": "99"} {
+		val, err := restored.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != expected {
+			t.Errorf("expected %v => %v, got %v", key, expected, val)
+		}
+	}
+	if _, err = restored.Get("050"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	// The restored collection is writable.
+	if err = restored.Set("100", "100"); err != nil {
+		t.Fatal(err)
+	}
+	report, err := restored.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("unexpected problems: %v", report.Problems)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	c, err := NewCollection("/tmp/test_export.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	wb.Set("b", "with,comma")
+	wb.Set("c", "with \"quotes\"\nand newline")
+	if _, err = c.Update(wb); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []Format{JSONLines, CSV} {
+		buf := bytes.NewBuffer(nil)
+		if err = c.Export(buf, format); err != nil {
+			t.Fatal(err)
+		}
+
+		c2, err := NewCollection("/tmp/test_import.lm2", 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = c2.Import(buf, format); err != nil {
+			t.Fatal(err)
+		}
+
+		cur1, err := c.NewCursor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cur2, err := c2.NewCursor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for cur1.Next() {
+			if !cur2.Next() {
+				t.Fatalf("format %v: missing key %q", format, cur1.Key())
+			}
+			if cur1.Key() != cur2.Key() || cur1.Value() != cur2.Value() {
+				t.Errorf("format %v: expected %q => %q, got %q => %q",
+					format, cur1.Key(), cur1.Value(), cur2.Key(), cur2.Value())
+			}
+		}
+		if cur2.Next() {
+			t.Errorf("format %v: unexpected key %q", format, cur2.Key())
+		}
+		c2.Destroy()
+	}
+
+	if err = c.Set("d", "\xff"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Export(ioutil.Discard, JSONLines); err == nil {
+		t.Error("expected an error exporting invalid UTF-8 as JSON")
+	}
+}
+
+func TestSetAfterDelete(t *testing.T) {
+	c, err := NewCollection("/tmp/test_setafterdelete.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	if err = c.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	snap := c.Snapshot()
+	if err = c.Set("a", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = snap.Get("a"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+	stats := c.Stats()
+	if stats.LiveRecords != 1 || stats.DeletedRecords != 1 {
+		t.Errorf("expected 1 live and 1 deleted record, got %d and %d",
+			stats.LiveRecords, stats.DeletedRecords)
+	}
+}
+
+func TestSetWithTTL(t *testing.T) {
+	c, err := NewCollection("/tmp/test_setwithttl.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	wb.SetWithTTL("a", "1", 100*time.Millisecond)
+	wb.SetWithTTL("b", "1", time.Hour)
+	wb.Set("c", "1")
+	if _, err = c.Update(wb); err != nil {
+		t.Fatal(err)
+	}
+
+	// A snapshot cursor created before expiration still sees the record.
+	cur, err := c.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if !cur.Next() || cur.Key() != "a" {
+		t.Fatalf("expected cursor key to be 'a', got %v", cur.Key())
+	}
+	cur.Close()
+
+	if _, err = c.Get("a"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+	if _, err = c.Get("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	err = c.WalkRecords(func(rec RecordInfo) bool {
+		keys = append(keys, rec.Key)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(keys) != "[b c]" {
+		t.Errorf("expected [b c] after compaction, got %v", keys)
+	}
+
+	// Expiration times survive compaction.
+	head, err := c.readRecord(c.Head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Expires == 0 {
+		t.Error("expected b to keep its expiration time")
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	c, err := NewCollection("/tmp/test_buckets.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	a := c.Bucket("a")
+	ab := c.Bucket("ab")
+
+	if err = c.Set("x", "root"); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Set("bx", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Set("by", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err = ab.Set("x", "ab"); err != nil {
+		t.Fatal(err)
+	}
+
+	val, err := ab.Get("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "ab" {
+		t.Errorf("expected value %v, got %v", "ab", val)
+	}
+	if _, err = a.Get("x"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	tests := []struct {
+		bucket   *Bucket
+		expected []string
+	}{
+		{a, []string{"bx", "by"}},
+		{ab, []string{"x"}},
+		{c.Bucket("empty"), nil},
+	}
+	for _, test := range tests {
+		cur, err := test.bucket.NewCursor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for cur.Next() {
+			keys = append(keys, cur.Key())
+		}
+		if fmt.Sprint(keys) != fmt.Sprint(test.expected) {
+			t.Errorf("expected %v, got %v", test.expected, keys)
+		}
+
+		// Seeking before the first key stays inside the bucket.
+		cur.Seek("")
+		keys = nil
+		for cur.Next() {
+			keys = append(keys, cur.Key())
+		}
+		if fmt.Sprint(keys) != fmt.Sprint(test.expected) {
+			t.Errorf("expected %v after Seek, got %v", test.expected, keys)
+		}
+	}
+
+	cur, err := a.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur.Seek("bz")
+	if !cur.Next() || cur.Key() != "by" {
+		t.Errorf("expected cursor key to be 'by', got %v", cur.Key())
+	}
+}
+
+func TestTx(t *testing.T) {
+	c, err := NewCollection("/tmp/test_tx.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	if err = c.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := c.Begin()
+	tx.Set("b", "2")
+	tx.Delete("a")
+	if _, err = tx.Get("a"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound in tx, got %v", err)
+	}
+	val, err := tx.Get("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "2" {
+		t.Errorf("expected value %v in tx, got %v", "2", val)
+	}
+
+	// Uncommitted writes are invisible to other readers.
+	if _, err = c.Get("b"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound before commit, got %v", err)
+	}
+	if _, err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Get("a"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound after commit, got %v", err)
+	}
+	if val, err = c.Get("b"); err != nil || val != "2" {
+		t.Errorf("expected value %v after commit, got %v, %v", "2", val, err)
+	}
+	if err = tx.Set("c", "3"); err != ErrTxDone {
+		t.Errorf("expected ErrTxDone, got %v", err)
+	}
+
+	// Rolled back writes are discarded.
+	tx = c.Begin()
+	tx.Set("c", "3")
+	tx.Rollback()
+	if _, err = tx.Commit(); err != ErrTxDone {
+		t.Errorf("expected ErrTxDone, got %v", err)
+	}
+	if _, err = c.Get("c"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound after rollback, got %v", err)
+	}
+
+	// A key read by the transaction was modified concurrently.
+	tx = c.Begin()
+	if _, err = tx.Get("b"); err != nil {
+		t.Fatal(err)
+	}
+	tx.Set("c", "3")
+	if err = c.Set("b", "4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tx.Commit(); err != ErrTxConflict {
+		t.Errorf("expected ErrTxConflict, got %v", err)
+	}
+	if _, err = c.Get("c"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound after conflict, got %v", err)
+	}
+
+	// A deleted key conflicts too.
+	tx = c.Begin()
+	tx.Set("b", "5")
+	if err = c.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tx.Commit(); err != ErrTxConflict {
+		t.Errorf("expected ErrTxConflict after delete, got %v", err)
+	}
+
+	// Updates to unrelated keys don't conflict.
+	tx = c.Begin()
+	tx.Get("d")
+	tx.Set("e", "6")
+	if err = c.Set("f", "7"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if val, err = c.Get("e"); err != nil || val != "6" {
+		t.Errorf("expected value %v, got %v, %v", "6", val, err)
+	}
+}
+
+func TestContext(t *testing.T) {
+	c, err := NewCollection("/tmp/test_context.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 10; i++ {
+		wb.Set(fmt.Sprint(i), "value")
+	}
+	if _, err = c.Update(wb); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Delete("5"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err = c.SetContext(ctx, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	val, err := c.GetContext(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "1" {
+		t.Errorf("expected value %v, got %v", "1", val)
+	}
+
+	cur, err := c.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := cur.NextContext(ctx); !ok || err != nil {
+		t.Fatalf("expected a record, got %v, %v", ok, err)
+	}
+	cancel()
+	if ok, err := cur.NextContext(ctx); ok || err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v, %v", ok, err)
+	}
+	if cur.Valid() {
+		t.Error("expected cursor to be invalid after cancellation")
+	}
+
+	if err = c.SetContext(ctx, "b", "2"); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if _, err = c.Get("b"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+	if _, err = c.GetContext(ctx, "a"); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	version := c.Version()
+	if err = c.CompactContext(ctx); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if c.Version() != version {
+		t.Errorf("expected version %d after cancelled compaction, got %d", version, c.Version())
+	}
+	if _, err = os.Stat("/tmp/test_context.lm2.compact"); !os.IsNotExist(err) {
+		t.Errorf("expected compaction file to be removed, got %v", err)
+	}
+	if val, err = c.Get("a"); err != nil || val != "1" {
+		t.Errorf("expected value %v, got %v, %v", "1", val, err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	c, err := NewCollection("/tmp/test_compression.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	value := strings.Repeat(`{"name":"value"}`, 100)
+	if err = c.Set("a", value); err != nil {
+		t.Fatal(err)
+	}
+	uncompressedSize := c.Stats().FileSize
+
+	if err = c.SetCompression(FlateCompression); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set("b", value); err != nil {
+		t.Fatal(err)
+	}
+	// Too short to compress.
+	if err = c.Set("c", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if growth := c.Stats().FileSize - uncompressedSize; growth >= int64(len(value)) {
+		t.Errorf("expected compressed record to be smaller than %d bytes, file grew %d bytes",
+			len(value), growth)
+	}
+
+	c.Close()
+	c, err = OpenCollection("/tmp/test_compression.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(c *Collection) {
+		for key, expected := range map[string]string{"a": value, "b": value, "c": "x"} {
+			val, err := c.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if val != expected {
+				t.Errorf("unexpected value for key %v: %q", key, val)
+			}
+		}
+	}
+	check(c)
+
+	buf := bytes.NewBuffer(nil)
+	if _, err = c.Backup(buf); err != nil {
+		t.Fatal(err)
+	}
+	if err = Restore(buf, "/tmp/test_compression_restore.lm2"); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := OpenCollection("/tmp/test_compression_restore.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Destroy()
+	check(restored)
+
+	c.SetCompression(FlateCompression)
+	if err = c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check(c)
+	if size := c.Stats().FileSize; size >= int64(len(value)) {
+		t.Errorf("expected compacted file to be smaller than %d bytes, got %d", len(value), size)
+	}
+
+	if err = c.SetCompression(Compression(100)); err == nil {
+		t.Error("expected an error for an unknown compression")
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	c, err := NewEncryptedCollection("/tmp/test_encryption.lm2", 100, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	c.SetCompression(FlateCompression)
+	value := strings.Repeat("secret value ", 10)
+	if err = c.Set("a", value); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set("b", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	data, err := ioutil.ReadFile("/tmp/test_encryption.lm2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Error("expected values to be encrypted in the data file")
+	}
+
+	if _, err = OpenCollection("/tmp/test_encryption.lm2", 100); err != ErrEncrypted {
+		t.Errorf("expected ErrEncrypted, got %v", err)
+	}
+	if _, err = OpenCollectionReadOnly("/tmp/test_encryption.lm2", 100); err != ErrEncrypted {
+		t.Errorf("expected ErrEncrypted, got %v", err)
+	}
+	wrongKey := []byte("fedcba9876543210fedcba9876543210")
+	if _, err = OpenEncryptedCollection("/tmp/test_encryption.lm2", 100, wrongKey); err != ErrDecryptionFailed {
+		t.Errorf("expected ErrDecryptionFailed, got %v", err)
+	}
+
+	c, err = OpenEncryptedCollection("/tmp/test_encryption.lm2", 100, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(c *Collection) {
+		for k, expected := range map[string]string{"a": value, "b": "secret"} {
+			val, err := c.Get(k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if val != expected {
+				t.Errorf("unexpected value for key %v: %q", k, val)
+			}
+		}
+	}
+	check(c)
+
+	if err = c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check(c)
+
+	buf := bytes.NewBuffer(nil)
+	if _, err = c.Backup(buf); err != nil {
+		t.Fatal(err)
+	}
+	if err = Restore(buf, "/tmp/test_encryption_restore.lm2"); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := OpenEncryptedCollection("/tmp/test_encryption_restore.lm2", 100, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Destroy()
+	check(restored)
+
+	plain, err := NewCollection("/tmp/test_encryption_plain.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Destroy()
+	plain.Close()
+	if _, err = OpenEncryptedCollection("/tmp/test_encryption_plain.lm2", 100, key); err != ErrNotEncrypted {
+		t.Errorf("expected ErrNotEncrypted, got %v", err)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	c, err := NewCollection("/tmp/test_bloom_filter.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	if err = c.Set("before", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.SetBloomFilter(0.01); err != nil {
+		t.Fatal(err)
+	}
+
+	// Enough keys to grow the filter.
+	for i := 0; i < 3; i++ {
+		wb := NewWriteBatch()
+		for j := 0; j < 1000; j++ {
+			wb.Set(fmt.Sprintf("key-%d-%d", i, j), "value")
+		}
+		if _, err = c.Update(wb); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(c.bloom.layers) < 2 {
+		t.Errorf("expected bloom filter to grow, got %d layers", len(c.bloom.layers))
+	}
+
+	snap := c.Snapshot()
+	if err = c.Delete("before"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = snap.Get("before"); err != nil {
+		t.Errorf("expected key in snapshot, got %v", err)
+	}
+	if _, err = c.Get("before"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 1000; j += 100 {
+			if _, err = c.Get(fmt.Sprintf("key-%d-%d", i, j)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		if c.bloom.mayContain(fmt.Sprintf("missing-%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 50 {
+		t.Errorf("expected about 1%% false positives, got %d of 1000", falsePositives)
+	}
+
+	if err = c.SetBloomFilter(0); err != nil {
+		t.Fatal(err)
+	}
+	if c.bloom != nil {
+		t.Error("expected bloom filter to be disabled")
+	}
+	if err = c.SetBloomFilter(1); err == nil {
+		t.Error("expected an error for a false positive rate of 1")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	c, err := NewCollection("/tmp/test_merge.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	if err = c.Merge("counter", "1"); err == nil {
+		t.Error("expected an error without a merge function")
+	}
+
+	c.SetMergeFunc(func(key, existing string, found bool, operands []string) (string, error) {
+		n := 0
+		if found {
+			fmt.Sscan(existing, &n)
+		}
+		for _, operand := range operands {
+			delta := 0
+			if _, err := fmt.Sscan(operand, &delta); err != nil {
+				return "", err
+			}
+			n += delta
+		}
+		return fmt.Sprint(n), nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if err := c.Merge("counter", "1"); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	val, err := c.Get("counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "100" {
+		t.Errorf("expected value %v, got %v", "100", val)
+	}
+
+	wb := NewWriteBatch()
+	wb.Set("counter", "5")
+	wb.Merge("counter", "2")
+	wb.Merge("counter", "3")
+	wb.Merge("deleted", "1")
+	wb.Delete("deleted")
+	if _, err = c.Update(wb); err != nil {
+		t.Fatal(err)
+	}
+	if val, err = c.Get("counter"); err != nil || val != "10" {
+		t.Errorf("expected value %v, got %v, %v", "10", val, err)
+	}
+	if _, err = c.Get("deleted"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	if err = c.Merge("counter", "not a number"); err == nil {
+		t.Error("expected an error from the merge function")
+	}
+	if val, err = c.Get("counter"); err != nil || val != "10" {
+		t.Errorf("expected value %v after failed merge, got %v, %v", "10", val, err)
+	}
+
+	// Merges keep the metadata of the value they merge into.
+	if err = c.SetWithMeta("counter", "1", map[string]string{"unit": "hits"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Merge("counter", "1"); err != nil {
+		t.Fatal(err)
+	}
+	val, meta, err := c.GetWithMeta("counter")
+	if err != nil || val != "2" || meta["unit"] != "hits" {
+		t.Errorf("expected value %v with metadata, got %v, %v, %v", "2", val, meta, err)
+	}
+}
+
+func TestCorruptErrors(t *testing.T) {
+	c, err := NewCollection("/tmp/test_corrupt_errors.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	if err = c.Set("a", strings.Repeat("a", 100)); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// Cut the record short.
+	if err = os.Truncate("/tmp/test_corrupt_errors.lm2", fileHeaderSize+recordHeaderSize+10); err != nil {
+		t.Fatal(err)
+	}
+	ro, err := OpenCollectionReadOnly("/tmp/test_corrupt_errors.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ro.Get("a")
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt, got %v", err)
+	}
+	ro.Close()
+
+	c, err = OpenCollection("/tmp/test_corrupt_errors.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.SetCompression(Compression(100)); !errors.Is(err, ErrUnknownCompression) {
+		t.Errorf("expected ErrUnknownCompression, got %v", err)
+	}
+}
+
+func TestClosed(t *testing.T) {
+	c, err := NewCollection("/tmp/test_closed.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	c.SetSyncPolicy(SyncNever, 0)
+	if err = c.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Close(); err != ErrClosed {
+		t.Errorf("expected ErrClosed from Close, got %v", err)
+	}
+	if err = c.Set("b", "2"); err != ErrClosed {
+		t.Errorf("expected ErrClosed from Set, got %v", err)
+	}
+	if _, err = c.Get("a"); err != ErrClosed {
+		t.Errorf("expected ErrClosed from Get, got %v", err)
+	}
+	if _, err = c.NewCursor(); err != ErrClosed {
+		t.Errorf("expected ErrClosed from NewCursor, got %v", err)
+	}
+	if err = c.Compact(); err != ErrClosed {
+		t.Errorf("expected ErrClosed from Compact, got %v", err)
+	}
+	if err = c.Sync(); err != ErrClosed {
+		t.Errorf("expected ErrClosed from Sync, got %v", err)
+	}
+	if _, err = c.Verify(); err != ErrClosed {
+		t.Errorf("expected ErrClosed from Verify, got %v", err)
+	}
+
+	// Pending writes were synced by Close.
+	c, err = OpenCollection("/tmp/test_closed.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := c.Get("a"); err != nil || val != "1" {
+		t.Errorf("expected value %v, got %v, %v", "1", val, err)
+	}
+}
+
+func TestOpenOptions(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	c, err := Open("/tmp/test_open_options.lm2",
+		WithCacheSize(10),
+		WithSyncPolicy(SyncNever, 0),
+		WithCompression(FlateCompression),
+		WithEncryptionKey(key),
+		WithBloomFilter(0.01),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	if c.cache.size != 10 {
+		t.Errorf("expected cache size %d, got %d", 10, c.cache.size)
+	}
+	if c.syncPolicy != SyncNever {
+		t.Errorf("expected sync policy %v, got %v", SyncNever, c.syncPolicy)
+	}
+	if c.compression != FlateCompression {
+		t.Errorf("expected compression %v, got %v", FlateCompression, c.compression)
+	}
+	if c.bloom == nil {
+		t.Error("expected a bloom filter")
+	}
+	if err = c.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	if _, err = Open("/tmp/test_open_options.lm2"); err != ErrEncrypted {
+		t.Errorf("expected ErrEncrypted, got %v", err)
+	}
+
+	ro, err := Open("/tmp/test_open_options.lm2", WithReadOnly(), WithEncryptionKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := ro.Get("a"); err != nil || val != "1" {
+		t.Errorf("expected value %v, got %v, %v", "1", val, err)
+	}
+	if err = ro.Set("b", "2"); err != ErrReadOnly {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+	ro.Close()
+
+	if _, err = Open("/tmp/test_open_options_missing.lm2", WithReadOnly()); err != ErrDoesNotExist {
+		t.Errorf("expected ErrDoesNotExist, got %v", err)
+	}
+
+	c, err = Open("/tmp/test_open_options.lm2", WithEncryptionKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileLock(t *testing.T) {
+	c, err := NewCollection("/tmp/test_file_lock.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	if _, err = OpenCollection("/tmp/test_file_lock.lm2", 100); err != ErrLocked {
+		t.Errorf("expected ErrLocked, got %v", err)
+	}
+	if _, err = NewCollection("/tmp/test_file_lock.lm2", 100); err != ErrLocked {
+		t.Errorf("expected ErrLocked from NewCollection, got %v", err)
+	}
+	if _, err = Open("/tmp/test_file_lock.lm2", WithReadOnly(), WithSharedLock()); err != ErrLocked {
+		t.Errorf("expected ErrLocked for a shared lock, got %v", err)
+	}
+
+	// Read-only collections don't lock by default.
+	ro, err := OpenCollectionReadOnly("/tmp/test_file_lock.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro.Close()
+
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Shared locks only exclude writers.
+	ro1, err := Open("/tmp/test_file_lock.lm2", WithReadOnly(), WithSharedLock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro2, err := Open("/tmp/test_file_lock.lm2", WithReadOnly(), WithSharedLock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenCollection("/tmp/test_file_lock.lm2", 100); err != ErrLocked {
+		t.Errorf("expected ErrLocked with shared locks held, got %v", err)
+	}
+	ro1.Close()
+	ro2.Close()
+
+	c, err = OpenCollection("/tmp/test_file_lock.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	// Compaction swaps in a new data file, which has to stay locked.
+	if err = c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenCollection("/tmp/test_file_lock.lm2", 100); err != ErrLocked {
+		t.Errorf("expected ErrLocked after compaction, got %v", err)
+	}
+}
+
+func TestOpenMemory(t *testing.T) {
+	c, err := OpenMemory(WithCompression(FlateCompression))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 100; i++ {
+		wb.Set(fmt.Sprintf("%03d", i), strings.Repeat("value", 10))
+	}
+	if _, err = c.Update(wb); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i += 2 {
+		if err = c.Delete(fmt.Sprintf("%03d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	cur, err := c.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for cur.Next() {
+		if cur.Value() != strings.Repeat("value", 10) {
+			t.Errorf("unexpected value for key %v: %v", cur.Key(), cur.Value())
+		}
+		count++
+	}
+	if count != 50 {
+		t.Errorf("expected %d records, got %d", 50, count)
+	}
+	if stats := c.Stats(); stats.LiveRecords != 50 || stats.DeletedRecords != 0 {
+		t.Errorf("expected 50 live and 0 deleted records, got %d and %d",
+			stats.LiveRecords, stats.DeletedRecords)
+	}
+	if _, err = os.Stat(":memory:"); !os.IsNotExist(err) {
+		t.Errorf("expected no data file, got %v", err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if _, err = c.Backup(buf); err != nil {
+		t.Fatal(err)
+	}
+	if err = Restore(buf, "/tmp/test_open_memory_restore.lm2"); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := OpenCollection("/tmp/test_open_memory_restore.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Destroy()
+	if val, err := restored.Get("001"); err != nil || val != strings.Repeat("value", 10) {
+		t.Errorf("unexpected restored value %v, %v", val, err)
+	}
+
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Get("001"); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestReverse(t *testing.T) {
+	c, err := NewCollection("/tmp/test_reverse.lm2", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 20; i++ {
+		wb.Set(fmt.Sprintf("%02d", i), fmt.Sprint(i))
+	}
+	if _, err = c.Update(wb); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Delete("15"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Delete("19"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		start, end string
+		expected   []string
+	}{
+		{"", "", []string{"18", "17", "16", "14", "13", "12", "11", "10",
+			"09", "08", "07", "06", "05", "04", "03", "02", "01", "00"}},
+		{"12", "17", []string{"16", "14", "13", "12"}},
+		{"16", "", []string{"18", "17", "16"}},
+		{"30", "", nil},
+	}
+	for _, test := range tests {
+		cur, err := c.ReverseRange(test.start, test.end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for cur.Prev() {
+			keys = append(keys, cur.Key())
+		}
+		if fmt.Sprint(keys) != fmt.Sprint(test.expected) {
+			t.Errorf("ReverseRange(%q, %q): expected %v, got %v",
+				test.start, test.end, test.expected, keys)
+		}
+	}
+
+	// Change direction in the middle of an iteration.
+	cur, err := c.Range("13", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	cur.Next()
+	keys = append(keys, cur.Key())
+	cur.Next()
+	keys = append(keys, cur.Key())
+	cur.Prev()
+	keys = append(keys, cur.Key())
+	cur.Next()
+	keys = append(keys, cur.Key())
+	for cur.Next() {
+	}
+	cur.Prev()
+	keys = append(keys, cur.Key())
+	if expected := "[13 14 13 14 18]"; fmt.Sprint(keys) != expected {
+		t.Errorf("expected %v, got %v", expected, keys)
+	}
+
+	if cur.Prev(); cur.Key() != "17" {
+		t.Errorf("expected key %v, got %v", "17", cur.Key())
+	}
+	for cur.Prev() {
+	}
+	if cur.Valid() {
+		t.Error("expected cursor to be invalid before the range start")
+	}
+}
+
+func TestGetMulti(t *testing.T) {
+	c, err := NewCollection("/tmp/test_get_multi.lm2", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 100; i++ {
+		wb.Set(fmt.Sprintf("%02d", i), fmt.Sprint(i))
+	}
+	if _, err = c.Update(wb); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Delete("50"); err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := c.GetMulti([]string{"90", "05", "50", "missing", "05", "42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"90": "90", "05": "5", "42": "42"}
+	if fmt.Sprint(values) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, values)
+	}
+
+	values, err = c.GetMulti(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 0 {
+		t.Errorf("expected no values, got %v", values)
+	}
+}
+
+func TestAsyncWriter(t *testing.T) {
+	c, err := NewCollection("/tmp/test_async_writer.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	w := c.NewAsyncWriter(10, time.Hour)
+	if err = w.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	w.Delete("a")
+	w.Set("a", "2")
+	w.Set("b", "1")
+	w.Delete("b")
+	if _, err = c.Get("a"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound before Flush, got %v", err)
+	}
+
+	version := c.Version()
+	if err = w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := c.Get("a"); err != nil || val != "2" {
+		t.Errorf("expected value %v, got %v, %v", "2", val, err)
+	}
+	if _, err = c.Get("b"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+	if c.Version() == version {
+		t.Error("expected Flush to commit")
+	}
+
+	// Reaching maxOps commits in the background.
+	for i := 0; i < 10; i++ {
+		w.Set(fmt.Sprint(i), "value")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err = c.Get("9"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected buffered writes to be committed in the background")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	w.Set("c", "1")
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := c.Get("c"); err != nil || val != "1" {
+		t.Errorf("expected value %v after Close, got %v, %v", "1", val, err)
+	}
+
+	// Commit errors are reported by the next call.
+	w = c.NewAsyncWriter(10, time.Hour)
+	c.Close()
+	w.Set("d", "1")
+	if err = w.Flush(); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	w.Close()
+}
+
+func TestHistory(t *testing.T) {
+	c, err := NewCollection("/tmp/test_history.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	c.Set("a", "1")
+	v1 := c.Version()
+	wb := NewWriteBatch()
+	wb.Set("a", "2")
+	wb.Set("b", "1")
+	v2, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Delete("a")
+	v3 := c.Version()
+
+	for _, test := range []struct {
+		version int64
+		value   string
+		err     error
+	}{
+		{v1, "1", nil},
+		{v2, "2", nil},
+		{v3, "", ErrKeyNotFound},
+	} {
+		val, err := c.GetAt("a", test.version)
+		if val != test.value || err != test.err {
+			t.Errorf("GetAt(a, %d): expected %q, %v, got %q, %v", test.version, test.value, test.err, val, err)
+		}
+	}
+
+	history, err := c.History("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []KeyVersion{
+		{Value: "1", Created: v1, Deleted: v2},
+		{Value: "2", Created: v2, Deleted: v3},
+	}
+	if fmt.Sprint(history) != fmt.Sprint(expected) {
+		t.Errorf("expected history %v, got %v", expected, history)
+	}
+	history, err = c.History("missing")
+	if err != nil || len(history) != 0 {
+		t.Errorf("expected empty history, got %v, %v", history, err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	c, err := NewCollection("/tmp/test_subscribe.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	c.Set("a", "1")
+	v1 := c.Version()
+	c.Set("a", "2")
+	v2 := c.Version()
+	c.Set("b", "1")
+	v3 := c.Version()
+
+	sub, err := c.Subscribe(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Delete("b")
+	v4 := c.Version()
+	wb := NewWriteBatch()
+	wb.Set("c", "1")
+	wb.Delete("a")
+	wb.Delete("missing")
+	v5, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Change{
+		{Version: v2, Key: "a", Value: "2"},
+		{Version: v3, Key: "b", Value: "1"},
+		{Version: v4, Key: "b", Deleted: true},
+		{Version: v5, Key: "a", Deleted: true},
+		{Version: v5, Key: "c", Value: "1"},
+	}
+	for i, want := range expected {
+		select {
+		case got := <-sub.C:
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("change %d: expected %+v, got %+v", i, want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for change %d", i)
+		}
+	}
+
+	sub.Stop()
+	if _, ok := <-sub.C; ok {
+		t.Error("expected C to be closed after Stop")
+	}
+
+	if _, err = c.Subscribe(v1 + 1); err != ErrUnknownVersion {
+		t.Errorf("expected ErrUnknownVersion, got %v", err)
+	}
+
+	sub, err = c.Subscribe(c.Version())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if _, ok := <-sub.C; ok {
+		t.Error("expected C to be closed after Close")
+	}
+}
+
+func TestReplication(t *testing.T) {
+	primary, err := NewCollection("/tmp/test_replication_primary.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Destroy()
+	follower, err := NewCollection("/tmp/test_replication_follower.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Destroy()
+
+	replicate := func(from int64) int64 {
+		changes, err := primary.ChangesSince(from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = follower.ApplyChanges(changes); err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) == 0 {
+			return from
+		}
+		return changes[len(changes)-1].Version
+	}
+
+	primary.Set("a", "1")
+	primary.SetWithTTL("b", "1", time.Hour)
+	primary.Set("c", "1")
+	version := replicate(0)
+
+	wb := NewWriteBatch()
+	wb.Set("a", "2")
+	wb.Delete("c")
+	primary.Update(wb)
+	primary.Set("d", "1")
+	version = replicate(version)
+	if version != primary.Version() {
+		t.Errorf("expected follower to be at version %d, got %d", primary.Version(), version)
+	}
+	if changes, err := primary.ChangesSince(version); err != nil || len(changes) != 0 {
+		t.Errorf("expected no changes, got %v, %v", changes, err)
+	}
+
+	expected := map[string]string{"a": "2", "b": "1", "d": "1"}
+	values, err := follower.GetMulti([]string{"a", "b", "c", "d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(values) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, values)
+	}
+	history, err := follower.History("b")
+	if err != nil || len(history) != 1 || history[0].Expires == 0 {
+		t.Errorf("expected b to keep its expiration, got %v, %v", history, err)
+	}
+}
+
+var (
+	benchKeySize   = flag.Int("bench.keysize", 16, "key size in bytes for benchmarks")
+	benchValueSize = flag.Int("bench.valuesize", 100, "value size in bytes for benchmarks")
+	benchRecords   = flag.Int("bench.records", 10000, "number of records loaded by read benchmarks")
+)
+
+func benchKey(i int) string {
+	return fmt.Sprintf("%0*d", *benchKeySize, i)
+}
+
+func benchValue() string {
+	return strings.Repeat("v", *benchValueSize)
+}
+
+// benchCollection returns a collection with the given cache size
+// loaded with *benchRecords records.
+func benchCollection(b *testing.B, cacheSize int) *Collection {
+	c, err := NewCollection("/tmp/bench.lm2", cacheSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+	c.SetSyncPolicy(SyncNever, 0)
+	value := benchValue()
+	wb := NewWriteBatch()
+	for i := 0; i < *benchRecords; i++ {
+		wb.Set(benchKey(i), value)
+		if (i+1)%1000 == 0 {
+			if _, err = c.Update(wb); err != nil {
+				b.Fatal(err)
+			}
+			wb = NewWriteBatch()
+		}
+	}
+	if _, err = c.Update(wb); err != nil {
+		b.Fatal(err)
+	}
+	return c
+}
+
+func BenchmarkPut(b *testing.B) {
+	c, err := NewCollection("/tmp/bench.lm2", 100)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Destroy()
+
+	value := benchValue()
+	keys := rand.Perm(b.N)
+	b.SetBytes(int64(*benchKeySize + *benchValueSize))
+	b.ResetTimer()
+	for _, i := range keys {
+		if err = c.Set(benchKey(i), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetHot(b *testing.B) {
+	c := benchCollection(b, 100)
+	defer c.Destroy()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Get(benchKey(i % 10)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetCold(b *testing.B) {
+	c := benchCollection(b, 1)
+	defer c.Destroy()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Get(benchKey(rand.Intn(*benchRecords))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCursorScan(b *testing.B) {
+	c := benchCollection(b, 100)
+	defer c.Destroy()
+
+	b.SetBytes(int64(*benchRecords * (*benchKeySize + *benchValueSize)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cur, err := c.NewCursor()
+		if err != nil {
+			b.Fatal(err)
+		}
+		n := 0
+		for cur.Next() {
+			n++
+		}
+		if n != *benchRecords {
+			b.Fatalf("expected %d records, got %d", *benchRecords, n)
+		}
+	}
+}
+
+func BenchmarkCompact(b *testing.B) {
+	c := benchCollection(b, 100)
+	defer c.Destroy()
+
+	value := benchValue()
+	for i := 0; i < b.N; i++ {
+		// Overwrite half of the records to leave garbage behind.
+		b.StopTimer()
+		wb := NewWriteBatch()
+		for j := 0; j < *benchRecords; j += 2 {
+			wb.Set(benchKey(j), value)
+		}
+		if _, err := c.Update(wb); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		if err := c.Compact(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestLayout(t *testing.T) {
+	h := fileHeader{
+		Magic:             fileMagic,
+		FormatVersion:     formatVersion,
+		Flags:             flagEncrypted,
+		Head:              1,
+		LastCommit:        -2,
+		LastValidLogEntry: 1 << 40,
+	}
+	b := h.bytes()
+	if len(b) != fileHeaderSize {
+		t.Errorf("expected %d byte file header, got %d", fileHeaderSize, len(b))
+	}
+	if decoded := decodeFileHeader(b); decoded != h {
+		t.Errorf("expected file header %+v, got %+v", h, decoded)
+	}
+
+	rh := recordHeader{
+		Next:    fileHeaderSize,
+		Deleted: 1 << 50,
+		Expires: -1,
+		Flags:   recordEncrypted | uint16(FlateCompression),
+		KeyLen:  0xffff,
+		ValLen:  0xfffffffe,
+	}
+	b = rh.bytes()
+	expected := []byte{
+		36, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 4, 0,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		5, 0,
+		0xff, 0xff,
+		0xfe, 0xff, 0xff, 0xff,
+	}
+	if !bytes.Equal(b, expected) {
+		t.Errorf("expected record header %v, got %v", expected, b)
+	}
+	if decoded := decodeRecordHeader(b); decoded != rh {
+		t.Errorf("expected record header %+v, got %+v", rh, decoded)
+	}
+
+	s := sentinelRecord{Magic: sentinelMagic, Offset: 1234}
+	b = s.bytes()
+	expected = []byte{0xcc, 0x10, 0xad, 0xde, 0xd2, 0x04, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(b, expected) {
+		t.Errorf("expected sentinel %v, got %v", expected, b)
+	}
+	if decoded, ok := decodeSentinelRecord(b); !ok || decoded != s {
+		t.Errorf("expected sentinel %+v, got %+v, %v", s, decoded, ok)
+	}
+
+	s = sentinelRecord{Magic: timedSentinelMagic, Offset: 1234, Timestamp: 1}
+	b = s.bytes()
+	expected = []byte{0xcd, 0x10, 0xad, 0xde, 0xd2, 0x04, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(b, expected) {
+		t.Errorf("expected timed sentinel %v, got %v", expected, b)
+	}
+	if decoded, ok := decodeSentinelRecord(b); !ok || decoded != s {
+		t.Errorf("expected timed sentinel %+v, got %+v, %v", s, decoded, ok)
+	}
+	if _, ok := decodeSentinelRecord(b[:sentinelSize]); ok {
+		t.Error("expected truncated timed sentinel to be rejected")
+	}
+}
+
+func TestLenAndEstimateSize(t *testing.T) {
+	c, err := NewCollection("/tmp/test_len.lm2", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	if n, err := c.Len(); err != nil || n != 0 {
+		t.Errorf("expected 0 records, got %d, %v", n, err)
+	}
+	value := strings.Repeat("v", 100)
+	wb := NewWriteBatch()
+	for i := 0; i < 100; i++ {
+		wb.Set(fmt.Sprintf("%03d", i), value)
+	}
+	c.Update(wb)
+	c.Set("000", "overwritten")
+	c.Delete("001")
+	if n, err := c.Len(); err != nil || n != 99 {
+		t.Errorf("expected 99 records, got %d, %v", n, err)
+	}
+
+	recordSize := int64(recordHeaderSize + 3 + 100)
+	for _, test := range []struct {
+		start, end string
+		size       int64
+	}{
+		{"050", "", 50 * recordSize},
+		{"010", "020", 10 * recordSize},
+		{"200", "", 0},
+	} {
+		size, err := c.EstimateSize(test.start, test.end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != test.size {
+			t.Errorf("EstimateSize(%q, %q): expected %d, got %d", test.start, test.end, test.size, size)
+		}
+	}
+
+	c.Close()
+	if _, err = c.Len(); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	c, err := NewCollection("/tmp/test_delete_range.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		wb.Set(key, key)
+	}
+	c.Update(wb)
+
+	version := c.Version()
+	if err = c.DeleteRange("b", "d"); err != nil {
+		t.Fatal(err)
+	}
+	if c.Version() == version {
+		t.Error("expected DeleteRange to commit")
+	}
+	values, err := c.GetMulti([]string{"a", "b", "c", "d", "e"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]string{"a": "a", "d": "d", "e": "e"}; fmt.Sprint(values) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, values)
+	}
+
+	if err = c.DeleteRange("d", ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := verifyOrder(t, c); n != 1 {
+		t.Errorf("expected 1 record, got %d", n)
+	}
+	if err = c.DeleteRange("x", "z"); err != nil {
+		t.Errorf("expected empty range delete to succeed, got %v", err)
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	c, err := NewCollection("/tmp/test_conditional.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	if err = c.PutIfAbsent("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.PutIfAbsent("a", "2"); err != ErrConflict {
+		t.Errorf("expected ErrConflict, got %v", err)
+	}
+	if err = c.CompareAndSwap("a", "2", "3"); err != ErrConflict {
+		t.Errorf("expected ErrConflict, got %v", err)
+	}
+	if err = c.CompareAndSwap("missing", "", "1"); err != ErrConflict {
+		t.Errorf("expected ErrConflict for missing key, got %v", err)
+	}
+	if err = c.CompareAndSwap("a", "1", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := c.Get("a"); err != nil || val != "2" {
+		t.Errorf("expected value %v, got %v, %v", "2", val, err)
+	}
+	c.Delete("a")
+	if err = c.PutIfAbsent("a", "3"); err != nil {
+		t.Errorf("expected PutIfAbsent of deleted key to succeed, got %v", err)
+	}
+
+	// Concurrent increments only succeed once per value.
+	c.Set("counter", "0")
+	const N = 8
+	wg := sync.WaitGroup{}
+	for i := 0; i < N; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				val, err := c.Get("counter")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n := 0
+				fmt.Sscan(val, &n)
+				err = c.CompareAndSwap("counter", val, fmt.Sprint(n+1))
+				if err == nil {
+					return
+				}
+				if err != ErrConflict {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if val, err := c.Get("counter"); err != nil || val != fmt.Sprint(N) {
+		t.Errorf("expected counter %v, got %v, %v", N, val, err)
+	}
+}
+
+func TestBackpressure(t *testing.T) {
+	c, err := NewCollection("/tmp/test_backpressure.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	stalls := 0
+	onStall := func(time.Duration) {
+		stalls++
+	}
+	c.SetBackpressure(BackpressureBlock, 0.5, onStall)
+	c.Set("a", "1")
+	c.Set("a", "2")
+	if stalls != 0 {
+		t.Errorf("expected no stalls, got %d", stalls)
+	}
+	// 1 of 2 records is garbage, which isn't over the limit.
+	c.Set("a", "3")
+	// 2 of 3 records are garbage, so this set compacts first.
+	if err = c.Set("a", "4"); err != nil {
+		t.Fatal(err)
+	}
+	if stalls != 1 {
+		t.Errorf("expected 1 stall, got %d", stalls)
+	}
+	if stats := c.Stats(); stats.DeletedRecords != 1 || stats.LiveRecords != 1 {
+		t.Errorf("expected compaction before the last set, got %+v", stats)
+	}
+
+	c.SetBackpressure(BackpressureError, 0.5, onStall)
+	c.Set("a", "5")
+	if err = c.Set("a", "6"); err != ErrBusy {
+		t.Errorf("expected ErrBusy, got %v", err)
+	}
+	c.background.Wait()
+	if err = c.Set("a", "6"); err != nil {
+		t.Errorf("expected set to succeed after compaction, got %v", err)
+	}
+
+	c.SetBackpressure(BackpressureDelay, 0.5, onStall)
+	stalls = 0
+	c.Set("a", "7")
+	c.Set("a", "8")
+	c.background.Wait()
+	if stalls != 1 {
+		t.Errorf("expected 1 stall, got %d", stalls)
+	}
+	if val, err := c.Get("a"); err != nil || val != "8" {
+		t.Errorf("expected value %v, got %v, %v", "8", val, err)
+	}
+
+	// Updates aren't held up while the collection can't be compacted.
+	snap := c.Snapshot()
+	for _, policy := range []BackpressurePolicy{BackpressureBlock, BackpressureError} {
+		c.SetBackpressure(policy, 0.5, nil)
+		for i := 0; i < 3; i++ {
+			if err = c.Set("a", fmt.Sprint(i)); err != nil {
+				t.Errorf("expected set to succeed with an open snapshot, got %v", err)
+			}
+		}
+	}
+	c.background.Wait()
+	if val, err := snap.Get("a"); err != nil || val != "8" {
+		t.Errorf("expected value %v, got %v, %v", "8", val, err)
+	}
+	snap.Close()
+}
+
+func TestChecksums(t *testing.T) {
+	c, err := Open("/tmp/test_checksums.lm2", WithChecksums())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	if err = c.Set("a", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set("b", "value"); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	ro, err := OpenCollectionReadOnly("/tmp/test_checksums.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := ro.Get("b"); err != nil || val != "value" {
+		t.Errorf("expected value %v, got %v, %v", "value", val, err)
+	}
+	ro.Close()
+
+	// Flip a byte in the value of the last record.
+	f, err := os.OpenFile("/tmp/test_checksums.lm2", os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{'V'}, int64(bytes.LastIndex(data, []byte("value"))))
+	f.Close()
+
+	ro, err = OpenCollectionReadOnly("/tmp/test_checksums.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if _, err = ro.Get("b"); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt, got %v", err)
+	}
+	cur, err := ro.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for cur.Next() {
+		n++
+	}
+	if n != 1 || !errors.Is(cur.Err(), ErrCorrupt) {
+		t.Errorf("expected cursor to stop with ErrCorrupt after 1 record, got %d, %v", n, cur.Err())
+	}
+}
+
+func TestUpgradeFormatVersion(t *testing.T) {
+	c, err := NewCollection("/tmp/test_upgrade.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	c.Set("a", "1")
+	c.Close()
+
+	f, err := os.OpenFile("/tmp/test_upgrade.lm2", os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{3, 0, 0, 0}, 4)
+	f.Close()
+
+	if _, err = OpenCollectionReadOnly("/tmp/test_upgrade.lm2", 100); err != ErrIncompatibleVersion {
+		t.Errorf("expected ErrIncompatibleVersion for read-only open, got %v", err)
+	}
+	c, err = OpenCollection("/tmp/test_upgrade.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.FormatVersion != formatVersion {
+		t.Errorf("expected format version %d, got %d", formatVersion, c.FormatVersion)
+	}
+	if val, err := c.Get("a"); err != nil || val != "1" {
+		t.Errorf("expected value %v, got %v, %v", "1", val, err)
+	}
+}
+
+func TestUpgradeLegacyFormats(t *testing.T) {
+	const file = "/tmp/test_upgrade_legacy.lm2"
+	defer os.Remove(file + ".wal")
+	defer os.Remove(file + ".cache")
+
+	type legacyRecord struct {
+		key, value string
+		deleted    bool
+		expires    int64
+	}
+	records := []legacyRecord{
+		{key: "a", value: "1"},
+		{key: "b", value: "2", deleted: true},
+		{key: "c", value: "3", expires: 1},
+		{key: "d", value: "4", expires: time.Now().Add(time.Hour).UnixNano()},
+	}
+	for _, version := range []uint32{0, 1, 2} {
+		// Write the records in the layout of version.
+		start := int64(fileHeaderSize)
+		if version == 0 {
+			start = legacyFileHeaderSize
+		}
+		body := bytes.NewBuffer(nil)
+		offset := start
+		for i, rec := range records {
+			if version < 2 && rec.expires != 0 {
+				continue
+			}
+			size := int64(legacyRecordHeaderSizes[version] + len(rec.key) + len(rec.value))
+			next, deleted := offset+size, int64(0)
+			if i == len(records)-1 || (version < 2 && i == 1) {
+				next = 0
+			}
+			if rec.deleted {
+				deleted = start
+			}
+			binary.Write(body, binary.LittleEndian, next)
+			binary.Write(body, binary.LittleEndian, deleted)
+			if version == 2 {
+				binary.Write(body, binary.LittleEndian, rec.expires)
+			}
+			binary.Write(body, binary.LittleEndian, uint16(len(rec.key)))
+			binary.Write(body, binary.LittleEndian, uint32(len(rec.value)))
+			body.WriteString(rec.key + rec.value)
+			offset += size
+		}
+		binary.Write(body, binary.LittleEndian, uint32(sentinelMagic))
+		binary.Write(body, binary.LittleEndian, offset)
+
+		buf := bytes.NewBuffer(nil)
+		if version > 0 {
+			binary.Write(buf, binary.LittleEndian, uint32(fileMagic))
+			binary.Write(buf, binary.LittleEndian, version)
+			binary.Write(buf, binary.LittleEndian, uint32(0))
+		}
+		binary.Write(buf, binary.LittleEndian, start)
+		binary.Write(buf, binary.LittleEndian, offset+sentinelSize)
+		binary.Write(buf, binary.LittleEndian, int64(0))
+		buf.Write(body.Bytes())
+		if err := ioutil.WriteFile(file, buf.Bytes(), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := resetWALAndCache(file); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := OpenCollectionReadOnly(file, 100); err != ErrIncompatibleVersion {
+			t.Errorf("expected ErrIncompatibleVersion for read-only open of version %d, got %v", version, err)
+		}
+		c, err := OpenCollection(file, 100)
+		if err != nil {
+			t.Fatalf("version %d: %v", version, err)
+		}
+		if c.FormatVersion != formatVersion {
+			t.Errorf("expected format version %d, got %d", formatVersion, c.FormatVersion)
+		}
+		expected := "a=1 "
+		if version == 2 {
+			expected += "d=4 "
+		}
+		got := ""
+		cur, err := c.NewCursor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for cur.Next() {
+			got += cur.Key() + "=" + cur.Value() + " "
+		}
+		if got != expected {
+			t.Errorf("version %d: expected %q, got %q", version, expected, got)
+		}
+		if err = c.Set("e", "5"); err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		if c, err = OpenCollection(file, 100); err != nil {
+			t.Fatal(err)
+		}
+		if val, err := c.Get("e"); err != nil || val != "5" {
+			t.Errorf("expected value %v, got %v, %v", "5", val, err)
+		}
+		c.Destroy()
+	}
+}
+
+func TestRepair(t *testing.T) {
+	c, err := NewCollection("/tmp/test_repair.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	defer os.Remove("/tmp/test_repair_repaired.lm2")
+	defer os.Remove("/tmp/test_repair_repaired.lm2.wal")
+	defer os.Remove("/tmp/test_repair_repaired.lm2.cache")
+
+	c.Set("a", "1")
+	c.Set("damaged", "1")
+	wb := NewWriteBatch()
+	wb.Set("b", "1")
+	wb.Set("c", "1")
+	c.Update(wb)
+	c.Set("a", "2")
+	c.Delete("c")
+	c.SetWithTTL("d", "1", time.Hour)
+	c.Close()
+
+	// Give the second record an impossible length and break the chain.
+	f, err := os.OpenFile("/tmp/test_repair.lm2", os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := int64(bytes.Index(data, []byte("damaged1"))) - recordHeaderSize
+	f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, offset+28)
+	f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, fileHeaderSize)
+	f.Close()
+
+	report, err := Repair("/tmp/test_repair.lm2", "/tmp/test_repair_repaired.lm2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Records != 3 {
+		t.Errorf("expected 3 records, got %d", report.Records)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Offset != offset {
+		t.Errorf("expected a problem at offset %d, got %v", offset, report.Problems)
+	}
+
+	repaired, err := OpenCollection("/tmp/test_repair_repaired.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repaired.Close()
+	values, err := repaired.GetMulti([]string{"a", "b", "c", "d", "damaged"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]string{"a": "2", "b": "1", "d": "1"}; fmt.Sprint(values) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, values)
+	}
+	if history, err := repaired.History("d"); err != nil || history[0].Expires == 0 {
+		t.Errorf("expected d to keep its expiration, got %v, %v", history, err)
+	}
+	if report, err := repaired.Verify(); err != nil || !report.OK() {
+		t.Errorf("expected repaired collection to verify, got %v, %v", report, err)
+	}
+}
+
+func TestCursorConcurrentUpdates(t *testing.T) {
+	c, err := NewCollection("/tmp/test_cursor_concurrent.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	c.SetSyncPolicy(SyncNever, 0)
+
+	const N = 200
+	wb := NewWriteBatch()
+	for i := 0; i < N; i += 2 {
+		wb.Set(fmt.Sprintf("%03d", i), "original")
+	}
+	c.Update(wb)
+
+	cur, err := c.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Insert the odd keys and overwrite or delete the even
+	// keys while the cursor iterates.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < N; i++ {
+			key := fmt.Sprintf("%03d", i)
+			switch {
+			case i%2 == 1:
+				c.Set(key, "new")
+			case i%4 == 0:
+				c.Set(key, "overwritten")
+			default:
+				c.Delete(key)
+			}
+		}
+	}()
+
+	seen := 0
+	for cur.Next() {
+		if cur.Key() != fmt.Sprintf("%03d", seen*2) || cur.Value() != "original" {
+			t.Errorf("unexpected record %v => %v at position %d", cur.Key(), cur.Value(), seen)
+		}
+		seen++
+	}
+	<-done
+	if seen != N/2 {
+		t.Errorf("expected %d records, got %d", N/2, seen)
+	}
+	if n := verifyOrder(t, c); n != N/2+N/4 {
+		t.Errorf("expected %d records after the updates, got %d", N/2+N/4, n)
+	}
+}
+
+func TestHas(t *testing.T) {
+	c, err := NewCollection("/tmp/test_has.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	c.SetBloomFilter(0.01)
+
+	c.Set("a", "1")
+	c.Set("b", "1")
+	c.Delete("b")
+	c.SetWithTTL("c", "1", -time.Second)
+	for key, expected := range map[string]bool{"a": true, "b": false, "c": false, "d": false} {
+		if found, err := c.Has(key); err != nil || found != expected {
+			t.Errorf("Has(%q): expected %v, got %v, %v", key, expected, found, err)
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	c, err := NewCollection("/tmp/test_session.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	w := c.NewAsyncWriter(1000, time.Hour)
+	defer w.Close()
+	s := w.NewSession()
+	other := w.NewSession()
+
+	if err = s.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Get("a"); err != ErrKeyNotFound {
+		t.Errorf("expected write to be buffered, got %v", err)
+	}
+	if val, err := s.Get("a"); err != nil || val != "1" {
+		t.Errorf("expected value %v, got %v, %v", "1", val, err)
+	}
+
+	// Reads that don't depend on buffered writes don't flush them.
+	version := c.Version()
+	other.Set("b", "1")
+	if _, err = s.Get("b"); err != ErrKeyNotFound {
+		t.Errorf("expected other session's write to be buffered, got %v", err)
+	}
+	if c.Version() != version {
+		t.Error("expected no commit")
+	}
+
+	s.Delete("a")
+	cur, err := s.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for cur.Next() {
+		keys = append(keys, cur.Key())
+	}
+	if fmt.Sprint(keys) != "[b]" {
+		t.Errorf("expected keys [b], got %v", keys)
+	}
+
+	// A failed commit fails reads until it is cleared.
+	if err = s.Set(indexKeyPrefix+"a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err = s.Get("a"); !errors.Is(err, ErrReservedKey) {
+			t.Errorf("expected ErrReservedKey, got %v", err)
+		}
+	}
+	if err = s.Set("c", "1"); !errors.Is(err, ErrReservedKey) {
+		t.Errorf("expected ErrReservedKey, got %v", err)
+	}
+	if err = w.Flush(); !errors.Is(err, ErrReservedKey) {
+		t.Errorf("expected ErrReservedKey, got %v", err)
+	}
+	if err = w.ClearError(); !errors.Is(err, ErrReservedKey) {
+		t.Errorf("expected ErrReservedKey, got %v", err)
+	}
+	if err = s.Set("c", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := s.Get("c"); err != nil || val != "1" {
+		t.Errorf("expected value %v, got %v, %v", "1", val, err)
+	}
+}
+
+func TestCommitTime(t *testing.T) {
+	c, err := NewCollection("/tmp/test_commit_time.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	before := time.Now()
+	c.Set("a", "1")
+	v1 := c.Version()
+	c.Set("b", "1")
+	v2 := c.Version()
+	after := time.Now()
+
+	t1, err := c.CommitTime(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t2, err := c.CommitTime(v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if t1.Before(before) || t2.Before(t1) || t2.After(after) {
+		t.Errorf("expected %v <= %v <= %v <= %v", before, t1, t2, after)
+	}
+	for _, version := range []int64{0, fileHeaderSize, v1 + 1, v2 + 1} {
+		if _, err = c.CommitTime(version); err != ErrUnknownVersion {
+			t.Errorf("CommitTime(%d): expected ErrUnknownVersion, got %v", version, err)
+		}
+	}
+}
+
+func TestSnapshotAt(t *testing.T) {
+	c, err := NewCollection("/tmp/test_snapshot_at.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	before := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	c.Set("a", "1")
+	time.Sleep(10 * time.Millisecond)
+	t1 := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	c.Set("a", "2")
+
+	if _, err = c.SnapshotAt(before); err != ErrUnknownVersion {
+		t.Errorf("expected ErrUnknownVersion, got %v", err)
+	}
+
+	// Load the commit times from the data file
+	// and then maintain them.
+	c.Close()
+	c, err = OpenCollection("/tmp/test_snapshot_at.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := c.SnapshotAt(t1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := snap.Get("a"); err != nil || val != "1" {
+		t.Errorf("expected value %v, got %v, %v", "1", val, err)
+	}
+	c.Set("a", "3")
+	snap, err = c.SnapshotAt(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := snap.Get("a"); err != nil || val != "3" {
+		t.Errorf("expected value %v, got %v, %v", "3", val, err)
+	}
+}
+
+// fuzzCollectionSeeds returns the data file of a small collection, and a
+// copy with the last record linked back to the head record.
+func fuzzCollectionSeeds(f *testing.F) [][]byte {
+	file := f.TempDir() + "/seed.lm2"
+	c, err := NewCollection(file, 100)
+	if err != nil {
+		f.Fatal(err)
+	}
+	c.Set("a", "1")
+	c.Set("b", "2")
+	c.Delete("a")
+	c.SetWithTTL("c", "3", time.Hour)
+	var head, last int64
+	c.WalkRecords(func(info RecordInfo) bool {
+		if head == 0 {
+			head = info.Offset
+		}
+		last = info.Offset
+		return true
+	})
+	c.Close()
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		f.Fatal(err)
+	}
+	cyclic := append([]byte(nil), data...)
+	header := recordHeader{Next: head}
+	copy(cyclic[last:], header.bytes()[:8])
+	return [][]byte{data, cyclic}
+}
+
+func FuzzOpenCollection(f *testing.F) {
+	for _, seed := range fuzzCollectionSeeds(f) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		file := t.TempDir() + "/fuzz.lm2"
+		if err := ioutil.WriteFile(file, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file+".cache", nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+		c, err := OpenCollectionReadOnly(file, 100)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		if cur, err := c.NewCursor(); err == nil {
+			for cur.Next() {
+			}
+		}
+		c.Get("b")
+		c.Verify()
+		c.WalkRecords(func(RecordInfo) bool { return true })
+	})
+}
+
+func FuzzReadWALEntry(f *testing.F) {
+	w := newWALFile(newMemFile("seed.wal"))
+	w.noSync = true
+	entry := newWALEntry()
+	entry.Push(newWALRecord(fileHeaderSize, []byte("record header")))
+	entry.Push(newWALRecord(0, []byte("file header")))
+	if _, err := w.Append(entry); err != nil {
+		f.Fatal(err)
+	}
+	seed := make([]byte, w.lastGoodOffset)
+	w.f.ReadAt(seed, 0)
+	f.Add(seed)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		w := newWALFile(newMemFile("fuzz.wal"))
+		w.f.Write(data)
+		w.f.Seek(0, 0)
+		w.ReadEntry()
+		if len(data) >= 12 {
+			w.ReadLastEntry()
+		}
+	})
+}
+
+func TestCyclicRecordChain(t *testing.T) {
+	c, err := NewCollection("/tmp/test_cyclic_record_chain.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	c.Set("a", "1")
+	c.Set("b", "2")
+
+	// Link b back to a.
+	var offsets []int64
+	c.WalkRecords(func(info RecordInfo) bool {
+		offsets = append(offsets, info.Offset)
+		return true
+	})
+	header := recordHeader{Next: offsets[0]}
+	if _, err = c.f.WriteAt(header.bytes()[:8], offsets[1]); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	c, err = OpenCollection("/tmp/test_cyclic_record_chain.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cur, err := c.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; cur.Next(); i++ {
+		if i > 2 {
+			t.Fatal("cursor followed a cyclic record chain")
+		}
+	}
+	if !errors.Is(cur.Err(), ErrCorruptChain) || !errors.Is(cur.Err(), ErrCorrupt) {
+		t.Errorf("expected ErrCorruptChain, got %v", cur.Err())
+	}
+	if _, err = c.History("b"); !errors.Is(err, ErrCorruptChain) {
+		t.Errorf("expected ErrCorruptChain, got %v", err)
+	}
+	report, err := c.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() {
+		t.Error("expected Verify to report the cyclic record chain")
+	}
+}
+
+func TestCheckpoints(t *testing.T) {
+	c, err := NewCollection("/tmp/test_checkpoints.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	c.Set("a", "1")
+	if err = c.Checkpoint("before"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Checkpoint("before"); err != ErrCheckpointExists {
+		t.Errorf("expected ErrCheckpointExists, got %v", err)
+	}
+	c.Set("a", "2")
+	c.Delete("a")
+	if err = c.Compact(); err != ErrCheckpointed {
+		t.Errorf("expected ErrCheckpointed, got %v", err)
+	}
+
+	// Checkpoints survive reopening the collection.
+	c.Close()
+	c, err = OpenCollection("/tmp/test_checkpoints.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoints, err := c.Checkpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checkpoints) != 1 || checkpoints[0].Name != "before" {
+		t.Fatalf("unexpected checkpoints %v", checkpoints)
+	}
+	snap, err := c.OpenCheckpoint("before")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Version() != checkpoints[0].Version {
+		t.Errorf("expected version %d, got %d", checkpoints[0].Version, snap.Version())
+	}
+	if val, err := snap.Get("a"); err != nil || val != "1" {
+		t.Errorf("expected value %v, got %v, %v", "1", val, err)
+	}
+
+	if err = c.DropCheckpoint("before"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.OpenCheckpoint("before"); err != ErrDoesNotExist {
+		t.Errorf("expected ErrDoesNotExist, got %v", err)
+	}
+	if err = c.DropCheckpoint("before"); err != ErrDoesNotExist {
+		t.Errorf("expected ErrDoesNotExist, got %v", err)
+	}
+	if err = c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Versions from after a compaction can be read.
+	c.Set("b", "1")
+	version := c.Version()
+	if val, err := c.GetAt("b", version); err != nil || val != "1" {
+		t.Errorf("expected value %v, got %v, %v", "1", val, err)
+	}
+	if err = c.Checkpoint("after"); err != nil {
+		t.Fatal(err)
+	}
+	snap, err = c.OpenCheckpoint("after")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := snap.Get("b"); err != nil || val != "1" {
+		t.Errorf("expected value %v, got %v, %v", "1", val, err)
+	}
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	c, err := NewCollection("/tmp/test_incremental.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	c.Set("a", "1")
+	c.Set("b", "2")
+
+	full := bytes.NewBuffer(nil)
+	version, err := c.Backup(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Restore(full, "/tmp/test_incremental_restored.lm2"); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := OpenCollection("/tmp/test_incremental_restored.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Destroy()
+
+	c.Set("a", "updated")
+	c.Delete("b")
+	c.Set("c", "3")
+	incremental := bytes.NewBuffer(nil)
+	if version, err = c.BackupSince(version, incremental); err != nil {
+		t.Fatal(err)
+	}
+	if version != c.Version() {
+		t.Errorf("expected backup version %d, got %d", c.Version(), version)
+	}
+
+	// A truncated backup changes nothing.
+	truncated := bytes.NewReader(incremental.Bytes()[:incremental.Len()-1])
+	if err = restored.ApplyIncremental(truncated); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt, got %v", err)
+	}
+	if val, _ := restored.Get("a"); val != "1" {
+		t.Errorf("expected value %v, got %v", "1", val)
+	}
+
+	if err = restored.ApplyIncremental(incremental); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"a": "updated", "c": "3"}
+	for key, value := range expected {
+		if val, err := restored.Get(key); err != nil || val != value {
+			t.Errorf("expected value %v for key %v, got %v, %v", value, key, val, err)
+		}
+	}
+	if _, err = restored.Get("b"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	// Nothing changed since the last backup.
+	incremental.Reset()
+	if _, err = c.BackupSince(version, incremental); err != nil {
+		t.Fatal(err)
+	}
+	if err = restored.ApplyIncremental(incremental); err != nil {
+		t.Fatal(err)
+	}
+	if n := verifyOrder(t, restored); n != 2 {
+		t.Errorf("expected 2 records, got %d", n)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	c, err := NewCollection("/tmp/test_index.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	// Index users by city.
+	byCity := func(key, value string) []string {
+		return []string{value}
+	}
+	c.Set("alice", "paris")
+	if err = c.CreateIndex("city", byCity); err != nil {
+		t.Fatal(err)
+	}
+	c.Set("bob", "paris")
+	c.Set("carol", "rome")
+	c.Set("alice", "rome")
+
+	lookup := func(city string) []string {
+		cur, err := c.IndexCursor("city", city)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for cur.Next() {
+			keys = append(keys, cur.Key())
+		}
+		return keys
+	}
+	if keys := fmt.Sprint(lookup("paris")); keys != "[bob]" {
+		t.Errorf("expected [bob], got %v", keys)
+	}
+	if keys := fmt.Sprint(lookup("rome")); keys != "[alice carol]" {
+		t.Errorf("expected [alice carol], got %v", keys)
+	}
+	c.Delete("carol")
+	if keys := fmt.Sprint(lookup("rome")); keys != "[alice]" {
+		t.Errorf("expected [alice], got %v", keys)
+	}
+
+	// Creating the index again after reopening doesn't change it.
+	c.Close()
+	c, err = OpenCollection("/tmp/test_index.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.IndexCursor("city", "rome"); err != ErrDoesNotExist {
+		t.Errorf("expected ErrDoesNotExist, got %v", err)
+	}
+	countRecords := func() int {
+		n := 0
+		c.WalkRecords(func(RecordInfo) bool {
+			n++
+			return true
+		})
+		return n
+	}
+	records := countRecords()
+	if err = c.CreateIndex("city", byCity); err != nil {
+		t.Fatal(err)
+	}
+	if keys := fmt.Sprint(lookup("paris")); keys != "[bob]" {
+		t.Errorf("expected [bob], got %v", keys)
+	}
+	if n := countRecords(); n != records {
+		t.Errorf("expected %d records, got %d", records, n)
+	}
+
+	if err = c.DropIndex("city"); err != nil {
+		t.Fatal(err)
+	}
+	if n := verifyOrder(t, c); n != 2 {
+		t.Errorf("expected 2 records, got %d", n)
+	}
+}
+
+func TestReservedKeys(t *testing.T) {
+	c, err := NewCollection("/tmp/test_reserved_keys.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	err = c.CreateIndex("value", func(key, value string) []string {
+		return []string{value}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeduplication(1)
+	if err = c.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Updates of reserved keys fail.
+	if err = c.SetMeta("schema", "1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{indexKeyPrefix, indexKeyPrefix + "user", metaKeyPrefix + "user", blobKeyPrefix + "user"} {
+		if err = c.Set(key, "1"); !errors.Is(err, ErrReservedKey) {
+			t.Errorf("expected ErrReservedKey setting %q, got %v", key, err)
+		}
+		if err = c.Delete(key); !errors.Is(err, ErrReservedKey) {
+			t.Errorf("expected ErrReservedKey deleting %q, got %v", key, err)
+		}
+		tx := c.Begin()
+		tx.Set(key, "1")
+		if _, err = tx.Commit(); !errors.Is(err, ErrReservedKey) {
+			t.Errorf("expected ErrReservedKey committing %q, got %v", key, err)
+		}
+	}
+
+	// Only the collection's own keys are returned and counted.
+	check := func() {
+		t.Helper()
+		if n := verifyOrder(t, c); n != 2 {
+			t.Errorf("expected %d records, got %d", 2, n)
+		}
+		if n, err := c.Len(); err != nil || n != 2 {
+			t.Errorf("expected length %d, got %d, %v", 2, n, err)
+		}
+		buf := bytes.NewBuffer(nil)
+		if err := c.Export(buf, JSONLines); err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Count(buf.String(), "\n"); lines != 2 {
+			t.Errorf("expected %d exported records, got %d", 2, lines)
+		}
+		changes, err := c.ChangesSince(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, change := range changes {
+			if isReservedKey(change.Key) {
+				t.Errorf("unexpected change of %q", change.Key)
+			}
+		}
+		cur, err := c.IndexCursor("value", "2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cur.Next() || cur.Key() != "b" {
+			t.Errorf("expected b to be indexed, got %q", cur.Key())
+		}
+		cur.Close()
+		if value, err := c.GetMeta("schema"); err != nil || value != "1" {
+			t.Errorf("expected metadata %v, got %v, %v", "1", value, err)
+		}
+	}
+	check()
+	if err = c.DeleteRange("", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	if err = c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+func TestTuple(t *testing.T) {
+	epoch := time.Unix(0, 0).UTC()
+	// Tuples in sorted order.
+	tuples := [][]interface{}{
+		{""},
+		{"a"},
+		{"a", "x"},
+		{"a", int64(-5)},
+		{"a", int64(3)},
+		{"a\x00"},
+		{"a\x00b"},
+		{"b"},
+		{int64(math.MinInt64)},
+		{int64(-1)},
+		{int64(0)},
+		{int64(256)},
+		{math.Inf(-1)},
+		{-2.5},
+		{-0.5},
+		{0.0},
+		{0.5},
+		{1e10},
+		{epoch.Add(-time.Hour)},
+		{epoch},
+		{epoch.Add(time.Nanosecond)},
+	}
+	var prev string
+	for i, tuple := range tuples {
+		key, err := EncodeTuple(tuple...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 && key <= prev {
+			t.Errorf("expected %v to sort after %v", tuple, tuples[i-1])
+		}
+		prev = key
+
+		decoded, err := DecodeTuple(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(decoded) != fmt.Sprint(tuple) {
+			t.Errorf("expected %v, got %v", tuple, decoded)
+		}
+	}
+
+	intKey, _ := EncodeTuple("a", 3)
+	int64Key, _ := EncodeTuple("a", int64(3))
+	if intKey != int64Key {
+		t.Error("expected ints to encode like int64s")
+	}
+	if _, err := EncodeTuple(uint8(1)); err == nil {
+		t.Error("expected an error for an unsupported type")
+	}
+	if _, err := DecodeTuple("\x02abc"); err != ErrInvalidTuple {
+		t.Errorf("expected ErrInvalidTuple, got %v", err)
+	}
+}
+
+func TestRecordMeta(t *testing.T) {
+	c, err := NewCollection("/tmp/test_record_meta.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	c.SetCompression(FlateCompression)
+
+	meta := map[string]string{"content-type": "text/plain", "owner": ""}
+	if err = c.SetWithMeta("a", strings.Repeat("a", 100), meta); err != nil {
+		t.Fatal(err)
+	}
+	c.Set("b", "2")
+	if err = c.SetWithMeta("c", "3", map[string]string{"x": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	c.Set("c", "updated")
+
+	check := func(c *Collection) {
+		t.Helper()
+		value, got, err := c.GetWithMeta("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != strings.Repeat("a", 100) || !reflect.DeepEqual(got, meta) {
+			t.Errorf("expected %v, got %v", meta, got)
+		}
+		for _, key := range []string{"b", "c"} {
+			if _, got, err = c.GetWithMeta(key); err != nil || got != nil {
+				t.Errorf("expected no metadata for key %v, got %v, %v", key, got, err)
+			}
+		}
+		cur, err := c.NewCursor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cur.Next() || !reflect.DeepEqual(cur.Meta(), meta) {
+			t.Errorf("expected %v, got %v", meta, cur.Meta())
+		}
+		cur.Close()
+	}
+	check(c)
+
+	// Metadata survives compaction and backups.
+	if err = c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check(c)
+	buf := bytes.NewBuffer(nil)
+	if _, err = c.Backup(buf); err != nil {
+		t.Fatal(err)
+	}
+	if err = Restore(buf, "/tmp/test_record_meta_restored.lm2"); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := OpenCollection("/tmp/test_record_meta_restored.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Destroy()
+	check(restored)
+}
+
+func TestDeduplication(t *testing.T) {
+	c, err := NewCollection("/tmp/test_dedup.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	c.SetDeduplication(64)
+
+	value := strings.Repeat("shared", 100)
+	for _, key := range []string{"a", "b", "c"} {
+		if err = c.Set(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Set("d", "small")
+	meta := map[string]string{"content-type": "text/plain"}
+	if err = c.SetWithMeta("e", value, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	blobs := func(c *Collection) int {
+		t.Helper()
+		count := 0
+		err := c.WalkRecords(func(info RecordInfo) bool {
+			if isBlobKey(info.Key) && info.Deleted == 0 {
+				count++
+			}
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+	check := func(c *Collection) {
+		t.Helper()
+		for _, key := range []string{"a", "b", "c"} {
+			if got, err := c.Get(key); err != nil || got != value {
+				t.Errorf("expected shared value for key %v, got %d bytes, %v", key, len(got), err)
+			}
+		}
+		if got, err := c.Get("d"); err != nil || got != "small" {
+			t.Errorf("expected small, got %v, %v", got, err)
+		}
+		got, gotMeta, err := c.GetWithMeta("e")
+		if err != nil || got != value || !reflect.DeepEqual(gotMeta, meta) {
+			t.Errorf("expected shared value with %v, got %d bytes with %v, %v", meta, len(got), gotMeta, err)
+		}
+		if n := blobs(c); n != 1 {
+			t.Errorf("expected 1 shared value, got %d", n)
+		}
+	}
+	check(c)
+
+	if err = c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check(c)
+	c.Close()
+	c, err = OpenCollection("/tmp/test_dedup.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeduplication(64)
+	check(c)
+
+	// Unreferenced values are removed by compaction.
+	wb := NewWriteBatch()
+	wb.Delete("a")
+	wb.Delete("b")
+	wb.Delete("e")
+	wb.Set("c", "replaced")
+	if _, err = c.Update(wb); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if n := blobs(c); n != 0 {
+		t.Errorf("expected no shared values after compaction, got %d", n)
+	}
+	if got, err := c.Get("c"); err != nil || got != "replaced" {
+		t.Errorf("expected replaced, got %v, %v", got, err)
+	}
+}
+
+func TestEncryptedDeduplication(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	c, err := NewEncryptedCollection("/tmp/test_encrypted_dedup.lm2", 100, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	c.SetDeduplication(64)
+
+	value := strings.Repeat("secret", 100)
+	if err = c.Set("a", value); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// Keys aren't encrypted, so the key of the shared value must not
+	// be the plain hash of the value.
+	data, err := ioutil.ReadFile("/tmp/test_encrypted_dedup.lm2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(value))
+	if bytes.Contains(data, sum[:]) {
+		t.Error("expected the shared value's key not to contain its hash")
+	}
+
+	c, err = OpenEncryptedCollection("/tmp/test_encrypted_dedup.lm2", 100, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeduplication(64)
+	if err = c.Set("b", value); err != nil {
+		t.Fatal(err)
+	}
+	blobs := 0
+	err = c.WalkRecords(func(info RecordInfo) bool {
+		if isBlobKey(info.Key) {
+			blobs++
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blobs != 1 {
+		t.Errorf("expected 1 shared value, got %d", blobs)
+	}
+	for _, key := range []string{"a", "b"} {
+		if got, err := c.Get(key); err != nil || got != value {
+			t.Errorf("expected shared value for key %v, got %d bytes, %v", key, len(got), err)
+		}
+	}
+}
+
+type testTracerKey struct{}
+
+type testTracer struct {
+	sync.Mutex
+	spans []string
+}
+
+func (tr *testTracer) StartOperation(ctx context.Context, op Operation) func(err error) {
+	name, _ := ctx.Value(testTracerKey{}).(string)
+	return func(err error) {
+		tr.Lock()
+		defer tr.Unlock()
+		tr.spans = append(tr.spans, fmt.Sprintf("%v %v %v", name, op, err))
+	}
+}
+
+func TestTracer(t *testing.T) {
+	c, err := NewCollection("/tmp/test_tracer.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	tr := &testTracer{}
+	c.SetTracer(tr)
+
+	ctx := context.WithValue(context.Background(), testTracerKey{}, "request")
+	if err = c.SetContext(ctx, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.GetContext(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	c.Get("b")
+	if err = c.PutIfAbsent("a", "2"); err != ErrConflict {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+	if err = c.CompactContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"request update <nil>",
+		"request get <nil>",
+		" get <nil>",
+		" update " + ErrConflict.Error(),
+		// Compaction syncs the collection before it completes.
+		" sync <nil>",
+		"request compact <nil>",
+	}
+	if !reflect.DeepEqual(tr.spans, expected) {
+		t.Errorf("expected %q, got %q", expected, tr.spans)
+	}
+
+	// Spans end when backpressure has nothing to compact.
+	tr.spans = nil
+	if err = c.compactIfOver(); err != nil {
+		t.Fatal(err)
+	}
+	if expected = []string{" compact <nil>"}; !reflect.DeepEqual(tr.spans, expected) {
+		t.Errorf("expected %q, got %q", expected, tr.spans)
+	}
+}
+
+type testLogger struct {
+	sync.Mutex
+	messages []string
+}
+
+func (l *testLogger) log(level, msg string, args ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.messages = append(l.messages, fmt.Sprintln(append([]interface{}{level, msg}, args...)...))
+}
+
+func (l *testLogger) Info(msg string, args ...interface{})  { l.log("INFO", msg, args...) }
+func (l *testLogger) Warn(msg string, args ...interface{})  { l.log("WARN", msg, args...) }
+func (l *testLogger) Error(msg string, args ...interface{}) { l.log("ERROR", msg, args...) }
+
+func TestLogger(t *testing.T) {
+	file := "/tmp/test_logger.lm2"
+	os.Remove(file)
+	os.Remove(file + ".wal")
+	l := &testLogger{}
+	c, err := Open(file, WithLogger(l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { c.Destroy() }()
+	if err = c.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// Data written after the last commit is dropped when reopening.
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("incomplete"))
+	f.Close()
+	if c, err = Open(file, WithLogger(l)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Open("/tmp/test_logger_missing.lm2", WithReadOnly(), WithLogger(l)); err != ErrDoesNotExist {
+		t.Fatalf("expected ErrDoesNotExist, got %v", err)
+	}
+
+	expected := []string{
+		"INFO lm2: opened collection",
+		"INFO lm2: compacted collection",
+		"WARN lm2: recovered from an incomplete write",
+		"INFO lm2: opened collection",
+		"ERROR lm2: error opening collection",
+	}
+	if len(l.messages) != len(expected) {
+		t.Fatalf("expected %q, got %q", expected, l.messages)
+	}
+	for i, prefix := range expected {
+		if !strings.HasPrefix(l.messages[i], prefix) {
+			t.Errorf("expected message %d to start with %q, got %q", i, prefix, l.messages[i])
+		}
+	}
+	if !strings.Contains(l.messages[2], " truncated_bytes 10 ") {
+		t.Errorf("expected 10 truncated bytes, got %q", l.messages[2])
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	c, err := NewCollection("/tmp/test_size_limits.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	// Keys that don't fit in a record are rejected instead of truncated.
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	wb.Set(strings.Repeat("k", MaxKeySize+1), "1")
+	if _, err = c.Update(wb); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("expected ErrKeyTooLarge, got %v", err)
+	}
+	if _, err = c.Get("a"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+	if err = c.Set(strings.Repeat("k", MaxKeySize), "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Delete(strings.Repeat("k", MaxKeySize)); err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetSizeLimits(4, 8)
+	if err = c.Set("abcd", "12345678"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set("abcde", "1"); !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("expected ErrKeyTooLarge, got %v", err)
+	}
+	if err = c.Set("a", "123456789"); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("expected ErrValueTooLarge, got %v", err)
+	}
+	if err = c.SetWithMeta("a", "1234", map[string]string{"type": "x"}); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("expected ErrValueTooLarge for metadata, got %v", err)
+	}
+
+	// Index entries aren't limited.
+	err = c.CreateIndex("values", func(key, value string) []string {
+		return []string{value}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := c.Get("abcd"); err != nil || value != "12345678" {
+		t.Errorf("expected 12345678, got %v, %v", value, err)
+	}
+}
+
+func TestClone(t *testing.T) {
+	c, err := NewCollection("/tmp/test_clone.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	if err = c.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	version := c.Version()
+	if err = c.Set("a", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Clone("/tmp/test_clone.lm2"); err == nil {
+		t.Fatal("expected an error cloning onto the collection's own file")
+	}
+	if err = c.Clone("/tmp/test_clone_copy.lm2"); err != nil {
+		t.Fatal(err)
+	}
+	clone, err := OpenCollection("/tmp/test_clone_copy.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clone.Destroy()
+
+	// The clone has the same versions and is independent.
+	if value, err := clone.Get("a"); err != nil || value != "2" {
+		t.Errorf("expected 2, got %v, %v", value, err)
+	}
+	if value, err := clone.GetAt("a", version); err != nil || value != "1" {
+		t.Errorf("expected 1 at version %d, got %v, %v", version, value, err)
+	}
+	if err = clone.Set("b", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Get("b"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	// In-memory collections can be cloned to files.
+	m, err := OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if err = m.Set("m", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Clone("/tmp/test_clone_memory.lm2"); err != nil {
+		t.Fatal(err)
+	}
+	clone, err = OpenCollection("/tmp/test_clone_memory.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clone.Destroy()
+	if value, err := clone.Get("m"); err != nil || value != "1" {
+		t.Errorf("expected 1, got %v, %v", value, err)
+	}
+}
+
+type testPairs struct {
+	keys, values []string
+	i            int
+}
+
+func (p *testPairs) Next() bool    { p.i++; return p.i <= len(p.keys) }
+func (p *testPairs) Key() string   { return p.keys[p.i-1] }
+func (p *testPairs) Value() string { return p.values[p.i-1] }
+func (p *testPairs) Err() error    { return nil }
+
+func TestBulkLoad(t *testing.T) {
+	c, err := NewCollection("/tmp/test_bulk_load.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { c.Destroy() }()
+	c.SetCompression(FlateCompression)
+	c.SetChecksums(true)
+	err = c.CreateIndex("parity", func(key, value string) []string {
+		return []string{fmt.Sprint(len(value) % 2)}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const N = 5000
+	pairs := &testPairs{}
+	for i := 0; i < N; i++ {
+		pairs.keys = append(pairs.keys, fmt.Sprintf("%08d", i))
+		pairs.values = append(pairs.values, strings.Repeat("v", i%10))
+	}
+
+	// Unsorted input leaves the collection unchanged.
+	unsorted := &testPairs{keys: []string{"b", "a"}, values: []string{"1", "2"}}
+	if _, err = c.BulkLoad(unsorted); !errors.Is(err, ErrUnsorted) {
+		t.Fatalf("expected ErrUnsorted, got %v", err)
+	}
+	if _, err = c.BulkLoad(pairs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.BulkLoad(&testPairs{keys: []string{"z"}, values: []string{"1"}}); err != ErrNotEmpty {
+		t.Errorf("expected ErrNotEmpty, got %v", err)
+	}
+
+	check := func(c *Collection) {
+		t.Helper()
+		// Cursors skip the index entries.
+		if n := verifyOrder(t, c); n != N {
+			t.Errorf("expected %d records, got %d", N, n)
+		}
+		for i := 0; i < N; i += 97 {
+			if value, err := c.Get(pairs.keys[i]); err != nil || value != pairs.values[i] {
+				t.Errorf("expected %q for key %v, got %q, %v", pairs.values[i], pairs.keys[i], value, err)
+			}
+		}
+		report, err := c.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !report.OK() {
+			t.Fatalf("unexpected problems: %v", report.Problems)
+		}
+	}
+	check(c)
+	cur, err := c.IndexCursor("parity", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexed := 0
+	for cur.Next() {
+		indexed++
+	}
+	if indexed != N/2 {
+		t.Errorf("expected %d indexed keys, got %d", N/2, indexed)
+	}
+
+	c.Close()
+	if c, err = OpenCollection("/tmp/test_bulk_load.lm2", 100); err != nil {
+		t.Fatal(err)
+	}
+	check(c)
+}
+
+func TestExpireNow(t *testing.T) {
+	c, err := NewCollection("/tmp/test_expire_now.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	wb.SetWithTTL("a", "1", time.Millisecond)
+	wb.SetWithTTL("b", "2", time.Millisecond)
+	wb.SetWithTTL("c", "3", time.Hour)
+	wb.Set("d", "4")
+	if _, err = c.Update(wb); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if n, err := c.ExpireNow(); err != nil || n != 2 {
+		t.Fatalf("expected 2 expired keys, got %d, %v", n, err)
+	}
+	if c.garbage != 2 {
+		t.Errorf("expected expired records to count as garbage, got %d", c.garbage)
+	}
+	if n, err := c.ExpireNow(); err != nil || n != 0 {
+		t.Errorf("expected no expired keys, got %d, %v", n, err)
+	}
+	for key, expected := range map[string]string{"c": "3", "d": "4"} {
+		if value, err := c.Get(key); err != nil || value != expected {
+			t.Errorf("expected %v, got %v, %v", expected, value, err)
+		}
+	}
+
+	// Index entries expire with their keys, but aren't counted.
+	err = c.CreateIndex("value", func(key, value string) []string {
+		return []string{value}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.SetWithTTL("f", "6", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if n, err := c.ExpireNow(); err != nil || n != 1 {
+		t.Errorf("expected 1 expired key, got %d, %v", n, err)
+	}
+
+	// Keys are expired in the background.
+	c.SetExpiryInterval(time.Millisecond)
+	if err = c.SetWithTTL("e", "5", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		history, err := c.History("e")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if history[0].Deleted != 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected e to be expired in the background")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCursorTracking(t *testing.T) {
+	c, err := NewCollection("/tmp/test_cursor_tracking.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err = c.Set(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cur, err := c.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := c.Stats().OpenCursors; n != 1 {
+		t.Errorf("expected 1 open cursor, got %d", n)
+	}
+	if err = c.Compact(); err != ErrCursorsOpen {
+		t.Errorf("expected ErrCursorsOpen, got %v", err)
+	}
+
+	c.SetMaxOpenCursors(1)
+	if _, err = c.NewCursor(); err != ErrTooManyCursors {
+		t.Errorf("expected ErrTooManyCursors, got %v", err)
+	}
+	c.SetMaxOpenCursors(0)
+
+	cur.Next()
+	cur.Close()
+	if cur.Next() || cur.Err() != ErrCursorClosed {
+		t.Errorf("expected ErrCursorClosed, got %v", cur.Err())
+	}
+	if n := c.Stats().OpenCursors; n != 0 {
+		t.Errorf("expected no open cursors, got %d", n)
+	}
+
+	// Cursors are released when they reach the end.
+	cur, err = c.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cur.Next() {
+	}
+	if cur.Err() != nil {
+		t.Fatal(cur.Err())
+	}
+	if err = c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	cur, err = c.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := c.InvalidateCursors(); n != 1 {
+		t.Errorf("expected 1 invalidated cursor, got %d", n)
+	}
+	if cur.Next() || cur.Err() != ErrCursorInvalidated {
+		t.Errorf("expected ErrCursorInvalidated, got %v", cur.Err())
+	}
+	if n := c.Stats().OpenCursors; n != 0 {
+		t.Errorf("expected no open cursors, got %d", n)
+	}
+
+	// Snapshots are counted as open until they are closed,
+	// and can't be read once the collection is compacted.
+	snap := c.Snapshot()
+	if err = c.Compact(); err != ErrCursorsOpen {
+		t.Errorf("expected ErrCursorsOpen, got %v", err)
+	}
+	tx := c.Begin()
+	snap.Close()
+	if err = c.Compact(); err != ErrCursorsOpen {
+		t.Errorf("expected ErrCursorsOpen, got %v", err)
+	}
+	tx.Rollback()
+	if err = c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = snap.Get("a"); err != ErrCursorInvalidated {
+		t.Errorf("expected ErrCursorInvalidated, got %v", err)
+	}
+	if _, err = snap.NewCursor(); err != ErrCursorInvalidated {
+		t.Errorf("expected ErrCursorInvalidated, got %v", err)
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	c, err := NewCollection("/tmp/test_group_commit.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	if err = c.Set("x", "1"); err != nil {
+		t.Fatal(err)
+	}
+	c.SetMergeFunc(func(key, existing string, found bool, operands []string) (string, error) {
+		return existing + strings.Join(operands, ""), nil
+	})
+	c.SetSizeLimits(0, 10)
+	c.SetGroupCommit(4, time.Second)
+
+	batches := []*WriteBatch{}
+	for i := 0; i < 8; i++ {
+		wb := NewWriteBatch()
+		wb.Set(fmt.Sprint("key", i), fmt.Sprint(i))
+		batches = append(batches, wb)
+	}
+	batches[1].Merge("x", "2")
+	batches[2].Delete("key0")
+	// This one makes its group fail and is committed on its own.
+	batches[5].Set("large", strings.Repeat("v", 20))
+
+	versions := make([]int64, len(batches))
+	errs := make([]error, len(batches))
+	wg := sync.WaitGroup{}
+	for i, wb := range batches {
+		wg.Add(1)
+		go func(i int, wb *WriteBatch) {
+			defer wg.Done()
+			versions[i], errs[i] = c.Update(wb)
+		}(i, wb)
+	}
+	wg.Wait()
+
+	distinct := map[int64]struct{}{}
+	for i, err := range errs {
+		if i == 5 {
+			if !errors.Is(err, ErrValueTooLarge) {
+				t.Errorf("expected ErrValueTooLarge, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		distinct[versions[i]] = struct{}{}
+	}
+	if len(distinct) >= len(batches)-1 {
+		t.Errorf("expected updates to be grouped, got %d versions", len(distinct))
+	}
+	for i := 1; i < 8; i++ {
+		if i == 5 {
+			if _, err := c.Get("key5"); err != ErrKeyNotFound {
+				t.Errorf("expected key5 not to be set, got %v", err)
+			}
+			continue
+		}
+		if value, err := c.Get(fmt.Sprint("key", i)); err != nil || value != fmt.Sprint(i) {
+			t.Errorf("expected %d, got %v, %v", i, value, err)
+		}
+	}
+	if value, err := c.Get("x"); err != nil || value != "12" {
+		t.Errorf("expected 12, got %v, %v", value, err)
+	}
+
+	// Merges into a key deleted by the group aren't combined with it.
+	wb := NewWriteBatch()
+	wb.Delete("x")
+	other := NewWriteBatch()
+	other.Merge("x", "3")
+	if wb.add(other) {
+		t.Error("expected batches not to be combined")
+	}
+}
+
+func TestCollectionMeta(t *testing.T) {
+	c, err := NewCollection("/tmp/test_collection_meta.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = c.GetMeta("schema"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+	if err = c.SetMeta("schema", "3"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Metadata is committed with data in a WriteBatch.
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	wb.SetMeta("cursor", "a")
+	version, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Get("schema"); err != ErrKeyNotFound {
+		t.Errorf("expected metadata not to be a key, got %v", err)
+	}
+
+	c.Close()
+	c, err = OpenCollection("/tmp/test_collection_meta.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	for name, expected := range map[string]string{"schema": "3", "cursor": "a"} {
+		if value, err := c.GetMeta(name); err != nil || value != expected {
+			t.Errorf("expected %v, got %v, %v", expected, value, err)
+		}
+	}
+	if value, err := c.Snapshot().Get(metaKey("cursor")); err != nil || value != "a" {
+		t.Errorf("expected a, got %v, %v", value, err)
+	}
+	if c.LastCommit != version {
+		t.Errorf("expected version %d, got %d", version, c.LastCommit)
+	}
+
+	// Metadata changes are carried by incremental backups,
+	// but aren't changes of keys.
+	full := bytes.NewBuffer(nil)
+	version, err = c.Backup(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Restore(full, "/tmp/test_collection_meta_restored.lm2"); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := OpenCollection("/tmp/test_collection_meta_restored.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Destroy()
+
+	if err = c.Delete(metaKey("schema")); !errors.Is(err, ErrReservedKey) {
+		t.Errorf("expected ErrReservedKey, got %v", err)
+	}
+	if err = c.DeleteMeta("schema"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.SetMeta("cursor", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if changes, err := c.ChangesSince(version); err != nil || len(changes) != 0 {
+		t.Errorf("expected no changes, got %v, %v", changes, err)
+	}
+	incremental := bytes.NewBuffer(nil)
+	if _, err = c.BackupSince(version, incremental); err != nil {
+		t.Fatal(err)
+	}
+	if err = restored.ApplyIncremental(incremental); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*Collection{c, restored} {
+		if _, err = c.GetMeta("schema"); err != ErrKeyNotFound {
+			t.Errorf("expected ErrKeyNotFound, got %v", err)
+		}
+		if value, err := c.GetMeta("cursor"); err != nil || value != "b" {
+			t.Errorf("expected b, got %v, %v", value, err)
+		}
+	}
+}
+
+func TestCloseWithTimeout(t *testing.T) {
+	c, err := NewCollection("/tmp/test_close_with_timeout.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2000; i++ {
+		if err = c.Set(fmt.Sprint(i%100), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := c.NewAsyncWriter(1000, time.Hour)
+	w.Set("buffered", "1")
+
+	// Start a compaction in the background and don't wait for it.
+	c.SetAutoCompact(1)
+	if err = c.Set("0", "last"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.CloseWithTimeout(0); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Errorf("expected buffered writes to be committed by Close, got %v", err)
+	}
+
+	c, err = OpenCollection("/tmp/test_close_with_timeout.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	for key, expected := range map[string]string{"0": "last", "99": "1999", "buffered": "1"} {
+		if value, err := c.Get(key); err != nil || value != expected {
+			t.Errorf("expected %v, got %v, %v", expected, value, err)
+		}
+	}
+}
+
+func TestTruncatedFiles(t *testing.T) {
+	const file = "/tmp/test_truncated_files.lm2"
+	c, err := Open(file, WithChecksums(), WithDeduplication(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		wb := NewWriteBatch()
+		wb.Set(fmt.Sprint("key", i%4), strings.Repeat("v", 20))
+		wb.SetWithMeta(fmt.Sprint("meta", i), fmt.Sprint(i), map[string]string{"n": fmt.Sprint(i)})
+		wb.Delete(fmt.Sprint("meta", i-1))
+		if _, err = c.Update(wb); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Close()
+	files := map[string][]byte{}
+	for _, suffix := range []string{"", ".wal", ".cache"} {
+		if files[suffix], err = ioutil.ReadFile(file + suffix); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		for suffix := range files {
+			os.Remove(file + suffix)
+		}
+	}()
+
+	// Every prefix of each file must open, or fail to open, and be
+	// read without panicking.
+	read := func() {
+		c, err := Open(file)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Verify()
+		c.History("key0")
+		c.ChangesSince(0)
+		c.WalkRecords(func(RecordInfo) bool { return true })
+		for i := 0; i < 10; i++ {
+			c.GetWithMeta(fmt.Sprint("meta", i))
+		}
+		cur, err := c.NewCursor()
+		if err != nil {
+			return
+		}
+		for cur.Next() {
+			cur.Meta()
+		}
+	}
+	for truncated, data := range files {
+		for n := 0; n < len(data); n++ {
+			for suffix, contents := range files {
+				if suffix == truncated {
+					contents = contents[:n]
+				}
+				if err = ioutil.WriteFile(file+suffix, contents, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Fatalf("panic reading %s truncated to %d bytes: %v", file+truncated, n, r)
+					}
+				}()
+				read()
+			}()
+		}
+	}
+}
+
+func TestLockKey(t *testing.T) {
+	c, err := NewCollection("/tmp/test_lock_key.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	// Concurrent read-modify-write cycles don't lose increments.
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				unlocker, err := c.LockKey("counter")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n := 0
+				if value, err := c.Get("counter"); err == nil {
+					n, _ = strconv.Atoi(value)
+				}
+				if err = c.Set("counter", strconv.Itoa(n+1)); err != nil {
+					t.Error(err)
+				}
+				unlocker.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if value, err := c.Get("counter"); err != nil || value != "100" {
+		t.Errorf("expected 100, got %v, %v", value, err)
+	}
+
+	unlocker, err := c.LockKey("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err = c.LockKeyContext(ctx, "a"); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	other, err := c.LockKey("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Unlock()
+	unlocker.Unlock()
+	// Unlocking again does nothing.
+	unlocker.Unlock()
+	if unlocker, err = c.LockKeyContext(ctx, "a"); err == nil {
+		t.Error("expected the done context to be checked")
+	}
+	if unlocker, err = c.LockKey("a"); err != nil {
+		t.Fatal(err)
+	}
+	unlocker.Unlock()
+	if n := len(c.keyLocks.locks); n != 0 {
+		t.Errorf("expected no key locks, got %d", n)
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	c, err := NewCollection("/tmp/test_analyze.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	for _, key := range []string{"a1", "a2", "b1"} {
+		if err = c.Set(key, "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = c.Set("a1", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Delete("b1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.SetWithTTL("c1", "1", time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.SetMeta("m", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := c.Analyze(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(recordHeaderSize + 2 + 1)
+	got := map[string]SpaceUsage{
+		"live":        report.Live,
+		"metadata":    report.Metadata,
+		"expired":     report.Expired,
+		"deleted":     report.Deleted,
+		"overwritten": report.Overwritten,
+	}
+	for name, usage := range map[string]SpaceUsage{
+		"live":        {2, 2 * size},
+		"metadata":    {1, size + 1},
+		"expired":     {1, size},
+		"deleted":     {1, size},
+		"overwritten": {1, size},
+	} {
+		if got[name] != usage {
+			t.Errorf("expected %s %+v, got %+v", name, usage, got[name])
+		}
+	}
+	if report.FileSize != c.LastCommit || report.Uncommitted != 0 {
+		t.Errorf("expected a file size of %d, got %d with %d uncommitted",
+			c.LastCommit, report.FileSize, report.Uncommitted)
+	}
+	if report.Commits != c.LastCommit-fileHeaderSize-6*size-1 {
+		t.Errorf("unexpected commit overhead %d", report.Commits)
+	}
+	prefixes := []PrefixUsage{
+		{Prefix: "a", Live: SpaceUsage{2, 2 * size}, Garbage: SpaceUsage{1, size}},
+		{Prefix: "b", Garbage: SpaceUsage{1, size}},
+		{Prefix: "c", Garbage: SpaceUsage{1, size}},
+	}
+	if !reflect.DeepEqual(report.Prefixes, prefixes) {
+		t.Errorf("expected prefixes %+v, got %+v", prefixes, report.Prefixes)
+	}
+}
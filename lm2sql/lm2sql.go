@@ -0,0 +1,330 @@
+// Package lm2sql is a database/sql driver for lm2 collections.
+//
+// The driver is registered as "lm2", and its data source name is the
+// path of a collection's data file, which is created if it doesn't exist:
+//
+//	db, err := sql.Open("lm2", "/var/lib/app/data.lm2")
+//
+// A *sql.DB opened this way shares a single collection between its
+// connections and closes it when the DB is closed. Use OpenDB to use a
+// collection that is already open.
+//
+// Statements are key-value operations with arguments given as
+// placeholders, which must be strings or byte slices:
+//
+//	GET ?          returns the key and value of a key, or no rows
+//	PUT ?, ?       sets a key to a value
+//	DELETE ?       deletes a key
+//	SCAN           returns every key and value in key order
+//	SCAN ?         returns the keys greater than or equal to a key
+//	SCAN ?, ?      returns the keys in a range, excluding the end
+//
+// Rows have the columns "key" and "value". Statements in a transaction
+// run in an lm2.Tx, which SCAN is not supported in.
+package lm2sql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/Preetam/lm2"
+)
+
+func init() {
+	sql.Register("lm2", Driver{})
+}
+
+// errScanInTx is returned by SCAN statements in transactions.
+var errScanInTx = errors.New("lm2sql: SCAN is not supported in transactions")
+
+// Driver is the lm2 database/sql driver.
+type Driver struct{}
+
+// Open returns a connection to the collection at dsn, which
+// is closed with the connection.
+func (Driver) Open(dsn string) (driver.Conn, error) {
+	c, err := lm2.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{collection: c, owned: true}, nil
+}
+
+// OpenConnector implements driver.DriverContext.
+func (Driver) OpenConnector(dsn string) (driver.Connector, error) {
+	return &connector{dsn: dsn}, nil
+}
+
+// OpenDB returns a *sql.DB that uses c. Closing the DB doesn't close c.
+func OpenDB(c *lm2.Collection) *sql.DB {
+	return sql.OpenDB(&connector{collection: c})
+}
+
+// connector shares a collection between connections. If dsn
+// is set, the collection is opened by the first connection and
+// closed with the connector.
+type connector struct {
+	dsn string
+
+	lock       sync.Mutex
+	collection *lm2.Collection
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.collection == nil {
+		collection, err := lm2.Open(c.dsn)
+		if err != nil {
+			return nil, err
+		}
+		c.collection = collection
+	}
+	return &conn{collection: c.collection}, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return Driver{}
+}
+
+// Close is called when the DB is closed.
+func (c *connector) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.dsn == "" || c.collection == nil {
+		return nil
+	}
+	err := c.collection.Close()
+	c.collection = nil
+	return err
+}
+
+type conn struct {
+	collection *lm2.Collection
+	// owned is true if the collection is closed with the connection.
+	owned bool
+	tx    *lm2.Tx
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	fields := strings.Fields(strings.Replace(query, ",", " ", -1))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("lm2sql: empty statement")
+	}
+	s := &stmt{conn: c, op: strings.ToUpper(fields[0])}
+	for _, field := range fields[1:] {
+		if field != "?" {
+			return nil, fmt.Errorf("lm2sql: invalid argument %q in %q; arguments must be placeholders", field, query)
+		}
+		s.numInput++
+	}
+
+	valid := false
+	switch s.op {
+	case "GET", "DELETE":
+		valid = s.numInput == 1
+	case "PUT":
+		valid = s.numInput == 2
+	case "SCAN":
+		valid = s.numInput <= 2
+	default:
+		return nil, fmt.Errorf("lm2sql: unsupported statement %q", query)
+	}
+	if !valid {
+		return nil, fmt.Errorf("lm2sql: wrong number of arguments in %q", query)
+	}
+	return s, nil
+}
+
+func (c *conn) Close() error {
+	if c.tx != nil {
+		c.tx.Rollback()
+		c.tx = nil
+	}
+	if c.owned {
+		return c.collection.Close()
+	}
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	if c.tx != nil {
+		return nil, errors.New("lm2sql: transaction already in progress")
+	}
+	c.tx = c.collection.Begin()
+	return &tx{conn: c}, nil
+}
+
+type tx struct {
+	conn *conn
+}
+
+func (t *tx) Commit() error {
+	lmTx := t.conn.tx
+	t.conn.tx = nil
+	_, err := lmTx.Commit()
+	return err
+}
+
+func (t *tx) Rollback() error {
+	t.conn.tx.Rollback()
+	t.conn.tx = nil
+	return nil
+}
+
+type stmt struct {
+	conn     *conn
+	op       string
+	numInput int
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+func (s *stmt) NumInput() int {
+	return s.numInput
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	c, tx := s.conn.collection, s.conn.tx
+	switch s.op {
+	case "PUT":
+		if tx != nil {
+			err = tx.Set(strs[0], strs[1])
+		} else {
+			err = c.Set(strs[0], strs[1])
+		}
+	case "DELETE":
+		if tx != nil {
+			err = tx.Delete(strs[0])
+		} else {
+			err = c.Delete(strs[0])
+		}
+	default:
+		return nil, fmt.Errorf("lm2sql: %s returns rows; use Query", s.op)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Deleting a key that doesn't exist is not an error, like
+	// Collection.Delete, so both count as one key written.
+	return driver.RowsAffected(1), nil
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	c, tx := s.conn.collection, s.conn.tx
+	switch s.op {
+	case "GET":
+		var value string
+		if tx != nil {
+			value, err = tx.Get(strs[0])
+		} else {
+			value, err = c.Get(strs[0])
+		}
+		if err == lm2.ErrKeyNotFound {
+			return &pairRows{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &pairRows{pairs: [][2]string{{strs[0], value}}}, nil
+	case "SCAN":
+		if tx != nil {
+			return nil, errScanInTx
+		}
+		start, end := "", ""
+		if len(strs) > 0 {
+			start = strs[0]
+		}
+		if len(strs) > 1 {
+			end = strs[1]
+		}
+		cur, err := c.Range(start, end)
+		if err != nil {
+			return nil, err
+		}
+		return &cursorRows{cursor: cur}, nil
+	default:
+		return nil, fmt.Errorf("lm2sql: %s doesn't return rows; use Exec", s.op)
+	}
+}
+
+// stringArgs converts statement arguments to strings.
+func stringArgs(args []driver.Value) ([]string, error) {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			strs[i] = v
+		case []byte:
+			strs[i] = string(v)
+		default:
+			return nil, fmt.Errorf("lm2sql: argument %d is a %T, not a string or []byte", i+1, arg)
+		}
+	}
+	return strs, nil
+}
+
+var columns = []string{"key", "value"}
+
+// pairRows returns rows of key-value pairs.
+type pairRows struct {
+	pairs [][2]string
+}
+
+func (r *pairRows) Columns() []string {
+	return columns
+}
+
+func (r *pairRows) Close() error {
+	return nil
+}
+
+func (r *pairRows) Next(dest []driver.Value) error {
+	if len(r.pairs) == 0 {
+		return io.EOF
+	}
+	dest[0], dest[1] = r.pairs[0][0], r.pairs[0][1]
+	r.pairs = r.pairs[1:]
+	return nil
+}
+
+// cursorRows returns the records of a cursor as rows.
+type cursorRows struct {
+	cursor *lm2.Cursor
+}
+
+func (r *cursorRows) Columns() []string {
+	return columns
+}
+
+func (r *cursorRows) Close() error {
+	r.cursor.Close()
+	return nil
+}
+
+func (r *cursorRows) Next(dest []driver.Value) error {
+	if !r.cursor.Next() {
+		if err := r.cursor.Err(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	dest[0], dest[1] = r.cursor.Key(), r.cursor.Value()
+	return nil
+}
@@ -0,0 +1,96 @@
+package lm2sql
+
+import (
+	"database/sql"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func scan(t *testing.T, rows *sql.Rows, err error) []string {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var pairs []string
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			t.Fatal(err)
+		}
+		pairs = append(pairs, key+"="+value)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return pairs
+}
+
+func TestDriver(t *testing.T) {
+	file := "/tmp/test_lm2sql.lm2"
+	defer os.Remove(file)
+	defer os.Remove(file + ".wal")
+	defer os.Remove(file + ".cache")
+	db, err := sql.Open("lm2", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if _, err = db.Exec("PUT ?, ?", key, "value of "+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = db.Exec("DELETE ?", "d"); err != nil {
+		t.Fatal(err)
+	}
+
+	var value string
+	if err = db.QueryRow("GET ?", "a").Scan(new(string), &value); err != nil || value != "value of a" {
+		t.Errorf("expected value of a, got %q, %v", value, err)
+	}
+	if err = db.QueryRow("GET ?", "d").Scan(new(string), &value); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+	rows, err := db.Query("SCAN ?, ?", "b", "d")
+	if got := scan(t, rows, err); !reflect.DeepEqual(got, []string{"b=value of b", "c=value of c"}) {
+		t.Errorf("unexpected scan results %q", got)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tx.Exec("PUT ?, ?", "a", "updated"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tx.Query("SCAN"); err != errScanInTx {
+		t.Errorf("expected errScanInTx, got %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tx.Exec("DELETE ?", "a"); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+	rows, err = db.Query("SCAN")
+	if got := scan(t, rows, err); !reflect.DeepEqual(got, []string{"a=updated", "b=value of b", "c=value of c"}) {
+		t.Errorf("unexpected scan results %q", got)
+	}
+
+	for _, query := range []string{"SELECT * FROM kv", "GET", "PUT ?", "GET a"} {
+		if _, err = db.Exec(query, "x"); err == nil {
+			t.Errorf("expected an error for %q", query)
+		}
+	}
+	if _, err = db.Exec("PUT ?, ?", 1, "x"); err == nil {
+		t.Error("expected an error for a non-string argument")
+	}
+}
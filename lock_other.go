@@ -0,0 +1,11 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package lm2
+
+import "os"
+
+// lockFile does nothing on platforms without file locking.
+func lockFile(f *os.File, shared bool) error {
+	return nil
+}
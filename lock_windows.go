@@ -0,0 +1,48 @@
+//go:build windows
+// +build windows
+
+package lm2
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errorLockViolation syscall.Errno = 33
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+// lockOffset is the offset of the byte that lockFile locks. Byte range
+// locks on Windows are mandatory, so a byte past the end of any data
+// file is locked to leave the file readable and writable through other
+// handles, the way advisory locks do elsewhere.
+const lockOffset = 1<<32 - 1
+
+// lockFile takes a lock on f without blocking. The lock is shared if
+// shared is true and exclusive otherwise, and is released when f is
+// closed. It only excludes other locks, not reads or writes of f.
+func lockFile(f *os.File, shared bool) error {
+	flags := uint32(lockfileFailImmediately)
+	if !shared {
+		flags |= lockfileExclusiveLock
+	}
+	overlapped := syscall.Overlapped{
+		Offset:     lockOffset,
+		OffsetHigh: lockOffset,
+	}
+	r, _, err := procLockFileEx.Call(f.Fd(), uintptr(flags), 0, 1, 0,
+		uintptr(unsafe.Pointer(&overlapped)))
+	if r != 0 {
+		return nil
+	}
+	if err == errorLockViolation {
+		return ErrLocked
+	}
+	return err
+}
@@ -0,0 +1,53 @@
+package lm2
+
+import (
+	"errors"
+	"time"
+)
+
+// Logger receives operational events from a collection: opens, recovery
+// from incomplete writes, compactions, and corruption found by any
+// operation. Messages are constant strings and args are alternating keys
+// and values, so a *slog.Logger can be used as a Logger. Implementations
+// must be safe for concurrent use.
+type Logger interface {
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// SetLogger sets the logger of the collection. It should be called
+// before the collection is used concurrently. Open and recovery events
+// are only logged for collections opened by Open with WithLogger. A nil
+// l disables logging.
+func (c *Collection) SetLogger(l Logger) {
+	c.logger = l
+}
+
+// logOpen logs the opening of c and anything that had to be recovered.
+func (c *Collection) logOpen() {
+	if c.logger == nil {
+		return
+	}
+	if c.discardedWALEntry || c.truncatedBytes > 0 {
+		c.logger.Warn("lm2: recovered from an incomplete write", "file", c.name,
+			"truncated_bytes", c.truncatedBytes, "discarded_wal_entry", c.discardedWALEntry)
+	}
+	c.logger.Info("lm2: opened collection", "file", c.name,
+		"version", c.LastCommit, "read_only", c.readOnly)
+}
+
+// logOperation logs the completion of op if it is worth logging.
+func (c *Collection) logOperation(op Operation, d time.Duration, err error) {
+	if c.logger == nil {
+		return
+	}
+	switch {
+	case errors.Is(err, ErrCorrupt):
+		c.logger.Error("lm2: corruption detected", "file", c.name, "op", string(op), "error", err)
+	case op == OpCompact && err != nil:
+		c.logger.Error("lm2: compaction failed", "file", c.name, "error", err)
+	case op == OpCompact:
+		c.logger.Info("lm2: compacted collection", "file", c.name, "duration", d)
+	}
+}
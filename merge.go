@@ -0,0 +1,100 @@
+package lm2
+
+import (
+	"errors"
+	"time"
+)
+
+// MergeFunc combines the existing value of key with merge operands,
+// oldest first, and returns the new value. found is false if key
+// doesn't exist. An error aborts the update containing the merges.
+type MergeFunc func(key, existing string, found bool, operands []string) (string, error)
+
+// ErrNoMergeFunc is returned when applying merges
+// without a MergeFunc.
+var ErrNoMergeFunc = errors.New("lm2: no merge function set")
+
+// SetMergeFunc sets the function used to apply merges.
+func (c *Collection) SetMergeFunc(fn MergeFunc) {
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+	c.mergeFunc = fn
+}
+
+// Merge merges operand into key in a single update. The existing value
+// is read and combined with operand while the update is applied, so
+// concurrent merges are never lost and the caller doesn't need to read
+// the value first. Compaction only sees the merged value.
+func (c *Collection) Merge(key, operand string) error {
+	wb := NewWriteBatch()
+	wb.Merge(key, operand)
+	_, err := c.Update(wb)
+	return err
+}
+
+// applyMerges turns the merges in wb into sets.
+// The caller must hold metaLock.
+func (c *Collection) applyMerges(wb *WriteBatch) error {
+	if len(wb.merges) == 0 {
+		return nil
+	}
+	if c.mergeFunc == nil {
+		return ErrNoMergeFunc
+	}
+
+	for key, operands := range wb.merges {
+		existing, found := wb.sets[key]
+		expires, meta := wb.expires[key], wb.meta[key]
+		if !found {
+			rec, err := c.latestRecord(key)
+			if err != nil {
+				return err
+			}
+			if rec != nil {
+				existing, expires, meta, found = rec.Value, rec.Expires, rec.Meta, true
+			}
+		}
+		value, err := c.mergeFunc(key, existing, found, operands)
+		if err != nil {
+			return err
+		}
+		// The merged value keeps the expiration time and metadata.
+		wb.setExpiresAt(key, value, expires)
+		wb.setRecordMeta(key, meta)
+	}
+	wb.merges = map[string][]string{}
+	return nil
+}
+
+// latest returns the value and expiration time of the latest version
+// of key. The caller must hold metaLock.
+func (c *Collection) latest(key string) (string, int64, bool, error) {
+	latest, err := c.latestRecord(key)
+	if err != nil || latest == nil {
+		return "", 0, false, err
+	}
+	return latest.Value, latest.Expires, true, nil
+}
+
+// latestRecord returns the record of the latest version of key, or nil
+// if key doesn't exist. The caller must hold metaLock.
+func (c *Collection) latestRecord(key string) (*record, error) {
+	cur := &Cursor{
+		collection: c,
+		snapshot:   c.LastCommit,
+		now:        time.Now().UnixNano(),
+		reserved:   true,
+	}
+	var latest *record
+	err := c.walkKey(key, func(rec *record) bool {
+		if cur.visible(rec) {
+			latest = rec
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return latest, nil
+}
@@ -0,0 +1,123 @@
+package lm2
+
+import (
+	"context"
+	"encoding/binary"
+	"sort"
+)
+
+// recordMeta is set in the flags of a record whose value is
+// prefixed with its metadata.
+const recordMeta = 1 << 4
+
+// SetWithMeta adds key => value with metadata meta to the WriteBatch.
+// The metadata is stored with the value and returned by GetWithMeta and
+// Cursor.Meta. Setting key again without metadata removes it.
+func (wb *WriteBatch) SetWithMeta(key, value string, meta map[string]string) {
+	wb.Set(key, value)
+	wb.setRecordMeta(key, meta)
+}
+
+// setRecordMeta sets the metadata of the value of key in the WriteBatch.
+func (wb *WriteBatch) setRecordMeta(key string, meta map[string]string) {
+	if len(meta) == 0 {
+		delete(wb.meta, key)
+		return
+	}
+	copied := make(map[string]string, len(meta))
+	for k, v := range meta {
+		copied[k] = v
+	}
+	wb.meta[key] = copied
+}
+
+// SetWithMeta sets key to value with metadata meta in a single update.
+// Metadata is meant for small attributes of a value, such as its content
+// type; it counts towards the size of the value.
+func (c *Collection) SetWithMeta(key, value string, meta map[string]string) error {
+	wb := NewWriteBatch()
+	wb.SetWithMeta(key, value, meta)
+	_, err := c.Update(wb)
+	return err
+}
+
+// GetWithMeta returns the value and metadata associated with key. The
+// metadata is nil if the value was set without any. ErrKeyNotFound is
+// returned if key does not exist.
+func (c *Collection) GetWithMeta(key string) (string, map[string]string, error) {
+	done := c.startOperation(context.Background(), OpGet)
+	value, meta, err := c.latestSnapshot().GetWithMeta(key)
+	if err == ErrKeyNotFound {
+		done(nil)
+	} else {
+		done(err)
+	}
+	return value, meta, err
+}
+
+// Meta returns the metadata of the current record, or nil if it has none
+// or the cursor is not valid. The returned map may be modified.
+func (c *Cursor) Meta() map[string]string {
+	if !c.Valid() || len(c.current.Meta) == 0 {
+		return nil
+	}
+	meta := make(map[string]string, len(c.current.Meta))
+	for k, v := range c.current.Meta {
+		meta[k] = v
+	}
+	return meta
+}
+
+// encodeMeta encodes meta as a uvarint count followed by each name and
+// value, length-prefixed, in name order.
+func encodeMeta(meta map[string]string) string {
+	names := make([]string, 0, len(meta))
+	for name := range meta {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	count := [binary.MaxVarintLen64]byte{}
+	n := binary.PutUvarint(count[:], uint64(len(names)))
+	b := append([]byte(nil), count[:n]...)
+	for _, name := range names {
+		b = append(b, lengthPrefixed(name)...)
+		b = append(b, lengthPrefixed(meta[name])...)
+	}
+	return string(b)
+}
+
+// decodeMeta decodes the metadata encoded by encodeMeta at the start of
+// value, and returns it with the rest of value. It returns false if the
+// metadata is invalid.
+func decodeMeta(value string) (map[string]string, string, bool) {
+	b := []byte(value)
+	next := func() (string, bool) {
+		length, n := binary.Uvarint(b)
+		if n <= 0 || length > uint64(len(b)-n) {
+			return "", false
+		}
+		s := string(b[n : n+int(length)])
+		b = b[n+int(length):]
+		return s, true
+	}
+
+	count, n := binary.Uvarint(b)
+	if n <= 0 || count > uint64(len(b)) {
+		return nil, "", false
+	}
+	b = b[n:]
+	meta := make(map[string]string, count)
+	for i := uint64(0); i < count; i++ {
+		name, ok := next()
+		if !ok {
+			return nil, "", false
+		}
+		metaValue, ok := next()
+		if !ok {
+			return nil, "", false
+		}
+		meta[name] = metaValue
+	}
+	return meta, string(b), true
+}
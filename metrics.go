@@ -0,0 +1,72 @@
+package lm2
+
+import (
+	"expvar"
+	"time"
+)
+
+// Operation identifies a collection operation reported to Metrics.
+type Operation string
+
+// Operations reported to Metrics.
+const (
+	OpGet     Operation = "get"
+	OpUpdate  Operation = "update"
+	OpCompact Operation = "compact"
+	OpSync    Operation = "sync"
+)
+
+// Metrics receives operation metrics from a collection. It can be used
+// to feed counters and latency histograms into a metrics system such as
+// Prometheus or expvar. Implementations must be safe for concurrent use.
+type Metrics interface {
+	// ObserveOperation is called when an operation completes.
+	ObserveOperation(op Operation, d time.Duration, err error)
+	// ObserveRecords is called after every commit with the number
+	// of records set and deleted by it.
+	ObserveRecords(sets, deletes int)
+}
+
+// SetMetrics sets the metrics hook of the collection. It should be
+// called before the collection is used concurrently. A nil m
+// disables metrics.
+func (c *Collection) SetMetrics(m Metrics) {
+	c.metrics = m
+}
+
+func (c *Collection) observe(op Operation, start time.Time, err error) {
+	if c.metrics != nil {
+		c.metrics.ObserveOperation(op, time.Since(start), err)
+	}
+}
+
+// ExpvarMetrics is a Metrics implementation that publishes
+// counters to an expvar.Map.
+//
+// For every operation, the map contains the number of calls ("<op>"),
+// failed calls ("<op>_errors"), and the total time spent in nanoseconds
+// ("<op>_nanos"). The number of records set and deleted are published
+// as "sets" and "deletes".
+type ExpvarMetrics struct {
+	m *expvar.Map
+}
+
+// NewExpvarMetrics returns an ExpvarMetrics publishing to m.
+func NewExpvarMetrics(m *expvar.Map) *ExpvarMetrics {
+	return &ExpvarMetrics{m: m}
+}
+
+// ObserveOperation implements Metrics.
+func (e *ExpvarMetrics) ObserveOperation(op Operation, d time.Duration, err error) {
+	e.m.Add(string(op), 1)
+	e.m.Add(string(op)+"_nanos", int64(d))
+	if err != nil {
+		e.m.Add(string(op)+"_errors", 1)
+	}
+}
+
+// ObserveRecords implements Metrics.
+func (e *ExpvarMetrics) ObserveRecords(sets, deletes int) {
+	e.m.Add("sets", int64(sets))
+	e.m.Add("deletes", int64(deletes))
+}
@@ -0,0 +1,303 @@
+package lm2
+
+import (
+	"crypto/cipher"
+	"time"
+)
+
+// defaultCacheSize is the cache size used by Open
+// unless WithCacheSize is given.
+const defaultCacheSize = 100
+
+// Option configures a collection opened with Open.
+type Option func(*options)
+
+type options struct {
+	cacheSize         int
+	readOnly          bool
+	sharedLock        bool
+	syncPolicy        SyncPolicy
+	syncInterval      time.Duration
+	compression       Compression
+	checksums         bool
+	dedupMinSize      int
+	maxKeySize        int
+	maxValueSize      int
+	encryptionKey     []byte
+	autoCompact       int
+	expiryInterval    time.Duration
+	groupCommitSize   int
+	groupCommitWindow time.Duration
+	maxOpenCursors    int
+	metrics           Metrics
+	tracer            Tracer
+	logger            Logger
+	falsePositiveRate float64
+	mergeFunc         MergeFunc
+	backpressure      BackpressurePolicy
+	maxGarbageRatio   float64
+	onStall           func(time.Duration)
+}
+
+// WithCacheSize sets the size of the collection cache.
+func WithCacheSize(size int) Option {
+	return func(o *options) {
+		o.cacheSize = size
+	}
+}
+
+// WithReadOnly opens the collection like OpenCollectionReadOnly.
+func WithReadOnly() Option {
+	return func(o *options) {
+		o.readOnly = true
+	}
+}
+
+// WithSharedLock makes a read-only collection take a shared lock on its
+// data file, so that it can't be opened for writing until every
+// read-only collection holding the lock has been closed. Opening fails
+// with ErrLocked if the collection is already open for writing.
+// Without a lock, read-only collections can be opened alongside
+// a writer.
+func WithSharedLock() Option {
+	return func(o *options) {
+		o.sharedLock = true
+	}
+}
+
+// WithSyncPolicy sets the sync policy like SetSyncPolicy.
+func WithSyncPolicy(policy SyncPolicy, interval time.Duration) Option {
+	return func(o *options) {
+		o.syncPolicy = policy
+		o.syncInterval = interval
+	}
+}
+
+// WithCompression sets the value compression like SetCompression.
+func WithCompression(compression Compression) Option {
+	return func(o *options) {
+		o.compression = compression
+	}
+}
+
+// WithChecksums enables record checksums like SetChecksums.
+func WithChecksums() Option {
+	return func(o *options) {
+		o.checksums = true
+	}
+}
+
+// WithDeduplication stores values of at least minSize bytes
+// once like SetDeduplication.
+func WithDeduplication(minSize int) Option {
+	return func(o *options) {
+		o.dedupMinSize = minSize
+	}
+}
+
+// WithEncryptionKey encrypts record values with key like
+// NewEncryptedCollection. The same key must be given every
+// time the collection is opened.
+func WithEncryptionKey(key []byte) Option {
+	return func(o *options) {
+		o.encryptionKey = key
+	}
+}
+
+// WithAutoCompact enables automatic compaction like SetAutoCompact.
+func WithAutoCompact(threshold int) Option {
+	return func(o *options) {
+		o.autoCompact = threshold
+	}
+}
+
+// WithExpiryInterval enables background expiry like SetExpiryInterval.
+func WithExpiryInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.expiryInterval = interval
+	}
+}
+
+// WithGroupCommit enables group commit like SetGroupCommit.
+func WithGroupCommit(size int, window time.Duration) Option {
+	return func(o *options) {
+		o.groupCommitSize = size
+		o.groupCommitWindow = window
+	}
+}
+
+// WithMaxOpenCursors limits the number of open cursors
+// like SetMaxOpenCursors.
+func WithMaxOpenCursors(n int) Option {
+	return func(o *options) {
+		o.maxOpenCursors = n
+	}
+}
+
+// WithMetrics sets the metrics hook like SetMetrics.
+func WithMetrics(m Metrics) Option {
+	return func(o *options) {
+		o.metrics = m
+	}
+}
+
+// WithTracer sets the tracer like SetTracer.
+func WithTracer(t Tracer) Option {
+	return func(o *options) {
+		o.tracer = t
+	}
+}
+
+// WithLogger sets the logger like SetLogger.
+func WithLogger(l Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// WithSizeLimits sets the key and value size limits like SetSizeLimits.
+func WithSizeLimits(maxKeySize, maxValueSize int) Option {
+	return func(o *options) {
+		o.maxKeySize = maxKeySize
+		o.maxValueSize = maxValueSize
+	}
+}
+
+// WithBloomFilter enables a bloom filter like SetBloomFilter.
+func WithBloomFilter(falsePositiveRate float64) Option {
+	return func(o *options) {
+		o.falsePositiveRate = falsePositiveRate
+	}
+}
+
+// WithMergeFunc sets the merge function like SetMergeFunc.
+func WithMergeFunc(fn MergeFunc) Option {
+	return func(o *options) {
+		o.mergeFunc = fn
+	}
+}
+
+// WithBackpressure sets the backpressure policy like SetBackpressure.
+func WithBackpressure(policy BackpressurePolicy, maxGarbageRatio float64, onStall func(time.Duration)) Option {
+	return func(o *options) {
+		o.backpressure = policy
+		o.maxGarbageRatio = maxGarbageRatio
+		o.onStall = onStall
+	}
+}
+
+// Open opens the collection with a data file at file, configured with
+// opts. A new collection is created if file doesn't exist, unless
+// the collection is opened read-only.
+func Open(file string, opts ...Option) (*Collection, error) {
+	o := newOptions(opts)
+
+	aead, err := o.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	var c *Collection
+	if o.readOnly {
+		c, err = openCollectionReadOnly(file, o.cacheSize, aead, o.sharedLock)
+	} else {
+		c, err = openCollection(file, o.cacheSize, aead)
+		if err == ErrDoesNotExist {
+			c, err = newCollection(file, o.cacheSize, aead)
+		}
+	}
+	if err != nil {
+		if o.logger != nil {
+			o.logger.Error("lm2: error opening collection", "file", file, "error", err)
+		}
+		return nil, err
+	}
+
+	if err = o.apply(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.logOpen()
+	return c, nil
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		cacheSize: defaultCacheSize,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// aead returns the cipher used to encrypt values, if any.
+func (o *options) aead() (cipher.AEAD, error) {
+	if o.encryptionKey == nil {
+		return nil, nil
+	}
+	return newAEAD(o.encryptionKey)
+}
+
+// apply configures c with the options that can be changed
+// after a collection is opened.
+func (o *options) apply(c *Collection) error {
+	if !c.readOnly {
+		c.SetSyncPolicy(o.syncPolicy, o.syncInterval)
+		c.SetAutoCompact(o.autoCompact)
+		c.SetExpiryInterval(o.expiryInterval)
+		c.SetGroupCommit(o.groupCommitSize, o.groupCommitWindow)
+		c.SetBackpressure(o.backpressure, o.maxGarbageRatio, o.onStall)
+	}
+	if err := c.SetCompression(o.compression); err != nil {
+		return err
+	}
+	c.SetChecksums(o.checksums)
+	c.SetDeduplication(o.dedupMinSize)
+	c.SetSizeLimits(o.maxKeySize, o.maxValueSize)
+	c.SetMetrics(o.metrics)
+	c.SetTracer(o.tracer)
+	c.SetLogger(o.logger)
+	c.SetMergeFunc(o.mergeFunc)
+	c.SetMaxOpenCursors(o.maxOpenCursors)
+	if o.falsePositiveRate != 0 {
+		return c.SetBloomFilter(o.falsePositiveRate)
+	}
+	return nil
+}
+
+// OpenMemory creates a new collection that is kept in memory instead of
+// in files, configured with opts. It has the same API as a collection in
+// files, but its records are lost when it is closed. It is meant for
+// tests and ephemeral caches.
+func OpenMemory(opts ...Option) (*Collection, error) {
+	o := newOptions(opts)
+	if o.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	aead, err := o.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := newMemoryCollection(o.cacheSize, aead)
+	if err != nil {
+		return nil, err
+	}
+	if err = o.apply(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func newMemoryCollection(cacheSize int, aead cipher.AEAD) (*Collection, error) {
+	c, err := initCollection(newMemFile(":memory:"), newWALFile(newMemFile(":memory:.wal")),
+		newCacheFile(cacheSize, newMemFile(":memory:.cache")), aead)
+	if err != nil {
+		return nil, err
+	}
+	c.memory = true
+	return c, nil
+}
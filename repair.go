@@ -0,0 +1,172 @@
+package lm2
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// RepairReport describes the result of Repair.
+type RepairReport struct {
+	// Records is the number of live records recovered.
+	Records int
+	// Problems lists the parts of the data file that were skipped.
+	Problems []RecordProblem
+}
+
+// Repair salvages the readable records of a damaged data file at file into
+// a new collection at repaired, configured with opts. The data file is
+// scanned from start to end without following the record chain, so that
+// records remain reachable when the chain or the file header is damaged.
+// Unreadable regions are skipped up to the next commit. The WAL and cache
+// of the damaged collection are ignored and file is not modified. Files
+// of older format versions have to be upgraded by opening them first.
+//
+// The latest readable version of every key is recovered unless it was
+// deleted, or overwritten by a version that can't be read. Records of a
+// commit that was interrupted before it completed are not recovered.
+func Repair(file, repaired string, opts ...Option) (*RepairReport, error) {
+	o := newOptions(opts)
+	aead, err := o.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrDoesNotExist
+		}
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// Records are read with a throwaway collection so that values
+	// are checked, decrypted and decompressed like any other read.
+	src := &Collection{
+		f:    f,
+		aead: aead,
+		cache: &recordCache{
+			cache:    map[int64]*record{},
+			readOnly: true,
+		},
+	}
+	report := &RepairReport{}
+	if err = src.readFileHeader(); err != nil {
+		report.addProblem(0, "unreadable file header: %v", err)
+	} else if src.Flags&flagEncrypted != 0 && aead == nil {
+		return nil, ErrEncrypted
+	} else if src.FormatVersion < formatVersion {
+		// Older records can only be read by upgrading the file.
+		return nil, ErrIncompatibleVersion
+	}
+
+	latest := src.salvage(info.Size(), report)
+
+	dst, err := newCollection(repaired, o.cacheSize, aead)
+	if err != nil {
+		return nil, err
+	}
+	if err = o.apply(dst); err != nil {
+		dst.Close()
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(latest))
+	for key, rec := range latest {
+		if rec.Deleted == 0 && !isBlobKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	wb := NewWriteBatch()
+	for i, key := range keys {
+		wb.setExpiresAt(key, latest[key].Value, latest[key].Expires)
+		wb.setRecordMeta(key, latest[key].Meta)
+		if (i+1)%compactionBatchSize == 0 || i == len(keys)-1 {
+			if _, err = dst.update(wb, nil); err != nil {
+				dst.Close()
+				return nil, err
+			}
+			wb = NewWriteBatch()
+		}
+	}
+	report.Records = len(keys)
+	return report, dst.Close()
+}
+
+// salvage scans the data file up to size and returns the latest
+// readable version of every key. Unreadable regions are added to report.
+func (c *Collection) salvage(size int64, report *RepairReport) map[string]*record {
+	latest := map[string]*record{}
+	var pending []*record
+	keep := func() {
+		for _, rec := range pending {
+			latest[rec.Key] = rec
+		}
+		pending = pending[:0]
+	}
+
+	for offset := int64(fileHeaderSize); offset+sentinelSize <= size; {
+		if sentinel, ok := c.sentinelAt(offset); ok {
+			keep()
+			offset += sentinel.size()
+			continue
+		}
+		rec, end, err := c.salvageRecord(offset, size)
+		if err == nil {
+			pending = append(pending, rec)
+			offset = end
+			continue
+		}
+
+		// Keep what was read of the damaged commit
+		// and skip to the start of the next one.
+		report.addProblem(offset, "%v", err)
+		keep()
+		next := offset + 1
+		for next+sentinelSize <= size {
+			if _, ok := c.sentinelAt(next); ok {
+				break
+			}
+			next++
+		}
+		offset = next
+	}
+	// Records after the last sentinel were never committed.
+	return latest
+}
+
+// salvageRecord reads the record at offset and returns it with its end
+// offset. Records that don't fit in size bytes are rejected before their
+// key and value are read.
+func (c *Collection) salvageRecord(offset, size int64) (*record, int64, error) {
+	buf := [recordHeaderSize]byte{}
+	if offset+recordHeaderSize > size {
+		return nil, 0, errCorrupt("partial record header at offset %d", offset)
+	}
+	if _, err := c.f.ReadAt(buf[:], offset); err != nil {
+		return nil, 0, err
+	}
+	header := decodeRecordHeader(buf[:])
+	end := offset + recordHeaderSize + int64(header.KeyLen) + int64(header.ValLen)
+	if end > size {
+		return nil, 0, errCorrupt("record at offset %d extends past the end of the file", offset)
+	}
+	rec, err := c.readRecord(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rec, end, nil
+}
+
+func (r *RepairReport) addProblem(offset int64, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, RecordProblem{
+		Offset:  offset,
+		Problem: fmt.Sprintf(format, args...),
+	})
+}
@@ -0,0 +1,72 @@
+package lm2
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrReservedKey is returned, wrapped with the key, by updates of keys
+// with a prefix reserved for the collection's own entries.
+var ErrReservedKey = errors.New("lm2: key has a reserved prefix")
+
+// reservedKeyPrefixes are the prefixes of the keys the collection
+// stores its own entries under.
+var reservedKeyPrefixes = []string{
+	indexKeyPrefix,
+	metaKeyPrefix,
+	blobKeyPrefix,
+}
+
+// isReservedKey returns true if key starts with a reserved prefix.
+func isReservedKey(key string) bool {
+	for _, prefix := range reservedKeyPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// reservedKeyError returns the error for an update of the reserved key.
+func reservedKeyError(key string) error {
+	return fmt.Errorf("%w: %q", ErrReservedKey, truncateKey(key))
+}
+
+// checkReserved returns an error if wb updates a reserved key
+// other than its metadata entries.
+func (wb *WriteBatch) checkReserved() error {
+	for key := range wb.sets {
+		if _, ok := wb.entries[key]; !ok && isReservedKey(key) {
+			return reservedKeyError(key)
+		}
+	}
+	for key := range wb.merges {
+		if isReservedKey(key) {
+			return reservedKeyError(key)
+		}
+	}
+	for key := range wb.deletes {
+		if _, ok := wb.entries[key]; !ok && isReservedKey(key) {
+			return reservedKeyError(key)
+		}
+	}
+	return nil
+}
+
+// countReserved returns the number of live records with reserved keys.
+// The caller must hold metaLock.
+func (c *Collection) countReserved() (int, error) {
+	n := 0
+	for _, prefix := range reservedKeyPrefixes {
+		err := c.walkRange(prefix, prefixEnd(prefix), func(rec *record) {
+			if rec.Deleted == 0 {
+				n++
+			}
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
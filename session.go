@@ -0,0 +1,104 @@
+package lm2
+
+import (
+	"sync"
+	"time"
+)
+
+// Session gives a caller read-your-writes consistency over writes made
+// through an AsyncWriter. Reads made through a session see every write
+// made through it, flushing the writer first if those writes haven't
+// been committed yet, and fail while the writer has a commit error that
+// hasn't been cleared. Writes made by others through the same writer
+// may or may not be visible. A Session is safe for concurrent use.
+type Session struct {
+	collection *Collection
+	writer     *AsyncWriter
+
+	lock sync.Mutex
+	// seq is the writer's seq of the session's last write.
+	seq uint64
+}
+
+// NewSession returns a session that writes through w.
+func (w *AsyncWriter) NewSession() *Session {
+	return &Session{
+		collection: w.collection,
+		writer:     w,
+	}
+}
+
+// Set buffers a set of key to value.
+func (s *Session) Set(key, value string) error {
+	return s.write(s.writer.Set(key, value))
+}
+
+// SetWithTTL buffers a set of key to value that expires ttl
+// after SetWithTTL is called.
+func (s *Session) SetWithTTL(key, value string, ttl time.Duration) error {
+	return s.write(s.writer.SetWithTTL(key, value, ttl))
+}
+
+// Delete buffers a delete of key.
+func (s *Session) Delete(key string) error {
+	return s.write(s.writer.Delete(key))
+}
+
+func (s *Session) write(err error) error {
+	if err != nil {
+		return err
+	}
+	// Other writes may have been buffered since, which
+	// only means the session might flush them early.
+	seq := s.writer.lastSeq()
+	s.lock.Lock()
+	if seq > s.seq {
+		s.seq = seq
+	}
+	s.lock.Unlock()
+	return nil
+}
+
+// Snapshot returns a snapshot of the collection that includes
+// every write made through the session.
+func (s *Session) Snapshot() (*Snapshot, error) {
+	if err := s.catchUp(); err != nil {
+		return nil, err
+	}
+	return s.collection.Snapshot(), nil
+}
+
+// catchUp commits the writes made through the session that haven't
+// been committed yet. It returns the writer's error if a commit failed,
+// as the session's writes may have been lost.
+func (s *Session) catchUp() error {
+	if err := s.writer.failed(); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	seq := s.seq
+	s.lock.Unlock()
+	if !s.writer.flushed(seq) {
+		return s.writer.Flush()
+	}
+	return nil
+}
+
+// Get returns the value associated with key, including writes
+// made through the session. ErrKeyNotFound is returned if key
+// does not exist.
+func (s *Session) Get(key string) (string, error) {
+	if err := s.catchUp(); err != nil {
+		return "", err
+	}
+	return s.collection.Get(key)
+}
+
+// NewCursor returns a new cursor over a snapshot that includes
+// every write made through the session.
+func (s *Session) NewCursor() (*Cursor, error) {
+	if err := s.catchUp(); err != nil {
+		return nil, err
+	}
+	return s.collection.NewCursor()
+}
@@ -0,0 +1,61 @@
+package lm2
+
+import "time"
+
+// CloseWithTimeout closes the collection like Close, but waits at most d
+// for a background compaction to complete. A compaction still running
+// after d is cancelled, which leaves the collection as it was before the
+// compaction, so shutting down doesn't have to wait for a long compaction
+// and doesn't lose any writes. Like Close, it commits the writes buffered
+// by AsyncWriters, stops background expiry and syncing, and syncs pending
+// writes before it closes the files. It can be called from the goroutine
+// that handles a shutdown signal while other goroutines use the
+// collection, whose operations return ErrClosed once it has closed.
+func (c *Collection) CloseWithTimeout(d time.Duration) error {
+	c.stopBackground()
+
+	stopped := make(chan struct{})
+	go func() {
+		c.background.Wait()
+		close(stopped)
+	}()
+	timer := time.NewTimer(d)
+	select {
+	case <-stopped:
+	case <-timer.C:
+		c.backgroundLock.Lock()
+		if c.cancelCompaction != nil {
+			c.cancelCompaction()
+		}
+		c.backgroundLock.Unlock()
+		<-stopped
+	}
+	timer.Stop()
+	return c.close()
+}
+
+// stopBackground stops background compactions from being started.
+func (c *Collection) stopBackground() {
+	c.backgroundLock.Lock()
+	c.closing = true
+	c.backgroundLock.Unlock()
+}
+
+// flushAsyncWriters commits the writes buffered by open AsyncWriters
+// and returns the first error.
+func (c *Collection) flushAsyncWriters() error {
+	c.backgroundLock.Lock()
+	writers := make([]*AsyncWriter, 0, len(c.asyncWriters))
+	for w := range c.asyncWriters {
+		writers = append(writers, w)
+	}
+	c.backgroundLock.Unlock()
+
+	var err error
+	for _, w := range writers {
+		if flushErr := w.Flush(); err == nil {
+			err = flushErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,191 @@
+package lm2
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// Snapshot is a read-only view of a collection pinned
+// at a specific version.
+//
+// Like a cursor, a snapshot is open until it is closed, and automatic
+// compaction waits until no snapshots are open. A snapshot used after
+// the collection was compacted returns ErrCursorInvalidated.
+type Snapshot struct {
+	collection *Collection
+	version    int64
+	generation int64 // the collection's generation when created
+	latest     bool  // true if reads see the latest version
+	tracked    bool  // guarded by the collection's cursorLock
+}
+
+// Snapshot returns a snapshot of the current collection state.
+// Updates applied after Snapshot returns are not visible to it.
+// It should be closed when it is no longer needed.
+func (c *Collection) Snapshot() *Snapshot {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	return c.trackedSnapshot(c.LastCommit)
+}
+
+// trackedSnapshot returns a snapshot at version that is counted as open
+// until it is closed. The caller must hold metaLock.
+func (c *Collection) trackedSnapshot(version int64) *Snapshot {
+	s := c.snapshotAt(version)
+	s.tracked = true
+	c.cursorLock.Lock()
+	defer c.cursorLock.Unlock()
+	if c.snapshots == nil {
+		c.snapshots = map[*Snapshot]struct{}{}
+	}
+	c.snapshots[s] = struct{}{}
+	return s
+}
+
+// snapshotAt returns a snapshot at version that isn't counted as open.
+// The caller must hold metaLock.
+func (c *Collection) snapshotAt(version int64) *Snapshot {
+	return &Snapshot{
+		collection: c,
+		version:    version,
+		generation: atomic.LoadInt64(&c.generation),
+	}
+}
+
+// latestSnapshot returns a snapshot for lookups that isn't counted as
+// open. Each of its reads sees the latest version when it starts.
+func (c *Collection) latestSnapshot() *Snapshot {
+	return &Snapshot{
+		collection: c,
+		latest:     true,
+	}
+}
+
+// Version returns the collection version the snapshot is pinned at.
+func (s *Snapshot) Version() int64 {
+	return s.version
+}
+
+// Close closes the snapshot. Closing a snapshot again has no effect.
+func (s *Snapshot) Close() {
+	c := s.collection
+	c.cursorLock.Lock()
+	defer c.cursorLock.Unlock()
+	if s.tracked {
+		delete(c.snapshots, s)
+		s.tracked = false
+	}
+}
+
+// NewCursor returns a new cursor with the snapshot's view
+// of the collection.
+func (s *Snapshot) NewCursor() (*Cursor, error) {
+	s.collection.metaLock.RLock()
+	defer s.collection.metaLock.RUnlock()
+	if err := s.usable(); err != nil {
+		return nil, err
+	}
+	return s.collection.newTrackedCursor(s.version)
+}
+
+// newCursor returns a new cursor with the snapshot's view of the
+// collection that isn't counted as open, for lookups.
+func (s *Snapshot) newCursor() (*Cursor, error) {
+	s.collection.metaLock.RLock()
+	defer s.collection.metaLock.RUnlock()
+	if s.latest {
+		return s.collection.newCursor(s.collection.LastCommit)
+	}
+	if err := s.usable(); err != nil {
+		return nil, err
+	}
+	return s.collection.newCursor(s.version)
+}
+
+// usable returns an error if the collection has been compacted since the
+// snapshot was created, which renumbers versions. The caller must hold
+// metaLock.
+func (s *Snapshot) usable() error {
+	if s.generation != atomic.LoadInt64(&s.collection.generation) {
+		return ErrCursorInvalidated
+	}
+	return nil
+}
+
+// Get returns the value associated with key as of the snapshot's
+// version. ErrKeyNotFound is returned if key does not exist.
+func (s *Snapshot) Get(key string) (string, error) {
+	value, _, err := s.GetWithMeta(key)
+	return value, err
+}
+
+// GetWithMeta returns the value and metadata associated with key as of
+// the snapshot's version. ErrKeyNotFound is returned if key does not exist.
+func (s *Snapshot) GetWithMeta(key string) (string, map[string]string, error) {
+	if !s.collection.mayContain(key) {
+		return "", nil, ErrKeyNotFound
+	}
+	cur, err := s.newCursor()
+	if err != nil {
+		return "", nil, err
+	}
+	cur.Seek(key)
+	if cur.Next() && cur.Key() == key {
+		return cur.Value(), cur.Meta(), nil
+	}
+	if err = cur.Err(); err != nil {
+		return "", nil, err
+	}
+	return "", nil, ErrKeyNotFound
+}
+
+// Has returns true if key exists as of the snapshot's version. Keys that
+// aren't in the bloom filter, if there is one, are ruled out without
+// reading any records.
+func (s *Snapshot) Has(key string) (bool, error) {
+	if !s.collection.mayContain(key) {
+		return false, nil
+	}
+	cur, err := s.newCursor()
+	if err != nil {
+		return false, err
+	}
+	cur.Seek(key)
+	if cur.Next() && cur.Key() == key {
+		return true, nil
+	}
+	return false, cur.Err()
+}
+
+// GetMulti returns the values of keys as of the snapshot's version.
+// Keys that don't exist are left out of the result. The keys are looked
+// up in order with a single cursor, which is cheaper than calling Get
+// for each key.
+func (s *Snapshot) GetMulti(keys []string) (map[string]string, error) {
+	sorted := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if s.collection.mayContain(key) {
+			sorted = append(sorted, key)
+		}
+	}
+	sort.Strings(sorted)
+
+	values := map[string]string{}
+	if len(sorted) == 0 {
+		return values, nil
+	}
+	cur, err := s.newCursor()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range sorted {
+		cur.Seek(key)
+		if cur.Next() && cur.Key() == key {
+			values[key] = cur.Value()
+		}
+		if err = cur.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
@@ -8,6 +8,19 @@ type Stats struct {
 	RecordsRead    uint64
 	CacheHits      uint64
 	CacheMisses    uint64
+
+	// LiveRecords is the number of records that haven't been
+	// deleted or overwritten.
+	LiveRecords uint64
+	// DeletedRecords is the number of deleted or overwritten
+	// records that haven't been reclaimed by Compact yet.
+	DeletedRecords uint64
+	// FileSize is the size of the data file in bytes.
+	FileSize int64
+	// Version is the last committed version.
+	Version int64
+	// OpenCursors is the number of open cursors.
+	OpenCursors int
 }
 
 func (s *Stats) incRecordsWritten(count uint64) {
@@ -0,0 +1,78 @@
+package lm2
+
+import "time"
+
+// SyncPolicy controls when a collection fsyncs its data file and WAL.
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs on every commit. This is the default policy
+	// and the only one that guarantees a commit is durable once
+	// Update returns.
+	SyncAlways SyncPolicy = iota
+	// SyncPeriodic fsyncs in the background at a fixed interval.
+	// Commits made since the last sync may be lost after a crash.
+	SyncPeriodic
+	// SyncNever only fsyncs when Sync or Close is called.
+	// Commits made since the last sync may be lost after a crash.
+	SyncNever
+)
+
+// SetSyncPolicy sets the sync policy of the collection. interval is
+// only used by SyncPeriodic.
+//
+// Policies other than SyncAlways trade durability for throughput:
+// the OS may write pages out of order, so a crash can lose or
+// corrupt recent commits that haven't been synced yet.
+func (c *Collection) SetSyncPolicy(policy SyncPolicy, interval time.Duration) {
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+
+	c.stopPeriodicSync()
+	c.syncPolicy = policy
+	if c.wal != nil {
+		c.wal.noSync = policy != SyncAlways
+	}
+	if policy == SyncPeriodic {
+		c.syncStop = make(chan struct{})
+		c.syncDone = make(chan struct{})
+		go c.periodicSync(interval, c.syncStop, c.syncDone)
+	}
+}
+
+// Sync fsyncs the data file and WAL.
+func (c *Collection) Sync() error {
+	c.metaLock.RLock()
+	closed := c.closed
+	c.metaLock.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+	return c.sync()
+}
+
+func (c *Collection) periodicSync(interval time.Duration, stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.sync()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// stopPeriodicSync stops the background sync goroutine, if any,
+// and waits for it to exit.
+func (c *Collection) stopPeriodicSync() {
+	if c.syncStop == nil {
+		return
+	}
+	close(c.syncStop)
+	<-c.syncDone
+	c.syncStop = nil
+	c.syncDone = nil
+}
@@ -0,0 +1,43 @@
+package lm2
+
+import (
+	"context"
+	"time"
+)
+
+// Tracer receives the start and end of the operations reported to
+// Metrics, with the context they were called with, so that storage
+// latency can be recorded in distributed traces. An OpenTelemetry
+// tracer, for example, starts a span that is a child of the span in ctx
+// and ends it when the operation completes. Methods that don't take a
+// context, such as Get, pass context.Background(). Implementations must
+// be safe for concurrent use.
+type Tracer interface {
+	// StartOperation is called when an operation starts. It returns a
+	// function that is called with the operation's error when it
+	// completes.
+	StartOperation(ctx context.Context, op Operation) func(err error)
+}
+
+// SetTracer sets the tracer of the collection. It should be called
+// before the collection is used concurrently. A nil t disables tracing.
+func (c *Collection) SetTracer(t Tracer) {
+	c.tracer = t
+}
+
+// startOperation reports the start of op to the tracer, and returns a
+// function that reports its end to the tracer, metrics and logger.
+func (c *Collection) startOperation(ctx context.Context, op Operation) func(err error) {
+	start := time.Now()
+	var end func(error)
+	if c.tracer != nil {
+		end = c.tracer.StartOperation(ctx, op)
+	}
+	return func(err error) {
+		c.observe(op, start, err)
+		c.logOperation(op, time.Since(start), err)
+		if end != nil {
+			end(err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package lm2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// ErrInvalidTuple is returned when decoding a key
+// that wasn't encoded by EncodeTuple.
+var ErrInvalidTuple = errors.New("lm2: invalid tuple key")
+
+// Type tags of tuple elements. Elements of different types
+// sort in the order of their tags.
+const (
+	tupleString = 0x02
+	tupleInt    = 0x10
+	tupleFloat  = 0x20
+	tupleTime   = 0x30
+)
+
+// EncodeTuple encodes parts as a key that sorts, under the byte-wise
+// ordering of keys, like the parts compared one by one: two keys compare
+// like their first parts, or their second parts if the first ones are
+// equal, and so on. Parts may be strings, ints, int64s, float64s and
+// times; parts of different types sort by type in that order. A tuple
+// sorts before longer tuples that start with it, and its encoding is a
+// prefix of theirs, so it can be passed to SeekPrefix to iterate over
+// them. Times are encoded as Unix nanoseconds, without their location.
+func EncodeTuple(parts ...interface{}) (string, error) {
+	var b []byte
+	for _, part := range parts {
+		switch v := part.(type) {
+		case string:
+			b = append(b, tupleString)
+			// Escape NULs so that the terminator sorts first.
+			b = append(b, strings.Replace(v, "\x00", "\x00\xff", -1)...)
+			b = append(b, 0)
+		case int:
+			b = appendTupleInt(b, tupleInt, int64(v))
+		case int64:
+			b = appendTupleInt(b, tupleInt, v)
+		case float64:
+			bits := math.Float64bits(v)
+			if bits&(1<<63) != 0 {
+				// Negative numbers sort in reverse order of their bits.
+				bits = ^bits
+			} else {
+				bits |= 1 << 63
+			}
+			b = append(b, tupleFloat)
+			b = appendUint64(b, bits)
+		case time.Time:
+			b = appendTupleInt(b, tupleTime, v.UnixNano())
+		default:
+			return "", fmt.Errorf("lm2: can't encode %T in a tuple", part)
+		}
+	}
+	return string(b), nil
+}
+
+// DecodeTuple decodes a key encoded by EncodeTuple. Ints are decoded
+// as int64s and times are decoded in UTC.
+func DecodeTuple(key string) ([]interface{}, error) {
+	var parts []interface{}
+	for len(key) > 0 {
+		tag := key[0]
+		key = key[1:]
+		switch tag {
+		case tupleString:
+			var s []byte
+			for {
+				i := strings.IndexByte(key, 0)
+				if i < 0 {
+					return nil, ErrInvalidTuple
+				}
+				s = append(s, key[:i]...)
+				key = key[i+1:]
+				if len(key) == 0 || key[0] != 0xff {
+					break
+				}
+				s = append(s, 0)
+				key = key[1:]
+			}
+			parts = append(parts, string(s))
+		case tupleInt, tupleFloat, tupleTime:
+			if len(key) < 8 {
+				return nil, ErrInvalidTuple
+			}
+			bits := binary.BigEndian.Uint64([]byte(key[:8]))
+			key = key[8:]
+			switch tag {
+			case tupleInt:
+				parts = append(parts, int64(bits^(1<<63)))
+			case tupleFloat:
+				if bits&(1<<63) != 0 {
+					bits &^= 1 << 63
+				} else {
+					bits = ^bits
+				}
+				parts = append(parts, math.Float64frombits(bits))
+			case tupleTime:
+				parts = append(parts, time.Unix(0, int64(bits^(1<<63))).UTC())
+			}
+		default:
+			return nil, ErrInvalidTuple
+		}
+	}
+	return parts, nil
+}
+
+// appendTupleInt appends v as an element with tag to b. The sign bit is
+// flipped so that negative numbers sort before positive ones.
+func appendTupleInt(b []byte, tag byte, v int64) []byte {
+	b = append(b, tag)
+	return appendUint64(b, uint64(v)^(1<<63))
+}
+
+// appendUint64 appends v to b in big-endian order,
+// which sorts like the numbers.
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
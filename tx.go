@@ -0,0 +1,142 @@
+package lm2
+
+import (
+	"context"
+	"time"
+)
+
+// Tx is a read-write transaction. Reads see the collection as of the
+// time the transaction began, along with the transaction's own writes.
+// Writes are buffered until Commit and are never visible to other
+// readers before then.
+//
+// Transactions are optimistic: Commit fails with ErrTxConflict if any
+// key the transaction read or wrote was modified by another update
+// after the transaction began. A Tx must not be used concurrently, and
+// its snapshot is open until it is committed or rolled back.
+type Tx struct {
+	collection *Collection
+	snapshot   *Snapshot
+	wb         *WriteBatch
+	keys       map[string]struct{}
+	done       bool
+}
+
+// Begin starts a new transaction.
+func (c *Collection) Begin() *Tx {
+	return &Tx{
+		collection: c,
+		snapshot:   c.Snapshot(),
+		wb:         NewWriteBatch(),
+		keys:       map[string]struct{}{},
+	}
+}
+
+// Get returns the value associated with key as seen by the transaction.
+// ErrKeyNotFound is returned if key does not exist.
+func (tx *Tx) Get(key string) (string, error) {
+	if tx.done {
+		return "", ErrTxDone
+	}
+	if _, ok := tx.wb.deletes[key]; ok {
+		return "", ErrKeyNotFound
+	}
+	if value, ok := tx.wb.sets[key]; ok {
+		return value, nil
+	}
+	tx.keys[key] = struct{}{}
+	return tx.snapshot.Get(key)
+}
+
+// Set sets key to value in the transaction.
+func (tx *Tx) Set(key, value string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	delete(tx.wb.deletes, key)
+	tx.wb.Set(key, value)
+	tx.keys[key] = struct{}{}
+	return nil
+}
+
+// SetWithTTL sets key to value in the transaction. The record
+// expires ttl after SetWithTTL is called.
+func (tx *Tx) SetWithTTL(key, value string, ttl time.Duration) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	delete(tx.wb.deletes, key)
+	tx.wb.SetWithTTL(key, value, ttl)
+	tx.keys[key] = struct{}{}
+	return nil
+}
+
+// Delete deletes key in the transaction.
+func (tx *Tx) Delete(key string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	delete(tx.wb.sets, key)
+	delete(tx.wb.expires, key)
+	tx.wb.Delete(key)
+	tx.keys[key] = struct{}{}
+	return nil
+}
+
+// Commit atomically applies the transaction's writes and returns the
+// new collection version. ErrTxConflict is returned, and nothing is
+// written, if another update modified a key the transaction used.
+func (tx *Tx) Commit() (int64, error) {
+	if tx.done {
+		return 0, ErrTxDone
+	}
+	tx.done = true
+	defer tx.snapshot.Close()
+
+	c := tx.collection
+	if len(tx.wb.sets) == 0 && len(tx.wb.deletes) == 0 {
+		// Reads are always consistent with the snapshot.
+		return tx.snapshot.Version(), nil
+	}
+	if c.readOnly {
+		return 0, ErrReadOnly
+	}
+	if err := tx.wb.checkReserved(); err != nil {
+		return 0, err
+	}
+
+	done := c.startOperation(context.Background(), OpUpdate)
+	version, err := c.update(tx.wb, func() error {
+		for key := range tx.keys {
+			modified, err := c.modifiedSince(key, tx.snapshot.Version())
+			if err != nil {
+				return err
+			}
+			if modified {
+				return ErrTxConflict
+			}
+		}
+		return nil
+	})
+	done(err)
+	return version, err
+}
+
+// Rollback discards the transaction's writes. Calling Rollback
+// after Commit has no effect.
+func (tx *Tx) Rollback() {
+	tx.done = true
+	tx.wb = NewWriteBatch()
+	tx.snapshot.Close()
+}
+
+// modifiedSince returns true if a record with key was set or deleted
+// by an update committed after version. The caller must hold metaLock.
+func (c *Collection) modifiedSince(key string, version int64) (bool, error) {
+	modified := false
+	err := c.walkKey(key, func(rec *record) bool {
+		modified = rec.Offset >= version || (rec.Deleted != 0 && rec.Deleted > version)
+		return !modified
+	})
+	return modified, err
+}
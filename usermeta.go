@@ -0,0 +1,63 @@
+package lm2
+
+import "strings"
+
+// metaKeyPrefix is the reserved key prefix under which
+// the collection's metadata is stored.
+const metaKeyPrefix = "\x00m"
+
+// metaKey returns the key that stores the metadata
+// entry with the given name.
+func metaKey(name string) string {
+	return metaKeyPrefix + name
+}
+
+// isMetaKey returns true if key is the key of a metadata entry.
+func isMetaKey(key string) bool {
+	return strings.HasPrefix(key, metaKeyPrefix)
+}
+
+// SetMeta sets the metadata entry with the given name to value in the
+// WriteBatch, so that it is committed with the data it describes, such
+// as a replication cursor with the changes it covers.
+func (wb *WriteBatch) SetMeta(name, value string) {
+	key := metaKey(name)
+	wb.Set(key, value)
+	wb.entries[key] = struct{}{}
+}
+
+// DeleteMeta marks the metadata entry with the given name for deletion.
+func (wb *WriteBatch) DeleteMeta(name string) {
+	key := metaKey(name)
+	wb.Delete(key)
+	wb.entries[key] = struct{}{}
+}
+
+// SetMeta sets the metadata entry with the given name to value in a
+// single update. Metadata entries describe the collection itself, such as
+// its schema version, rather than a value like the metadata set with
+// SetWithMeta. They are stored in the collection under reserved keys, so
+// they are compacted and backed up with the rest of the collection,
+// incremental backups included, but they aren't changes returned by
+// ChangesSince or delivered to subscriptions.
+func (c *Collection) SetMeta(name, value string) error {
+	wb := NewWriteBatch()
+	wb.SetMeta(name, value)
+	_, err := c.Update(wb)
+	return err
+}
+
+// DeleteMeta deletes the metadata entry with the given name in a single
+// update. Deleting an entry that hasn't been set has no effect.
+func (c *Collection) DeleteMeta(name string) error {
+	wb := NewWriteBatch()
+	wb.DeleteMeta(name)
+	_, err := c.Update(wb)
+	return err
+}
+
+// GetMeta returns the value of the metadata entry with the given name.
+// ErrKeyNotFound is returned if it hasn't been set.
+func (c *Collection) GetMeta(name string) (string, error) {
+	return c.Get(metaKey(name))
+}
@@ -0,0 +1,97 @@
+package lm2
+
+import "fmt"
+
+// VerifyReport describes the result of a collection verification.
+type VerifyReport struct {
+	// Records is the number of records checked.
+	Records int
+	// Problems lists every inconsistency found.
+	Problems []RecordProblem
+}
+
+// OK returns true if no problems were found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// RecordProblem describes an inconsistency found at a record offset.
+type RecordProblem struct {
+	Offset  int64
+	Problem string
+}
+
+func (p RecordProblem) String() string {
+	return fmt.Sprintf("offset %d: %s", p.Offset, p.Problem)
+}
+
+func (r *VerifyReport) addProblem(offset int64, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, RecordProblem{
+		Offset:  offset,
+		Problem: fmt.Sprintf(format, args...),
+	})
+}
+
+// Verify walks every record in the collection and checks the
+// consistency of the record chain. It returns a report of any
+// inconsistencies found. An error is only returned if the
+// verification could not be performed.
+func (c *Collection) Verify() (*VerifyReport, error) {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+	report := &VerifyReport{}
+
+	if c.Head == 0 {
+		return report, nil
+	}
+
+	inRange := func(offset int64) bool {
+		return offset >= fileHeaderSize && offset < c.LastCommit
+	}
+
+	if !inRange(c.Head) {
+		report.addProblem(0, "head offset %d out of range", c.Head)
+		return report, nil
+	}
+
+	prevKey, prevOffset := "", int64(0)
+	offset := c.Head
+	for offset != 0 {
+		rec, err := c.readRecord(offset)
+		if err != nil {
+			report.addProblem(offset, "unreadable record: %v", err)
+			break
+		}
+		report.Records++
+
+		rec.lock.RLock()
+		next := rec.Next
+		if rec.Key < prevKey {
+			rec.lock.RUnlock()
+			report.addProblem(offset, "key %q is less than previous key %q", rec.Key, prevKey)
+			break
+		}
+		if rec.Key == prevKey && rec.Offset <= prevOffset {
+			rec.lock.RUnlock()
+			report.addProblem(offset, "record of key %q is out of order after offset %d", rec.Key, prevOffset)
+			break
+		}
+		if rec.Deleted != 0 && (rec.Deleted <= rec.Offset || rec.Deleted > c.LastCommit) {
+			report.addProblem(offset, "deleted offset %d out of range", rec.Deleted)
+		}
+		prevKey, prevOffset = rec.Key, rec.Offset
+		rec.lock.RUnlock()
+
+		if next != 0 && !inRange(next) {
+			report.addProblem(offset, "next offset %d out of range", next)
+			break
+		}
+		offset = next
+	}
+
+	return report, nil
+}
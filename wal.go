@@ -3,7 +3,8 @@ package lm2
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
+	"fmt"
+	"io"
 	"os"
 )
 
@@ -13,9 +14,10 @@ const (
 )
 
 type wal struct {
-	f              *os.File
+	f              file
 	fileSize       int64
 	lastGoodOffset int64
+	noSync         bool
 }
 
 type walEntryHeader struct {
@@ -108,16 +110,20 @@ func newWAL(filename string) (*wal, error) {
 		f.Close()
 		return nil, err
 	}
+	return newWALFile(f), nil
+}
+
+func newWALFile(f file) *wal {
 	return &wal{
 		f: f,
-	}, nil
+	}
 }
 
 func (w *wal) Append(entry *walEntry) (int64, error) {
 	startOffset, err := w.f.Seek(0, 2)
 	if err != nil {
 		w.Truncate()
-		return 0, errors.New("lm2: couldn't get offset")
+		return 0, fmt.Errorf("lm2: couldn't get offset: %w", err)
 	}
 	entry.StartOffset = startOffset
 
@@ -143,19 +149,21 @@ func (w *wal) Append(entry *walEntry) (int64, error) {
 
 	if n != buf.Len() {
 		w.Truncate()
-		return 0, errors.New("lm2: incomplete WAL write")
+		return 0, fmt.Errorf("lm2: incomplete WAL write: %w", io.ErrShortWrite)
 	}
 
 	currentOffset, err := w.f.Seek(0, 2)
 	if err != nil {
 		w.Truncate()
-		return 0, errors.New("lm2: couldn't get offset")
+		return 0, fmt.Errorf("lm2: couldn't get offset: %w", err)
 	}
 
-	err = w.f.Sync()
-	if err != nil {
-		w.Truncate()
-		return 0, err
+	if !w.noSync {
+		err = w.f.Sync()
+		if err != nil {
+			w.Truncate()
+			return 0, err
+		}
 	}
 
 	w.lastGoodOffset = currentOffset
@@ -167,22 +175,22 @@ func (w *wal) ReadLastEntry() (*walEntry, error) {
 	const footerSize = 12
 	_, err := w.f.Seek(-footerSize, 2)
 	if err != nil {
-		return nil, errors.New("lm2: error seeking to WAL footer")
+		return nil, fmt.Errorf("lm2: error seeking to WAL footer: %w", err)
 	}
 	footer := walEntryFooter{}
 	err = binary.Read(w.f, binary.LittleEndian, &footer)
 	if err != nil {
-		return nil, errors.New("lm2: error reading WAL footer")
+		return nil, fmt.Errorf("lm2: error reading WAL footer: %w", err)
 	}
 	if footer.Magic != walFooterMagic {
-		return nil, errors.New("lm2: invalid WAL footer magic")
+		return nil, errCorrupt("invalid WAL footer magic")
 	}
 
 	// Read entry.
 
 	_, err = w.f.Seek(footer.StartOffset, 0)
 	if err != nil {
-		return nil, errors.New("lm2: error seeking to WAL entry start")
+		return nil, fmt.Errorf("lm2: error seeking to WAL entry start: %w", err)
 	}
 
 	return w.ReadEntry()
@@ -198,19 +206,26 @@ func (w *wal) ReadEntry() (*walEntry, error) {
 
 	err := binary.Read(w.f, binary.LittleEndian, &entry.walEntryHeader)
 	if err != nil {
-		return nil, errors.New("lm2: error reading WAL entry header")
+		return nil, fmt.Errorf("lm2: error reading WAL entry header: %w", err)
 	}
 	if entry.walEntryHeader.Magic != walMagic {
-		return nil, errors.New("lm2: invalid WAL header magic")
+		return nil, errCorrupt("invalid WAL header magic")
 	}
 
+	info, err := w.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if entry.Length < 0 || entry.Length > info.Size() {
+		return nil, errCorrupt("invalid WAL entry length %d", entry.Length)
+	}
 	b := make([]byte, int(entry.walEntryHeader.Length))
 	n, err := w.f.Read(b)
 	if err != nil {
-		return nil, errors.New("lm2: error reading WAL body")
+		return nil, fmt.Errorf("lm2: error reading WAL body: %w", err)
 	}
 	if n != len(b) {
-		return nil, errors.New("lm2: partial read")
+		return nil, errCorrupt("partial read of WAL entry")
 	}
 
 	r := bytes.NewReader(b)
@@ -220,15 +235,18 @@ func (w *wal) ReadEntry() (*walEntry, error) {
 		recHeader := walRecordHeader{}
 		err = binary.Read(r, binary.LittleEndian, &recHeader)
 		if err != nil {
-			return nil, errors.New("lm2: error reading WAL record header")
+			return nil, fmt.Errorf("lm2: error reading WAL record header: %w", err)
+		}
+		if recHeader.Size < 0 || recHeader.Size > int64(r.Len()) {
+			return nil, errCorrupt("invalid WAL record size %d", recHeader.Size)
 		}
 		walRecordBytes := make([]byte, int(recHeader.Size))
 		n, err := r.Read(walRecordBytes)
 		if err != nil {
-			return nil, errors.New("lm2: error reading WAL record body")
+			return nil, fmt.Errorf("lm2: error reading WAL record body: %w", err)
 		}
 		if n != len(walRecordBytes) {
-			return nil, errors.New("lm2: partial read")
+			return nil, errCorrupt("partial read of WAL entry")
 		}
 
 		entry.Push(newWALRecord(recHeader.Offset, walRecordBytes))
@@ -240,12 +258,12 @@ func (w *wal) ReadEntry() (*walEntry, error) {
 	}
 
 	if entry.walEntryFooter.Magic != walFooterMagic {
-		return nil, errors.New("lm2: invalid WAL footer magic")
+		return nil, errCorrupt("invalid WAL footer magic")
 	}
 
 	currentOffset, err := w.f.Seek(0, 2)
 	if err != nil {
-		return nil, errors.New("lm2: couldn't get offset")
+		return nil, fmt.Errorf("lm2: couldn't get offset: %w", err)
 	}
 
 	w.lastGoodOffset = currentOffset
@@ -257,8 +275,8 @@ func (w *wal) Truncate() error {
 	return w.f.Truncate(w.lastGoodOffset)
 }
 
-func (w *wal) Close() {
-	w.f.Close()
+func (w *wal) Close() error {
+	return w.f.Close()
 }
 
 func (w *wal) Destroy() error {
@@ -1,16 +1,31 @@
 package lm2
 
+import "time"
+
 // WriteBatch represents a set of modifications.
 type WriteBatch struct {
 	sets    map[string]string
+	expires map[string]int64
+	merges  map[string][]string
 	deletes map[string]struct{}
+	meta    map[string]map[string]string
+	entries map[string]struct{} // keys of the metadata entries updated
+
+	// Set while an update is applied: the keys with shared values mapped
+	// to the keys of the values, and the offsets of existing shared values.
+	shared map[string]string
+	blobs  map[string]int64
 }
 
 // NewWriteBatch returns a new WriteBatch.
 func NewWriteBatch() *WriteBatch {
 	return &WriteBatch{
 		sets:    map[string]string{},
+		expires: map[string]int64{},
+		merges:  map[string][]string{},
 		deletes: map[string]struct{}{},
+		meta:    map[string]map[string]string{},
+		entries: map[string]struct{}{},
 	}
 }
 
@@ -19,6 +34,36 @@ func NewWriteBatch() *WriteBatch {
 // then the Set will be ignored.
 func (wb *WriteBatch) Set(key, value string) {
 	wb.sets[key] = value
+	delete(wb.expires, key)
+	delete(wb.meta, key)
+}
+
+// SetWithTTL adds key => value to the WriteBatch. The record
+// expires ttl after SetWithTTL is called, after which it is
+// no longer visible and is removed by compaction.
+func (wb *WriteBatch) SetWithTTL(key, value string, ttl time.Duration) {
+	wb.setExpiresAt(key, value, time.Now().Add(ttl).UnixNano())
+}
+
+// setExpiresAt adds key => value to the WriteBatch that expires at
+// expires, in Unix nanoseconds. An expires of 0 means no expiration.
+func (wb *WriteBatch) setExpiresAt(key, value string, expires int64) {
+	wb.sets[key] = value
+	delete(wb.meta, key)
+	if expires == 0 {
+		delete(wb.expires, key)
+		return
+	}
+	wb.expires[key] = expires
+}
+
+// Merge adds a merge of operand into key to the WriteBatch. Merges
+// are applied in order with the collection's MergeFunc when the batch
+// is committed, after any Set of key in the same batch.
+// Note: If a key is passed to Delete and Merge,
+// then the Merge will be ignored.
+func (wb *WriteBatch) Merge(key, operand string) {
+	wb.merges[key] = append(wb.merges[key], operand)
 }
 
 // Delete marks a key for deletion.
@@ -29,5 +74,8 @@ func (wb *WriteBatch) Delete(key string) {
 func (wb *WriteBatch) cleanup() {
 	for key := range wb.deletes {
 		delete(wb.sets, key)
+		delete(wb.expires, key)
+		delete(wb.merges, key)
+		delete(wb.meta, key)
 	}
 }